@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func commandNames(list []*command) string {
+	names := make([]string, len(list))
+	for i, cmd := range list {
+		names[i] = cmd.name
+	}
+	return strings.Join(names, " ")
+}
+
+//completionPath collects the command path from words before the cursor,
+//global flags are skipped together with their values: -server URL or -server=URL
+func completionPath(word, end, start string) string {
+	return fmt.Sprintf("\tfor ((i = %s; i < %s; i++)); do\n", start, end) +
+		fmt.Sprintf("\t\tcase \"${%s}\" in\n", word) +
+		"\t\t-*=*) ;;\n" +
+		"\t\t-*) ((i++)) ;;\n" +
+		fmt.Sprintf("\t\t*) cmd+=(\"${%s}\") ;;\n", word) +
+		"\t\tesac\n" +
+		"\tdone\n"
+}
+
+//completion prints script generated from the command tree:
+//	source <(godockerctl completion bash)
+func completion(a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var script strings.Builder
+	switch args[0] {
+	case "bash":
+		script.WriteString("_godockerctl() {\n")
+		script.WriteString("\tlocal line=\"${COMP_LINE:0:COMP_POINT}\" cur=\"\" words=\"\" cmd=() args=() i\n")
+		//COMP_WORDS breaks -server=URL at "=" and ":", so the line is split by spaces
+		script.WriteString("\tread -ra args <<< \"$line\"\n")
+		script.WriteString("\tif [[ \"$line\" != *\" \" ]]; then\n")
+		script.WriteString("\t\tcur=\"${args[${#args[@]}-1]}\"\n")
+		script.WriteString("\t\tunset 'args[${#args[@]}-1]'\n")
+		script.WriteString("\tfi\n")
+		script.WriteString(completionPath("args[i]", "${#args[@]}", "1"))
+		script.WriteString("\tcase \"${cmd[*]}\" in\n")
+		for _, cmd := range commands {
+			if len(cmd.sub) > 0 {
+				fmt.Fprintf(&script, "\t%s) words=\"%s\" ;;\n", cmd.name, commandNames(cmd.sub))
+			}
+		}
+		script.WriteString("\tcompletion) words=\"bash zsh\" ;;\n")
+		fmt.Fprintf(&script, "\t\"\") words=\"%s\" ;;\n", commandNames(commands))
+		script.WriteString("\tesac\n")
+		script.WriteString("\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+		script.WriteString("}\n")
+		script.WriteString("complete -F _godockerctl godockerctl\n")
+	case "zsh":
+		script.WriteString("#compdef godockerctl\n")
+		script.WriteString("_godockerctl() {\n")
+		script.WriteString("\tlocal -a cmd\n")
+		script.WriteString("\tlocal i\n")
+		script.WriteString(completionPath("words[i]", "CURRENT", "2"))
+		script.WriteString("\tcase \"${cmd[*]}\" in\n")
+		for _, cmd := range commands {
+			if len(cmd.sub) > 0 {
+				fmt.Fprintf(&script, "\t%s) compadd %s ;;\n", cmd.name, commandNames(cmd.sub))
+			}
+		}
+		script.WriteString("\tcompletion) compadd bash zsh ;;\n")
+		fmt.Fprintf(&script, "\t\"\") compadd %s ;;\n", commandNames(commands))
+		script.WriteString("\tesac\n")
+		script.WriteString("}\n")
+		script.WriteString("compdef _godockerctl godockerctl\n")
+	default:
+		return fmt.Errorf("unknown shell %q", args[0])
+	}
+	_, err := fmt.Fprint(a.stdout, script.String())
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//config - file with profiles:
+//
+//	current: local
+//	profiles:
+//	  local:
+//	    server: http://localhost:15000
+//	  prod:
+//	    server: https://users.example.com
+//	    token: secret
+//	    output: json
+type config struct {
+	Current  string             `yaml:"current"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+type profile struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+	Output string `yaml:"output"`
+}
+
+//override replaces fields which are set in v
+func (p *profile) override(v profile) {
+	if v.Server != "" {
+		p.Server = v.Server
+	}
+	if v.Token != "" {
+		p.Token = v.Token
+	}
+	if v.Output != "" {
+		p.Output = v.Output
+	}
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv("GODOCKERCTL_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "godockerctl", "config.yaml")
+}
+
+//loadProfile reads profile name from the config, current profile is used
+//if name is empty. Missing config is fine unless a profile is asked for
+func loadProfile(path, name string) (profile, error) {
+	var cfg config
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) || path == "" {
+		if name != "" {
+			return profile{}, fmt.Errorf("profile %q: no config file %s", name, path)
+		}
+		return profile{}, nil
+	}
+	if err != nil {
+		return profile{}, err
+	}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return profile{}, fmt.Errorf("config %s: %v", path, err)
+	}
+	if name == "" {
+		name = cfg.Current
+	}
+	if name == "" {
+		return profile{}, nil
+	}
+	prof, ok := cfg.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("unknown profile %q in %s", name, path)
+	}
+	return prof, nil
+}
@@ -0,0 +1,161 @@
+//godockerctl manages users of the server from the command line
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/NektarinR/godocker/pkg/client"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//defaultServer - address of the server started with docker-compose
+const defaultServer = "http://localhost:15000"
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	name  string
+	usage string
+	run   func(a *app, args []string) error
+	sub   []*command
+}
+
+//commands is the only description of the command tree,
+//it is used for dispatch, help and shell completion
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "users", usage: "manage users", sub: []*command{
+			{name: "list", usage: "list users: [-offset N] [-limit N] [-all]", run: usersList},
+			{name: "get", usage: "show user: ID", run: usersGet},
+			{name: "create", usage: "create user: -name NAME [-email EMAIL] [-status active|suspended]", run: usersCreate},
+			{name: "update", usage: "update user: ID [-name NAME] [-email EMAIL] [-status active|suspended] [-version N]", run: usersUpdate},
+			{name: "delete", usage: "delete user: ID [-version N]", run: usersDelete},
+			{name: "export", usage: "stream users: [-name FILTER] [-format ndjson|csv]", run: usersExport},
+			{name: "import", usage: "create users from NDJSON or JSON array: [-batch N] FILE|-", run: usersImport},
+		}},
+		{name: "ping", usage: "check that the server answers", run: ping},
+		{name: "health", usage: "show server status and latency", run: health},
+		{name: "completion", usage: "print shell completion script: bash|zsh", run: completion},
+	}
+}
+
+type app struct {
+	client  *client.Client
+	out     *output
+	stdin   io.Reader
+	stdout  io.Writer
+	timeout time.Duration
+	server  string
+}
+
+//context of one command, limited by -timeout
+func (p *app) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.timeout)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("godockerctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", defaultConfigPath(), "config file with profiles")
+	profileName := flags.String("profile", os.Getenv("GODOCKERCTL_PROFILE"), "profile of the config file")
+	server := flags.String("server", "", "address of the server, "+defaultServer+" by default")
+	token := flags.String("token", "", "admin token")
+	format := flags.String("o", "", "output format: table, json or yaml")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of the command")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: godockerctl [flags] command [args]")
+		printCommands(stderr, commands, "  ")
+		fmt.Fprintln(stderr, "flags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	prof, err := loadProfile(*configPath, *profileName)
+	if err != nil {
+		fmt.Fprintf(stderr, "godockerctl: %v\n", err)
+		return 1
+	}
+	prof.override(profile{
+		Server: firstNonEmpty(*server, os.Getenv("GODOCKERCTL_SERVER")),
+		Token:  firstNonEmpty(*token, os.Getenv("GODOCKERCTL_TOKEN")),
+		Output: *format,
+	})
+	if prof.Server == "" {
+		prof.Server = defaultServer
+	}
+	out, err := newOutput(prof.Output, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "godockerctl: %v\n", err)
+		return 2
+	}
+	c := client.New(prof.Server)
+	c.Token = prof.Token
+	a := &app{
+		client:  c,
+		out:     out,
+		stdin:   stdin,
+		stdout:  stdout,
+		timeout: *timeout,
+		server:  prof.Server,
+	}
+	cmd, rest := findCommand(commands, flags.Args())
+	if cmd == nil || cmd.run == nil {
+		flags.Usage()
+		return 2
+	}
+	if err := cmd.run(a, rest); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(stderr, "usage: %s\n", cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(stderr, "godockerctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+//findCommand walks the tree by args, returns the deepest command found
+func findCommand(list []*command, args []string) (*command, []string) {
+	var found *command
+	for len(args) > 0 {
+		var next *command
+		for _, cmd := range list {
+			if cmd.name == args[0] {
+				next = cmd
+			}
+		}
+		if next == nil {
+			break
+		}
+		found, list, args = next, next.sub, args[1:]
+	}
+	return found, args
+}
+
+func printCommands(w io.Writer, list []*command, indent string) {
+	for _, cmd := range list {
+		fmt.Fprintf(w, "%s%-12s %s\n", indent, cmd.name, cmd.usage)
+		printCommands(w, cmd.sub, indent+"  ")
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
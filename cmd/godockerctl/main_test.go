@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/NektarinR/godocker/pkg/server"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type TestCase struct {
+	Args   []string
+	Stdin  string
+	Code   int
+	Stdout string
+}
+
+func newTestServer() *httptest.Server {
+	db, _ := repository.NewPostgresDBMock()
+	return httptest.NewServer(server.NewServer(db))
+}
+
+func runTest(t *testing.T, testCase *TestCase) string {
+	var stdout, stderr bytes.Buffer
+	code := run(testCase.Args, strings.NewReader(testCase.Stdin), &stdout, &stderr)
+	if code != testCase.Code {
+		t.Errorf("%v: wrong exit code, got %d expected %d, stderr %s\n",
+			testCase.Args, code, testCase.Code, stderr.String())
+	}
+	if testCase.Stdout != "" && stdout.String() != testCase.Stdout {
+		t.Errorf("%v: expected %q, got %q\n", testCase.Args, testCase.Stdout, stdout.String())
+	}
+	return stdout.String()
+}
+
+func TestRun_Users(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	base := []string{"-config", "", "-server", ts.URL}
+	created := "1970-01-01T00:00:10Z"
+	runTest(t, &TestCase{
+		Args: append(base, "users", "list", "-limit", "2"),
+		Code: 0,
+		Stdout: "ID  NAME      EMAIL  STATUS  CREATED               VERSION  DELETED\n" +
+			"1   Vasy             active  " + created + "  1        \n" +
+			"2   VasyVasy         active  " + created + "  1        \n",
+	})
+	runTest(t, &TestCase{
+		Args: append(base, "-o", "yaml", "users", "get", "1"),
+		Code: 0,
+		Stdout: "id: 1\nname: Vasy\nstatus: active\ncreated_on: 1970-01-01T00:00:10.00000001Z\n" +
+			"updated_on: 1970-01-01T00:00:10.00000001Z\nversion: 1\n",
+	})
+	out := runTest(t, &TestCase{
+		Args: append(base, "-o", "json", "users", "update", "2", "-name", "Pety", "-version", "1"),
+		Code: 0,
+	})
+	var usr api.User
+	if err := json.Unmarshal([]byte(out), &usr); err != nil || usr.Name != "Pety" || usr.Version != 2 {
+		t.Errorf("expected updated user, got %v %v\n", out, err)
+	}
+	//fields which are not given keep their values
+	out = runTest(t, &TestCase{
+		Args: append(base, "-o", "json", "users", "update", "2", "-email", "pety@example.com", "-status", "suspended"),
+		Code: 0,
+	})
+	if err := json.Unmarshal([]byte(out), &usr); err != nil || usr.Name != "Pety" ||
+		usr.Email != "pety@example.com" || usr.Status != "suspended" || usr.Version != 3 {
+		t.Errorf("expected updated user, got %v %v\n", out, err)
+	}
+	runTest(t, &TestCase{Args: append(base, "users", "update", "2", "-version", "1"), Code: 2})
+	runTest(t, &TestCase{Args: append(base, "users", "delete", "2"), Code: 0})
+	runTest(t, &TestCase{Args: append(base, "users", "delete", "2"), Code: 1})
+	runTest(t, &TestCase{Args: append(base, "users", "get", "x"), Code: 1})
+	runTest(t, &TestCase{Args: append(base, "users", "create"), Code: 2})
+	runTest(t, &TestCase{Args: append(base, "users", "rename"), Code: 2})
+}
+
+func TestRun_UsersImport(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	runTest(t, &TestCase{
+		Args:  []string{"-config", "", "-server", ts.URL, "users", "import", "-batch", "1", "-"},
+		Stdin: "{\"name\":\"Kolya\"}\n{\"name\":\" \"}\n",
+		Code:  1,
+		Stdout: "INDEX  STATUS  ID  ERROR\n" +
+			"0      201     6   \n" +
+			"1      400         name is required\n",
+	})
+}
+
+func TestRun_UsersExport(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	runTest(t, &TestCase{
+		Args: []string{"-config", "", "-server", ts.URL, "users", "export", "-name", "pety", "-format", "csv"},
+		Code: 0,
+		Stdout: "id,name,email,status,created_on,updated_on,version,deleted_on\n" +
+			"3,Pety,,active,1970-01-01T00:00:10.00000001Z,1970-01-01T00:00:10.00000001Z,1,\n" +
+			"4,PetyPety,,active,1970-01-01T00:00:10.00000001Z,1970-01-01T00:00:10.00000001Z,1,\n",
+	})
+}
+
+func TestRun_Profiles(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "godockerctl")
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	config := "current: broken\nprofiles:\n" +
+		"  broken:\n    server: http://127.0.0.1:1\n" +
+		"  test:\n    server: " + ts.URL + "\n    output: json\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	runTest(t, &TestCase{Args: []string{"-config", path, "-timeout", "1s", "ping"}, Code: 1})
+	runTest(t, &TestCase{Args: []string{"-config", path, "-profile", "test", "ping"}, Code: 0, Stdout: "pong\n"})
+	runTest(t, &TestCase{Args: []string{"-config", path, "-server", ts.URL, "ping"}, Code: 0, Stdout: "pong\n"})
+	runTest(t, &TestCase{Args: []string{"-config", path, "-profile", "prod", "ping"}, Code: 1})
+	out := runTest(t, &TestCase{Args: []string{"-config", path, "-profile", "test", "health"}, Code: 0})
+	var status healthStatus
+	if err := json.Unmarshal([]byte(out), &status); err != nil || status.Status != "ok" {
+		t.Errorf("expected ok health in JSON, got %v %v\n", out, err)
+	}
+}
+
+func TestRun_Completion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		out := runTest(t, &TestCase{Args: []string{"-config", "", "completion", shell}, Code: 0})
+		for _, word := range []string{"users", "health", "import", "export"} {
+			if !strings.Contains(out, word) {
+				t.Errorf("%s completion: expected %q in %s\n", shell, word, out)
+			}
+		}
+	}
+	runTest(t, &TestCase{Args: []string{"-config", "", "completion", "fish"}, Code: 1})
+}
+
+func TestRun_CompletionBash(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	script := runTest(t, &TestCase{Args: []string{"-config", "", "completion", "bash"}, Code: 0})
+	cases := []struct {
+		Line     string
+		Expected string
+	}{
+		{Line: "godockerctl ", Expected: "users ping health completion"},
+		{Line: "godockerctl us", Expected: "users"},
+		{Line: "godockerctl users ", Expected: "list get create update delete export import"},
+		{Line: "godockerctl -server http://localhost:15000 -o json users ", Expected: "list get create update delete export import"},
+		{Line: "godockerctl -server=http://localhost:15000 users ex", Expected: "export"},
+		{Line: "godockerctl -profile prod completion ", Expected: "bash zsh"},
+		{Line: "godockerctl users list ", Expected: ""},
+	}
+	for _, c := range cases {
+		cmd := exec.Command("bash", "-c", script+
+			`COMP_LINE="$1"; COMP_POINT=${#COMP_LINE}; _godockerctl; echo "${COMPREPLY[*]}"`, "bash", c.Line)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%q: expected nil, got %v\n", c.Line, err)
+		}
+		if got := strings.TrimSpace(string(out)); got != c.Expected {
+			t.Errorf("%q: expected %q, got %q\n", c.Line, c.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/NektarinR/godocker/pkg/api"
+	"gopkg.in/yaml.v2"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type output struct {
+	format string
+	w      io.Writer
+}
+
+func newOutput(format string, w io.Writer) (*output, error) {
+	switch format {
+	case "":
+		format = "table"
+	case "table", "json", "yaml":
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return &output{format: format, w: w}, nil
+}
+
+//print writes v as JSON or YAML, or header and rows as a table
+func (p *output) print(v interface{}, header []string, rows [][]string) error {
+	switch p.format {
+	case "json":
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = p.w.Write(data)
+		return err
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+var userHeader = []string{"ID", "NAME", "EMAIL", "STATUS", "CREATED", "VERSION", "DELETED"}
+
+func userRow(usr *api.User) []string {
+	deletedOn := ""
+	if usr.DeletedOn != nil {
+		deletedOn = usr.DeletedOn.Format(time.RFC3339)
+	}
+	return []string{
+		strconv.Itoa(usr.Id),
+		usr.Name,
+		usr.Email,
+		usr.Status,
+		usr.CreatedOn.Format(time.RFC3339),
+		strconv.Itoa(usr.Version),
+		deletedOn,
+	}
+}
+
+func (p *output) users(users []api.User) error {
+	rows := make([][]string, len(users))
+	for i := range users {
+		rows[i] = userRow(&users[i])
+	}
+	if users == nil {
+		users = []api.User{}
+	}
+	return p.print(users, userHeader, rows)
+}
+
+func (p *output) user(usr *api.User) error {
+	return p.print(usr, userHeader, [][]string{userRow(usr)})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/NektarinR/godocker/pkg/client"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//defaultImportBatch - default max batch size of the server
+const defaultImportBatch = 1000
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+//parseArgs parses flags placed before and after positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func parseId(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("bad id %q", args[0])
+	}
+	return id, nil
+}
+
+func usersList(a *app, args []string) error {
+	fs := newFlagSet("list")
+	offset := fs.Int("offset", 0, "")
+	limit := fs.Int("limit", client.MaxPageSize, "")
+	all := fs.Bool("all", false, "")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		return errUsage
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	if !*all {
+		users, err := a.client.ListUsers(ctx, *offset, *limit)
+		if err != nil {
+			return err
+		}
+		return a.out.users(users)
+	}
+	var users []api.User
+	it := a.client.Users(ctx, client.MaxPageSize)
+	for it.Next() {
+		users = append(users, it.User())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return a.out.users(users)
+}
+
+func usersGet(a *app, args []string) error {
+	id, err := parseId(args)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	usr, err := a.client.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.out.user(usr)
+}
+
+//isSet reports whether the flag was given, even with empty value
+func isSet(fs *flag.FlagSet, name string) bool {
+	result := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			result = true
+		}
+	})
+	return result
+}
+
+func usersCreate(a *app, args []string) error {
+	fs := newFlagSet("create")
+	name := fs.String("name", "", "")
+	email := fs.String("email", "", "")
+	status := fs.String("status", "", "")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 || *name == "" {
+		return errUsage
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	usr, err := a.client.CreateUser(ctx, api.UserInput{Name: *name, Email: *email, Status: *status})
+	if err != nil {
+		return err
+	}
+	return a.out.user(usr)
+}
+
+//usersUpdate changes only the given fields: PUT replaces the whole user,
+//so the rest is taken from the stored user and its version is checked
+func usersUpdate(a *app, args []string) error {
+	fs := newFlagSet("update")
+	name := fs.String("name", "", "")
+	email := fs.String("email", "", "")
+	status := fs.String("status", "", "")
+	version := fs.Int("version", 0, "")
+	rest, err := parseArgs(fs, args)
+	if err != nil || (*name == "" && !isSet(fs, "email") && *status == "") {
+		return errUsage
+	}
+	id, err := parseId(rest)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	stored, err := a.client.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if *version == 0 {
+		*version = stored.Version
+	}
+	input := api.UserInput{Name: stored.Name, Email: stored.Email, Status: stored.Status, Metadata: stored.Metadata}
+	if *name != "" {
+		input.Name = *name
+	}
+	if isSet(fs, "email") {
+		input.Email = *email
+	}
+	if *status != "" {
+		input.Status = *status
+	}
+	usr, err := a.client.UpdateUser(ctx, id, input, *version)
+	if err != nil {
+		return err
+	}
+	return a.out.user(usr)
+}
+
+func usersDelete(a *app, args []string) error {
+	fs := newFlagSet("delete")
+	version := fs.Int("version", 0, "")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return errUsage
+	}
+	id, err := parseId(rest)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	return a.client.DeleteUser(ctx, id, *version)
+}
+
+//usersExport streams users as they come, -o is not used
+func usersExport(a *app, args []string) error {
+	fs := newFlagSet("export")
+	name := fs.String("name", "", "")
+	format := fs.String("format", "ndjson", "")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		return errUsage
+	}
+	buf := bufio.NewWriter(a.stdout)
+	var write func(usr *api.User) error
+	switch *format {
+	case "ndjson":
+		encoder := json.NewEncoder(buf)
+		write = func(usr *api.User) error {
+			return encoder.Encode(usr)
+		}
+	case "csv":
+		w := csv.NewWriter(buf)
+		if err := w.Write([]string{"id", "name", "email", "status", "created_on", "updated_on", "version", "deleted_on"}); err != nil {
+			return err
+		}
+		write = func(usr *api.User) error {
+			deletedOn := ""
+			if usr.DeletedOn != nil {
+				deletedOn = usr.DeletedOn.Format(time.RFC3339Nano)
+			}
+			err := w.Write([]string{strconv.Itoa(usr.Id), usr.Name, usr.Email, usr.Status,
+				usr.CreatedOn.Format(time.RFC3339Nano), usr.UpdatedOn.Format(time.RFC3339Nano),
+				strconv.Itoa(usr.Version), deletedOn})
+			w.Flush()
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	if err := a.client.ExportUsers(ctx, *name, write); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+var importResultHeader = []string{"INDEX", "STATUS", "ID", "ERROR"}
+
+//usersImport sends users by batches, fails if any user was not created
+func usersImport(a *app, args []string) error {
+	fs := newFlagSet("import")
+	batch := fs.Int("batch", defaultImportBatch, "")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 || *batch <= 0 {
+		return errUsage
+	}
+	var r io.Reader = a.stdin
+	if rest[0] != "-" {
+		file, err := os.Open(rest[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	inputs, err := readUserInputs(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	results := make([]api.BatchResult, 0, len(inputs))
+	for start := 0; start < len(inputs); start += *batch {
+		end := start + *batch
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		part, err := a.client.CreateUsers(ctx, inputs[start:end])
+		if err != nil {
+			return fmt.Errorf("users %d-%d: %v", start, end-1, err)
+		}
+		for _, v := range part {
+			v.Index += start
+			results = append(results, v)
+		}
+	}
+	rows := make([][]string, len(results))
+	failed := 0
+	for i, v := range results {
+		id := ""
+		if v.User != nil {
+			id = strconv.Itoa(v.User.Id)
+		}
+		if v.Status != http.StatusCreated {
+			failed++
+		}
+		rows[i] = []string{strconv.Itoa(v.Index), strconv.Itoa(v.Status), id, v.Error}
+	}
+	if err := a.out.print(results, importResultHeader, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d users were not created", failed, len(results))
+	}
+	return nil
+}
+
+//readUserInputs reads JSON array or NDJSON stream of users
+func readUserInputs(r io.Reader) ([]api.UserInput, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	var inputs []api.UserInput
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &inputs); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for decoder.More() {
+			var input api.UserInput
+			if err := decoder.Decode(&input); err != nil {
+				return nil, fmt.Errorf("user %d: %v", len(inputs), err)
+			}
+			inputs = append(inputs, input)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("no users to import")
+	}
+	return inputs, nil
+}
+
+func ping(a *app, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	if err := a.client.Ping(ctx); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(a.stdout, "pong")
+	return err
+}
+
+type healthStatus struct {
+	Server  string `json:"server" yaml:"server"`
+	Status  string `json:"status" yaml:"status"`
+	Latency string `json:"latency" yaml:"latency"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+//health prints status even if the server is down, exit code tells the result
+func health(a *app, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	start := time.Now()
+	err := a.client.Ping(ctx)
+	status := healthStatus{
+		Server:  a.server,
+		Status:  "ok",
+		Latency: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		status.Status = "down"
+		status.Error = err.Error()
+	}
+	row := []string{status.Server, status.Status, status.Latency, status.Error}
+	if err := a.out.print(status, []string{"SERVER", "STATUS", "LATENCY", "ERROR"}, [][]string{row}); err != nil {
+		return err
+	}
+	return err
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"github.com/NektarinR/godocker/pkg/outbox"
 	"github.com/NektarinR/godocker/pkg/server"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -13,5 +16,99 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if envTTL := os.Getenv("IDEMPOTENCY_TTL"); envTTL != "" {
+		srv.IdempotencyTTL, err = time.ParseDuration(envTTL)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envRetention := os.Getenv("USER_RETENTION"); envRetention != "" {
+		srv.UserRetention, err = time.ParseDuration(envRetention)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envBatch := os.Getenv("MAX_BATCH_SIZE"); envBatch != "" {
+		srv.MaxBatchSize, err = strconv.Atoi(envBatch)
+		if err != nil {
+			panic(err)
+		}
+	}
+	srv.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if envGRPC := os.Getenv("GRPC_PORT"); envGRPC != "" {
+		srv.GRPCPort, err = strconv.Atoi(envGRPC)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envGateway := os.Getenv("GRPC_GATEWAY"); envGateway != "" {
+		srv.GRPCGateway, err = strconv.ParseBool(envGateway)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envAttempts := os.Getenv("WEBHOOK_ATTEMPTS"); envAttempts != "" {
+		srv.WebhookAttempts, err = strconv.Atoi(envAttempts)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envWait := os.Getenv("WEBHOOK_RETRY_WAIT"); envWait != "" {
+		srv.WebhookRetryWait, err = time.ParseDuration(envWait)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envCacheSize := os.Getenv("USER_CACHE_SIZE"); envCacheSize != "" {
+		srv.UserCacheSize, err = strconv.Atoi(envCacheSize)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envCacheTTL := os.Getenv("USER_CACHE_TTL"); envCacheTTL != "" {
+		srv.UserCacheTTL, err = time.ParseDuration(envCacheTTL)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envResponses := os.Getenv("RESPONSE_CACHE_SIZE"); envResponses != "" {
+		srv.ResponseCacheSize, err = strconv.Atoi(envResponses)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envResponsesTTL := os.Getenv("RESPONSE_CACHE_TTL"); envResponsesTTL != "" {
+		srv.ResponseCacheTTL, err = time.ParseDuration(envResponsesTTL)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envSinks := os.Getenv("OUTBOX_SINKS"); envSinks != "" {
+		srv.OutboxSinks, err = outbox.ParseSinks(envSinks, os.Getenv("OUTBOX_WEBHOOK_SECRET"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envReplicas := os.Getenv("DB_REPLICAS"); envReplicas != "" {
+		srv.DbReplicas = strings.Split(envReplicas, ",")
+	}
+	if envRetries := os.Getenv("DB_RETRY_ATTEMPTS"); envRetries != "" {
+		srv.DbRetryAttempts, err = strconv.Atoi(envRetries)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envThreshold := os.Getenv("BREAKER_THRESHOLD"); envThreshold != "" {
+		srv.BreakerThreshold, err = strconv.Atoi(envThreshold)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if envCooldown := os.Getenv("BREAKER_COOLDOWN"); envCooldown != "" {
+		srv.BreakerCooldown, err = time.ParseDuration(envCooldown)
+		if err != nil {
+			panic(err)
+		}
+	}
 	srv.Run(port)
 }
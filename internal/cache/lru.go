@@ -0,0 +1,103 @@
+//Package cache keeps hot users in memory in front of the repository
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+//Cache - storage of cached values, it must be safe for concurrent use.
+//LRU keeps values in the process, a shared backend such as Redis
+//can implement Cache to be used by several servers
+type Cache interface {
+	//Get returns false if the key is missing or expired
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+//LRU - in-process cache of limited size, the least recently used
+//values are evicted first, expired values are removed when they are read
+type LRU struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	key      string
+	value    []byte
+	expireOn time.Time
+}
+
+func NewLRU(size int) *LRU {
+	if size <= 0 {
+		size = 1
+	}
+	return &LRU{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+		now:   time.Now,
+	}
+}
+
+func (p *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := item.Value.(*lruEntry)
+	if !p.now().Before(entry.expireOn) {
+		p.remove(item)
+		return nil, false, nil
+	}
+	p.order.MoveToFront(item)
+	return entry.value, true, nil
+}
+
+func (p *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expireOn := p.now().Add(ttl)
+	if item, ok := p.items[key]; ok {
+		entry := item.Value.(*lruEntry)
+		entry.value, entry.expireOn = value, expireOn
+		p.order.MoveToFront(item)
+		return nil
+	}
+	p.items[key] = p.order.PushFront(&lruEntry{key: key, value: value, expireOn: expireOn})
+	for p.order.Len() > p.size {
+		p.remove(p.order.Back())
+	}
+	return nil
+}
+
+func (p *LRU) Delete(ctx context.Context, keys ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		if item, ok := p.items[key]; ok {
+			p.remove(item)
+		}
+	}
+	return nil
+}
+
+//Len returns count of values including expired ones which are not read yet
+func (p *LRU) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.order.Len()
+}
+
+func (p *LRU) remove(item *list.Element) {
+	p.order.Remove(item)
+	delete(p.items, item.Value.(*lruEntry).key)
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(100, 0)
+	lru := NewLRU(2)
+	lru.now = func() time.Time { return now }
+	lru.Set(ctx, "a", []byte("1"), time.Minute)
+	lru.Set(ctx, "b", []byte("2"), time.Second)
+	lru.Get(ctx, "a")
+	//b is the least recently used one
+	lru.Set(ctx, "c", []byte("3"), time.Minute)
+	type TestCase struct {
+		Key   string
+		After time.Duration
+		Value string
+		Ok    bool
+	}
+	tests := []TestCase{
+		{Key: "a", Value: "1", Ok: true},
+		{Key: "b", Ok: false},
+		{Key: "c", Value: "3", Ok: true},
+		{Key: "c", After: time.Minute, Ok: false},
+	}
+	for _, test := range tests {
+		now = now.Add(test.After)
+		value, ok, err := lru.Get(ctx, test.Key)
+		if err != nil || ok != test.Ok || string(value) != test.Value {
+			t.Errorf("%s: expected %q, %v got %q, %v, %v", test.Key, test.Value, test.Ok, value, ok, err)
+		}
+	}
+	lru.Delete(ctx, "a", "missing")
+	if lru.Len() != 0 {
+		t.Errorf("expected empty cache got %d", lru.Len())
+	}
+}
@@ -0,0 +1,282 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTTL         = time.Minute
+	defaultNegativeTTL = 5 * time.Second
+	invalidateTimeout  = 5 * time.Second
+)
+
+//Stats - counters of the cache since start of the process
+type Stats struct {
+	Hits int64 `json:"hits"`
+	//NegativeHits - hits of users which were not found
+	NegativeHits int64 `json:"negative_hits"`
+	Misses       int64 `json:"misses"`
+	//Shared - misses which waited for the load started by another caller
+	Shared int64 `json:"shared"`
+	//Errors - failed calls of the cache backend
+	Errors int64 `json:"errors"`
+}
+
+//Repository caches GetUserById of the wrapped repository, the rest of methods
+//are passed through. Users are loaded from the primary, users changed by
+//the repository are removed from the cache, so every server sharing a cache
+//backend must write through Repository.
+//Soft-deleted users asked with repository.WithDeleted are not cached
+type Repository struct {
+	repository.IRepository
+	cache Cache
+	//TTL - how long found users are kept
+	TTL time.Duration
+	//NegativeTTL - how long users which were not found are remembered
+	NegativeTTL time.Duration
+
+	mu    sync.Mutex
+	loads map[int]*load
+	//generation grows with every invalidation, loads which overlap
+	//an invalidation do not store their result, it may be stale
+	generation uint64
+	stats      Stats
+}
+
+//load - GetUserById in progress, concurrent misses of the same user wait for it
+type load struct {
+	done chan struct{}
+	user *repository.User
+	err  error
+}
+
+func NewRepository(repo repository.IRepository, cache Cache) *Repository {
+	return &Repository{
+		IRepository: repo,
+		cache:       cache,
+		TTL:         defaultTTL,
+		NegativeTTL: defaultNegativeTTL,
+		loads:       make(map[int]*load),
+	}
+}
+
+//Stats returns current counters
+func (p *Repository) Stats() Stats {
+	return Stats{
+		Hits:         atomic.LoadInt64(&p.stats.Hits),
+		NegativeHits: atomic.LoadInt64(&p.stats.NegativeHits),
+		Misses:       atomic.LoadInt64(&p.stats.Misses),
+		Shared:       atomic.LoadInt64(&p.stats.Shared),
+		Errors:       atomic.LoadInt64(&p.stats.Errors),
+	}
+}
+
+func userKey(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+func (p *Repository) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	if repository.IncludesDeleted(ctx) {
+		return p.IRepository.GetUserById(ctx, id)
+	}
+	value, ok, err := p.cache.Get(ctx, userKey(id))
+	if err != nil {
+		atomic.AddInt64(&p.stats.Errors, 1)
+	}
+	if ok {
+		if len(value) == 0 {
+			atomic.AddInt64(&p.stats.NegativeHits, 1)
+			return nil, gorm.ErrRecordNotFound
+		}
+		user := &repository.User{}
+		if err := json.Unmarshal(value, user); err == nil {
+			atomic.AddInt64(&p.stats.Hits, 1)
+			return user, nil
+		}
+		atomic.AddInt64(&p.stats.Errors, 1)
+	}
+	atomic.AddInt64(&p.stats.Misses, 1)
+	return p.load(ctx, id)
+}
+
+//load reads the user once for all concurrent callers and caches the result.
+//Callers share the context of the first one and so its cancellation
+func (p *Repository) load(ctx context.Context, id int) (*repository.User, error) {
+	p.mu.Lock()
+	if current, ok := p.loads[id]; ok {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.stats.Shared, 1)
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if current.user == nil {
+			return nil, current.err
+		}
+		user := *current.user
+		return &user, nil
+	}
+	current := &load{done: make(chan struct{})}
+	p.loads[id] = current
+	generation := p.generation
+	p.mu.Unlock()
+
+	//replicas may lag, the cache keeps what the primary has
+	current.user, current.err = p.IRepository.GetUserById(repository.WithPrimary(ctx), id)
+	p.mu.Lock()
+	delete(p.loads, id)
+	stale := generation != p.generation
+	p.mu.Unlock()
+	close(current.done)
+
+	if !stale {
+		p.store(ctx, id, current.user, current.err)
+	}
+	if current.user == nil {
+		return nil, current.err
+	}
+	user := *current.user
+	return &user, nil
+}
+
+func (p *Repository) store(ctx context.Context, id int, user *repository.User, err error) {
+	var value []byte
+	ttl := p.TTL
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		ttl = p.NegativeTTL
+	case err != nil:
+		return
+	default:
+		if value, err = json.Marshal(user); err != nil {
+			return
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	if err := p.cache.Set(ctx, userKey(id), value, ttl); err != nil {
+		atomic.AddInt64(&p.stats.Errors, 1)
+	}
+}
+
+//invalidate removes users from the cache, it is called after the write
+//is committed and also before it to shorten the time of stale reads.
+//Context of the write is not used, it may be already canceled
+func (p *Repository) invalidate(ids ...int) {
+	if len(ids) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), invalidateTimeout)
+	defer cancel()
+	p.mu.Lock()
+	p.generation++
+	p.mu.Unlock()
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = userKey(id)
+	}
+	if err := p.cache.Delete(ctx, keys...); err != nil {
+		atomic.AddInt64(&p.stats.Errors, 1)
+		log.Printf("Ошибка при очистке кэша пользователей %v\n", err)
+	}
+}
+
+//WithTx passes fn repository of the transaction which reads past the cache,
+//users written in the transaction are removed from the cache when it ends
+func (p *Repository) WithTx(ctx context.Context, fn func(repo repository.IRepository) error) error {
+	var ids []int
+	err := p.IRepository.WithTx(ctx, func(repo repository.IRepository) error {
+		return fn(&txRepository{IRepository: repo, ids: &ids})
+	})
+	p.invalidate(ids...)
+	return err
+}
+
+func (p *Repository) InsertUser(ctx context.Context, user *repository.User) error {
+	err := p.IRepository.InsertUser(ctx, user)
+	//the new id may be remembered as not found
+	p.invalidate(user.Id)
+	return err
+}
+
+func (p *Repository) InsertUsers(ctx context.Context, users []repository.User) error {
+	err := p.IRepository.InsertUsers(ctx, users)
+	ids := make([]int, 0, len(users))
+	for _, user := range users {
+		if user.Id != 0 {
+			ids = append(ids, user.Id)
+		}
+	}
+	p.invalidate(ids...)
+	return err
+}
+
+func (p *Repository) UpdateUser(ctx context.Context, user *repository.User) error {
+	p.invalidate(user.Id)
+	defer p.invalidate(user.Id)
+	return p.IRepository.UpdateUser(ctx, user)
+}
+
+func (p *Repository) DeleteUser(ctx context.Context, id, version int) error {
+	p.invalidate(id)
+	defer p.invalidate(id)
+	return p.IRepository.DeleteUser(ctx, id, version)
+}
+
+func (p *Repository) RestoreUser(ctx context.Context, id int) (*repository.User, error) {
+	p.invalidate(id)
+	defer p.invalidate(id)
+	return p.IRepository.RestoreUser(ctx, id)
+}
+
+//txRepository remembers users written in transaction,
+//nested transactions add them to ids of the outermost one
+type txRepository struct {
+	repository.IRepository
+	ids *[]int
+}
+
+func (p *txRepository) WithTx(ctx context.Context, fn func(repo repository.IRepository) error) error {
+	return p.IRepository.WithTx(ctx, func(repo repository.IRepository) error {
+		return fn(&txRepository{IRepository: repo, ids: p.ids})
+	})
+}
+
+func (p *txRepository) InsertUser(ctx context.Context, user *repository.User) error {
+	err := p.IRepository.InsertUser(ctx, user)
+	*p.ids = append(*p.ids, user.Id)
+	return err
+}
+
+func (p *txRepository) InsertUsers(ctx context.Context, users []repository.User) error {
+	err := p.IRepository.InsertUsers(ctx, users)
+	for _, user := range users {
+		*p.ids = append(*p.ids, user.Id)
+	}
+	return err
+}
+
+func (p *txRepository) UpdateUser(ctx context.Context, user *repository.User) error {
+	*p.ids = append(*p.ids, user.Id)
+	return p.IRepository.UpdateUser(ctx, user)
+}
+
+func (p *txRepository) DeleteUser(ctx context.Context, id, version int) error {
+	*p.ids = append(*p.ids, id)
+	return p.IRepository.DeleteUser(ctx, id, version)
+}
+
+func (p *txRepository) RestoreUser(ctx context.Context, id int) (*repository.User, error) {
+	*p.ids = append(*p.ids, id)
+	return p.IRepository.RestoreUser(ctx, id)
+}
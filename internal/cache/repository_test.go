@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	"sync"
+	"testing"
+	"time"
+)
+
+//countingRepository counts loads of users, gate holds them until it is closed
+type countingRepository struct {
+	repository.IRepository
+	mu    sync.Mutex
+	calls int
+	gate  chan struct{}
+}
+
+func (p *countingRepository) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	if p.gate != nil {
+		<-p.gate
+	}
+	//GetUserById of the mock is slow on purpose
+	users, err := p.IRepository.GetUsersByIds(ctx, []int{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &users[0], nil
+}
+
+func (p *countingRepository) loads() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func newTestRepository() (*Repository, *countingRepository) {
+	db, _ := repository.NewPostgresDBMock()
+	counting := &countingRepository{IRepository: db}
+	return NewRepository(counting, NewLRU(10)), counting
+}
+
+func TestRepository_GetUserById(t *testing.T) {
+	repo, counting := newTestRepository()
+	ctx := context.Background()
+	type TestCase struct {
+		Id    int
+		Name  string
+		Err   error
+		Loads int
+	}
+	tests := []TestCase{
+		{Id: 1, Name: "Vasy", Loads: 1},
+		{Id: 1, Name: "Vasy", Loads: 1},
+		{Id: 9, Err: gorm.ErrRecordNotFound, Loads: 2},
+		{Id: 9, Err: gorm.ErrRecordNotFound, Loads: 2},
+	}
+	for i, test := range tests {
+		user, err := repo.GetUserById(ctx, test.Id)
+		if err != test.Err || (err == nil && user.Name != test.Name) {
+			t.Errorf("%d: expected %s, %v got %v, %v", i, test.Name, test.Err, user, err)
+		}
+		if counting.loads() != test.Loads {
+			t.Errorf("%d: expected %d loads got %d", i, test.Loads, counting.loads())
+		}
+	}
+	expected := Stats{Hits: 1, NegativeHits: 1, Misses: 2}
+	if stats := repo.Stats(); stats != expected {
+		t.Errorf("expected %v got %v", expected, stats)
+	}
+	//soft-deleted users are asked past the cache
+	repo.GetUserById(repository.WithDeleted(ctx), 1)
+	if counting.loads() != 3 {
+		t.Errorf("expected 3 loads got %d", counting.loads())
+	}
+}
+
+func TestRepository_Invalidation(t *testing.T) {
+	repo, _ := newTestRepository()
+	ctx := context.Background()
+	repo.GetUserById(ctx, 1)
+	repo.GetUserById(ctx, 6)
+	if err := repo.UpdateUser(ctx, &repository.User{
+		PrivateUser: repository.PrivateUser{Id: 1},
+		PublicUser:  repository.PublicUser{Name: "Kolya"},
+	}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if user, err := repo.GetUserById(ctx, 1); err != nil || user.Name != "Kolya" || user.Version != 2 {
+		t.Errorf("expected updated user got %v, %v", user, err)
+	}
+	//user 6 was remembered as not found
+	if err := repo.InsertUser(ctx, &repository.User{PublicUser: repository.PublicUser{Name: "Pety"}}); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if user, err := repo.GetUserById(ctx, 6); err != nil || user.Name != "Pety" {
+		t.Errorf("expected inserted user got %v, %v", user, err)
+	}
+	err := repo.WithTx(ctx, func(tx repository.IRepository) error {
+		return tx.WithTx(ctx, func(tx repository.IRepository) error {
+			return tx.DeleteUser(ctx, 6, 0)
+		})
+	})
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if _, err := repo.GetUserById(ctx, 6); err != gorm.ErrRecordNotFound {
+		t.Errorf("expected %v got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestRepository_ConcurrentMisses(t *testing.T) {
+	repo, counting := newTestRepository()
+	counting.gate = make(chan struct{})
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := repo.GetUserById(context.Background(), 2)
+			if err == nil && user.Name != "VasyVasy" {
+				t.Errorf("expected VasyVasy got %v", user)
+			}
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for repo.Stats().Shared < callers-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(counting.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected nil got %v", err)
+		}
+	}
+	if counting.loads() != 1 {
+		t.Errorf("expected 1 load got %d", counting.loads())
+	}
+}
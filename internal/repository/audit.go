@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+const (
+	AuditInsert  = "insert"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+//UserAudit - append-only record of a change of user,
+//Diff holds changed fields as {"field": {"old": ..., "new": ...}}
+type UserAudit struct {
+	Id        int             `gorm:"column:id" json:"id"`
+	UserId    int             `gorm:"column:user_id" json:"user_id"`
+	Action    string          `gorm:"column:action" json:"action"`
+	Actor     string          `gorm:"column:actor" json:"actor"`
+	RequestId string          `gorm:"column:request_id" json:"request_id"`
+	Before    json.RawMessage `gorm:"column:before" json:"before,omitempty"`
+	After     json.RawMessage `gorm:"column:after" json:"after,omitempty"`
+	Diff      json.RawMessage `gorm:"column:diff" json:"diff,omitempty"`
+	CreateOn  time.Time       `gorm:"column:created_on" json:"created_on"`
+}
+
+//WithActor sets who performs changes made with this context
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+//WithRequestID sets request id recorded in the audit trail
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func newUserAudit(ctx context.Context, action string, before, after *User) (*UserAudit, error) {
+	actor, _ := ctx.Value(actorKey).(string)
+	if actor == "" {
+		actor = "system"
+	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	result := &UserAudit{
+		Action:    action,
+		Actor:     actor,
+		RequestId: requestID,
+		CreateOn:  time.Now(),
+	}
+	var err error
+	if before != nil {
+		result.UserId = before.Id
+		if result.Before, err = json.Marshal(before); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		result.UserId = after.Id
+		if result.After, err = json.Marshal(after); err != nil {
+			return nil, err
+		}
+	}
+	if result.Diff, err = jsonDiff(result.Before, result.After); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func jsonDiff(before, after []byte) ([]byte, error) {
+	oldFields := map[string]interface{}{}
+	newFields := map[string]interface{}{}
+	if before != nil {
+		if err := json.Unmarshal(before, &oldFields); err != nil {
+			return nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &newFields); err != nil {
+			return nil, err
+		}
+	}
+	diff := map[string]map[string]interface{}{}
+	for k, v := range oldFields {
+		if nv, ok := newFields[k]; !ok || !reflect.DeepEqual(v, nv) {
+			diff[k] = map[string]interface{}{"old": v, "new": newFields[k]}
+		}
+	}
+	for k, v := range newFields {
+		if _, ok := oldFields[k]; !ok {
+			diff[k] = map[string]interface{}{"old": nil, "new": v}
+		}
+	}
+	return json.Marshal(diff)
+}
@@ -0,0 +1,40 @@
+package repository_test
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/NektarinR/godocker/internal/cache"
+	"github.com/NektarinR/godocker/internal/repository"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCache_LaggingReplica(t *testing.T) {
+	repo, primary, replica := repository.SetupReplica()
+	cached := cache.NewRepository(repo, cache.NewLRU(10))
+	query := regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1)`)
+	columns := []string{"id", "created_on", "name", "version"}
+	created := time.Unix(10, 10)
+	primary.ExpectQuery(query).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(2, created, "Kolya", 2))
+	replica.ExpectQuery(query).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(2, created, "VasyVasy", 1))
+	//the miss is read from the primary, the hit does not read at all
+	for i := 0; i < 2; i++ {
+		usr, err := cached.GetUserById(context.Background(), 2)
+		if err != nil || usr.Name != "Kolya" || usr.Version != 2 {
+			t.Errorf("expected user of the primary got %v, %v", usr, err)
+		}
+	}
+	//reads past the cache still go to the replica which has not got the change yet
+	if usr, err := repo.GetUserById(context.Background(), 2); err != nil || usr.Version != 1 {
+		t.Errorf("expected user of the replica got %v, %v", usr, err)
+	}
+	if err := primary.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+	if err := replica.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+//defaultChangeHistory - count of recent changes kept for resuming subscribers
+const defaultChangeHistory = 1000
+
+//Change - committed change of user, Id grows by one with every change
+//published on the bus, ids start over when the process restarts
+type Change struct {
+	Id       int64
+	Type     string
+	User     User
+	CreateOn time.Time
+}
+
+//changeOf converts audit action into change, purge is not published:
+//the user was announced as deleted when it was soft-deleted
+func changeOf(action string, before, after *User) (Change, bool) {
+	result := Change{CreateOn: time.Now()}
+	switch action {
+	case AuditInsert:
+		result.Type = ChangeCreated
+	case AuditUpdate, AuditRestore:
+		result.Type = ChangeUpdated
+	case AuditDelete:
+		result.Type = ChangeDeleted
+	default:
+		return result, false
+	}
+	result.User = *after
+	return result, true
+}
+
+//ChangeBus delivers committed changes to subscribers in memory
+//and keeps the recent ones for subscribers which resume after a disconnect
+type ChangeBus struct {
+	mu      sync.Mutex
+	lastId  int64
+	history []Change
+	size    int
+	subs    map[*Subscription]struct{}
+}
+
+//NewChangeBus creates bus which keeps size recent changes
+func NewChangeBus(size int) *ChangeBus {
+	if size <= 0 {
+		size = defaultChangeHistory
+	}
+	return &ChangeBus{size: size, subs: make(map[*Subscription]struct{})}
+}
+
+//Publish assigns ids to changes and sends them to subscribers,
+//subscriber which is not able to keep up is closed
+func (p *ChangeBus) Publish(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, change := range changes {
+		p.lastId++
+		change.Id = p.lastId
+		p.history = append(p.history, change)
+		if len(p.history) > p.size {
+			p.history = p.history[len(p.history)-p.size:]
+		}
+		for sub := range p.subs {
+			select {
+			case sub.c <- change:
+			default:
+				p.unsubscribe(sub)
+			}
+		}
+	}
+}
+
+//Subscribe returns subscription receiving changes published from now on
+//and the kept changes with id greater than lastId, negative lastId means
+//no missed changes. complete is false if some changes after lastId are not kept
+//anymore, subscriber should reload its state.
+//buffer is a count of changes which may wait for the subscriber
+func (p *ChangeBus) Subscribe(lastId int64, buffer int) (sub *Subscription, missed []Change, complete bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lastId < 0 {
+		lastId = p.lastId
+	}
+	sub = &Subscription{bus: p, c: make(chan Change, buffer)}
+	p.subs[sub] = struct{}{}
+	complete = lastId <= p.lastId
+	if len(p.history) > 0 && lastId < p.history[0].Id-1 {
+		complete = false
+	}
+	for _, change := range p.history {
+		if change.Id > lastId {
+			missed = append(missed, change)
+		}
+	}
+	return sub, missed, complete
+}
+
+//unsubscribe must be called with p.mu locked
+func (p *ChangeBus) unsubscribe(sub *Subscription) {
+	if _, ok := p.subs[sub]; ok {
+		delete(p.subs, sub)
+		close(sub.c)
+	}
+}
+
+//Subscription - receiver of changes, channel is closed on Close
+//or when the subscriber falls behind
+type Subscription struct {
+	bus *ChangeBus
+	c   chan Change
+}
+
+func (p *Subscription) C() <-chan Change {
+	return p.c
+}
+
+func (p *Subscription) Close() {
+	p.bus.mu.Lock()
+	defer p.bus.mu.Unlock()
+	p.bus.unsubscribe(p)
+}
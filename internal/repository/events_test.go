@@ -0,0 +1,57 @@
+package repository
+
+import "testing"
+
+func TestChangeBus_Subscribe(t *testing.T) {
+	bus := NewChangeBus(3)
+	for i := 1; i <= 5; i++ {
+		bus.Publish(Change{Type: ChangeCreated, User: User{PrivateUser: PrivateUser{Id: i}}})
+	}
+	type TestCase struct {
+		lastId   int64
+		missed   []int64
+		complete bool
+	}
+	tests := []TestCase{
+		{lastId: -1, missed: nil, complete: true},
+		{lastId: 5, missed: nil, complete: true},
+		{lastId: 3, missed: []int64{4, 5}, complete: true},
+		{lastId: 2, missed: []int64{3, 4, 5}, complete: true},
+		{lastId: 1, missed: []int64{3, 4, 5}, complete: false},
+		{lastId: 9, missed: nil, complete: false},
+	}
+	for _, test := range tests {
+		sub, missed, complete := bus.Subscribe(test.lastId, 1)
+		sub.Close()
+		if complete != test.complete {
+			t.Errorf("lastId %d: expected complete %v got %v", test.lastId, test.complete, complete)
+		}
+		if len(missed) != len(test.missed) {
+			t.Errorf("lastId %d: expected %v got %v", test.lastId, test.missed, missed)
+			continue
+		}
+		for i := range missed {
+			if missed[i].Id != test.missed[i] {
+				t.Errorf("lastId %d: expected %v got %v", test.lastId, test.missed, missed)
+			}
+		}
+	}
+}
+
+func TestChangeBus_SlowSubscriber(t *testing.T) {
+	bus := NewChangeBus(0)
+	slow, _, _ := bus.Subscribe(-1, 1)
+	fast, _, _ := bus.Subscribe(-1, 2)
+	defer fast.Close()
+	bus.Publish(Change{Type: ChangeCreated}, Change{Type: ChangeDeleted})
+	if change := <-slow.C(); change.Id != 1 {
+		t.Errorf("expected change 1 got %v", change)
+	}
+	if _, ok := <-slow.C(); ok {
+		t.Errorf("expected slow subscription to be closed")
+	}
+	if len(fast.C()) != 2 {
+		t.Errorf("expected 2 changes got %d", len(fast.C()))
+	}
+	slow.Close()
+}
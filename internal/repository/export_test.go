@@ -0,0 +1,5 @@
+package repository
+
+//SetupReplica gives tests of package repository_test a repository
+//with a primary and a replica
+var SetupReplica = setupReplica
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+type migration struct {
+	Version int
+	Query   string
+}
+
+//migrations are applied in order, each one exactly once
+var migrations = []migration{
+	{Version: 1, Query: `CREATE TABLE IF NOT EXISTS users (
+		id         SERIAL PRIMARY KEY,
+		created_on TIMESTAMPTZ NOT NULL DEFAULT now(),
+		name       TEXT NOT NULL
+	)`},
+	{Version: 2, Query: `CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key         TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		body        BYTEA,
+		created_on  TIMESTAMPTZ NOT NULL,
+		expire_on   TIMESTAMPTZ NOT NULL
+	)`},
+	{Version: 3, Query: `ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS header BYTEA`},
+	{Version: 4, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`},
+	{Version: 5, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_on TIMESTAMPTZ`},
+	{Version: 6, Query: `CREATE TABLE IF NOT EXISTS user_audits (
+		id         BIGSERIAL PRIMARY KEY,
+		user_id    INTEGER NOT NULL,
+		action     TEXT NOT NULL,
+		actor      TEXT NOT NULL,
+		request_id TEXT NOT NULL,
+		before     JSONB,
+		after      JSONB,
+		diff       JSONB,
+		created_on TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`},
+	{Version: 7, Query: `CREATE INDEX IF NOT EXISTS user_audits_user_id_idx ON user_audits (user_id, id)`},
+	{Version: 8, Query: `CREATE TABLE IF NOT EXISTS webhooks (
+		id         SERIAL PRIMARY KEY,
+		url        TEXT NOT NULL,
+		secret     TEXT NOT NULL,
+		events     TEXT[] NOT NULL,
+		active     BOOLEAN NOT NULL DEFAULT true,
+		created_on TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`},
+	{Version: 9, Query: `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id              BIGSERIAL PRIMARY KEY,
+		webhook_id      INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event_id        BIGINT NOT NULL,
+		event           TEXT NOT NULL,
+		payload         JSONB NOT NULL,
+		status          TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		response_code   INTEGER NOT NULL DEFAULT 0,
+		error           TEXT NOT NULL DEFAULT '',
+		created_on      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		next_attempt_on TIMESTAMPTZ NOT NULL,
+		delivered_on    TIMESTAMPTZ
+	)`},
+	{Version: 10, Query: `CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx
+		ON webhook_deliveries (webhook_id, id)`},
+	{Version: 11, Query: `CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx
+		ON webhook_deliveries (next_attempt_on) WHERE status = 'pending'`},
+	{Version: 12, Query: `CREATE TABLE IF NOT EXISTS outbox (
+		id         BIGSERIAL PRIMARY KEY,
+		user_id    INTEGER NOT NULL,
+		type       TEXT NOT NULL,
+		payload    JSONB NOT NULL,
+		created_on TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`},
+	{Version: 13, Query: `CREATE EXTENSION IF NOT EXISTS pg_trgm`},
+	{Version: 14, Query: `CREATE INDEX IF NOT EXISTS users_name_trgm_idx
+		ON users USING GIN (name gin_trgm_ops)`},
+	{Version: 15, Query: `CREATE INDEX IF NOT EXISTS users_name_fts_idx
+		ON users USING GIN (to_tsvector('simple', name))`},
+	{Version: 16, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT ''`},
+	//users without email do not conflict
+	{Version: 17, Query: `CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx
+		ON users (lower(email)) WHERE email <> ''`},
+	{Version: 18, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+		CHECK (status IN ('active', 'suspended'))`},
+	{Version: 19, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_on TIMESTAMPTZ`},
+	{Version: 20, Query: `UPDATE users SET updated_on = created_on WHERE updated_on IS NULL`},
+	{Version: 21, Query: `ALTER TABLE users ALTER COLUMN updated_on SET DEFAULT now(),
+		ALTER COLUMN updated_on SET NOT NULL`},
+	{Version: 22, Query: `ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'`},
+	{Version: 23, Query: `CREATE INDEX IF NOT EXISTS users_metadata_idx
+		ON users USING GIN (metadata jsonb_path_ops)`},
+	//the relay may publish an event again, only the first delivery of it is kept
+	{Version: 24, Query: `DELETE FROM webhook_deliveries d USING webhook_deliveries o
+		WHERE d.webhook_id = o.webhook_id AND d.event_id = o.event_id AND d.id > o.id`},
+	{Version: 25, Query: `CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx
+		ON webhook_deliveries (webhook_id, event_id)`},
+}
+
+func migrate(db *gorm.DB) error {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`).Error
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		var count int
+		err := db.Table("schema_migrations").
+			Where("version = ?", m.Version).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		tx := db.Begin()
+		if err := tx.Exec(m.Query).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)",
+			m.Version).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
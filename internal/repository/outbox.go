@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//outboxLockKey - key of advisory lock held by the relay which publishes the outbox
+const outboxLockKey = 4404
+
+//OutboxEvent - change of user written in the same transaction as the change itself.
+//Relay publishes events in order of Id and deletes them afterwards,
+//so an event is published at least once even if the process dies after commit
+type OutboxEvent struct {
+	Id     int64  `gorm:"column:id"`
+	UserId int    `gorm:"column:user_id"`
+	Type   string `gorm:"column:type"`
+	//Payload - the user after the change
+	Payload  json.RawMessage `gorm:"column:payload"`
+	CreateOn time.Time       `gorm:"column:created_on"`
+}
+
+func newOutboxEvent(change *Change) (*OutboxEvent, error) {
+	payload, err := json.Marshal(change.User)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{
+		UserId:   change.User.Id,
+		Type:     change.Type,
+		Payload:  payload,
+		CreateOn: change.CreateOn,
+	}, nil
+}
+
+func (OutboxEvent) TableName() string {
+	return "outbox"
+}
@@ -2,9 +2,17 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type FuncLogging func(text string)
@@ -15,56 +23,750 @@ type DbConfig struct {
 	DbName   string
 	User     string
 	Password string
+	//Replicas - read replicas of the database, GetUserById and Fetch are sent to them
+	Replicas []DbConfig
 }
 
+func (p *DbConfig) source() string {
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable",
+		p.Host, p.Port, p.User, p.DbName, p.Password)
+}
+
+//changesSetting - gorm setting of transaction holding *[]Change written in it
+const changesSetting = "godocker:changes"
+
 type PostgreSql struct {
 	pool    *gorm.DB
 	logFunc FuncLogging
+	bus     *ChangeBus
+	//replicas is nil if there are no replicas
+	replicas *replicaSet
+	//tx is set for repository bound to transaction, depth is a nesting level of WithTx
+	tx    *gorm.DB
+	depth int
 }
 
-func (p *PostgreSql) InsertUser(ctx context.Context, user *User) error {
-
-	tx := p.pool.Begin()
+//WithTx runs fn in transaction, nested calls use savepoints.
+//Transaction is rolled back if fn returns error or panics, panic is re-raised.
+//Changes are published on the bus after commit of the outermost transaction
+func (p *PostgreSql) WithTx(ctx context.Context, fn func(repo IRepository) error) (err error) {
+	inner := &PostgreSql{pool: p.pool, logFunc: p.logFunc, bus: p.bus, replicas: p.replicas, depth: p.depth + 1}
+	changes := &[]Change{}
+	rollback := func() error { return inner.tx.Rollback().Error }
+	commit := func() error {
+		if err := inner.tx.Commit().Error; err != nil {
+			return err
+		}
+		p.bus.Publish(*changes...)
+		return nil
+	}
+	if p.tx == nil {
+		tx := p.pool.BeginTx(ctx, nil)
+		if err := tx.Error; err != nil {
+			return err
+		}
+		inner.tx = tx.Set(changesSetting, changes)
+	} else {
+		inner.tx = p.tx
+		var err error
+		if changes, err = txChanges(p.tx); err != nil {
+			return err
+		}
+		written := len(*changes)
+		savepoint := fmt.Sprintf("sp_%d", inner.depth)
+		if err := p.tx.Exec("SAVEPOINT " + savepoint).Error; err != nil {
+			return err
+		}
+		rollback = func() error {
+			*changes = (*changes)[:written]
+			return p.tx.Exec("ROLLBACK TO SAVEPOINT " + savepoint).Error
+		}
+		commit = func() error { return p.tx.Exec("RELEASE SAVEPOINT " + savepoint).Error }
+	}
 	defer func() {
 		if r := recover(); r != nil {
-			tx.Rollback()
+			rollback()
+			panic(r)
 		}
 	}()
-	if err := tx.Create(user).Error; err != nil {
-		tx.Rollback()
+	if err := fn(inner); err != nil {
+		if rbErr := rollback(); rbErr != nil && p.logFunc != nil {
+			p.logFunc(fmt.Sprintf("rollback failed: %v", rbErr))
+		}
 		return err
 	}
-	tx.Commit()
+	return commit()
+}
+
+//transaction runs fn on the current transaction or on a new one
+func (p *PostgreSql) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return p.WithTx(ctx, func(repo IRepository) error {
+		return fn(repo.(*PostgreSql).tx)
+	})
+}
+
+//conn returns transaction of the repository or the pool
+func (p *PostgreSql) conn() *gorm.DB {
+	if p.tx != nil {
+		return p.tx
+	}
+	return p.pool
+}
+
+func (p *PostgreSql) InsertUser(ctx context.Context, user *User) error {
+	user.normalize()
+	return p.transaction(ctx, func(tx *gorm.DB) error {
+		err := tx.Raw(`INSERT INTO "users" ("name", "email", "status", "metadata") VALUES (?, ?, ?, ?) `+
+			`RETURNING "id", "created_on", "updated_on", "version"`,
+			user.Name, user.Email, user.Status, user.Metadata).
+			Row().Scan(&user.Id, &user.CreateOn, &user.UpdatedOn, &user.Version)
+		if err != nil {
+			return emailError(err)
+		}
+		return writeAudit(ctx, tx, AuditInsert, nil, user)
+	})
+}
+
+//insertBatchSize keeps query parameters count far below postgres limit
+const insertBatchSize = 1000
+
+func (p *PostgreSql) InsertUsers(ctx context.Context, users []User) error {
+	return p.transaction(ctx, func(tx *gorm.DB) error {
+		for start := 0; start < len(users); start += insertBatchSize {
+			end := start + insertBatchSize
+			if end > len(users) {
+				end = len(users)
+			}
+			if err := insertUsers(ctx, tx, users[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//insertUsers inserts users with one statement. RETURNING gives rows in no
+//particular order, so ids are taken first and every row carries position of its user
+func insertUsers(ctx context.Context, tx *gorm.DB, users []User) error {
+	values := make([]string, len(users))
+	args := make([]interface{}, 0, 5*len(users))
+	for i := range users {
+		users[i].normalize()
+		values[i] = "(?::int, ?, ?, ?, ?::jsonb)"
+		args = append(args, i, users[i].Name, users[i].Email, users[i].Status, users[i].Metadata)
+	}
+	rows, err := tx.Raw(`WITH "input" AS (SELECT nextval(pg_get_serial_sequence('users', 'id')) AS "id", * `+
+		`FROM (VALUES `+strings.Join(values, ", ")+`) AS "values" ("ord", "name", "email", "status", "metadata")), `+
+		`"inserted" AS (INSERT INTO "users" ("id", "name", "email", "status", "metadata") `+
+		`SELECT "id", "name", "email", "status", "metadata" FROM "input" `+
+		`RETURNING "id", "created_on", "updated_on", "version") `+
+		`SELECT "input"."ord", "inserted".* FROM "inserted" JOIN "input" USING ("id")`, args...).Rows()
+	if err != nil {
+		return emailError(err)
+	}
+	found := 0
+	for rows.Next() {
+		var ord int
+		var usr User
+		if err := rows.Scan(&ord, &usr.Id, &usr.CreateOn, &usr.UpdatedOn, &usr.Version); err != nil {
+			rows.Close()
+			return err
+		}
+		if ord < 0 || ord >= len(users) {
+			rows.Close()
+			return fmt.Errorf("inserted user has unknown position %d", ord)
+		}
+		users[ord].PrivateUser = usr.PrivateUser
+		found++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return emailError(err)
+	}
+	if found != len(users) {
+		return fmt.Errorf("%d of %d users are inserted", found, len(users))
+	}
+	for i := range users {
+		if err := writeAudit(ctx, tx, AuditInsert, nil, &users[i]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (p *PostgreSql) GetUserById(ctx context.Context, id int) (*User, error) {
 	result := User{}
-	db := p.pool.First(&result, "id = ?", id)
-	if err := db.Error; err != nil {
+	err := p.read(ctx, func(db *gorm.DB) error {
+		return scopeUsers(ctx, db).First(&result, "id = ?", id).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
 
+func (p *PostgreSql) GetUsersByIds(ctx context.Context, ids []int) ([]User, error) {
+	result := make([]User, 0, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	if err := p.users(ctx).Where("id IN (?)", ids).Order("id").Find(&result).Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *PostgreSql) FindUsers(ctx context.Context, filter UserFilter, afterId, limit int) ([]User, error) {
+	result := make([]User, 0, limit)
+	db := p.users(ctx).Where("id > ?", afterId)
+	conditions, args := filterConditions(filter)
+	for i := range conditions {
+		db = db.Where(conditions[i], args[i])
+	}
+	if err := db.Order("id").Limit(limit).Find(&result).Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//SearchUsers matches words with full-text search and misspellings with trigrams of pg_trgm
+func (p *PostgreSql) SearchUsers(ctx context.Context, query string, offset, limit int) ([]SearchResult, error) {
+	result := make([]SearchResult, 0, limit)
+	words := SearchWords(query)
+	if len(words) == 0 {
+		return result, nil
+	}
+	text, tsQuery := strings.Join(words, " "), prefixQuery(words)
+	err := p.read(ctx, func(db *gorm.DB) error {
+		return scopeUsers(ctx, db).Table("users").
+			Select(`*, ts_rank(to_tsvector('simple', name), to_tsquery('simple', ?)) + similarity(name, ?) AS rank`,
+				tsQuery, text).
+			Where(`to_tsvector('simple', name) @@ to_tsquery('simple', ?) OR name % ?`, tsQuery, text).
+			Order("rank DESC, id").Offset(offset).Limit(limit).Scan(&result).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (p *PostgreSql) Fetch(ctx context.Context, offset, limit int) ([]User, error) {
 	result := make([]User, 0, limit)
-	if err := p.pool.Limit(limit).Offset(offset).Find(&result).Error; err != nil {
+	err := p.read(ctx, func(db *gorm.DB) error {
+		return scopeUsers(ctx, db).Limit(limit).Offset(offset).Find(&result).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
+//filterConditions returns conditions of not empty fields of filter, each one has one argument
+func filterConditions(filter UserFilter) ([]string, []interface{}) {
+	conditions := make([]string, 0, 5)
+	args := make([]interface{}, 0, 5)
+	if filter.Name != "" {
+		conditions = append(conditions, `"name" ILIKE ?`)
+		args = append(args, "%"+escapeLike(filter.Name)+"%")
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, `lower("email") = lower(?)`)
+		args = append(args, strings.TrimSpace(filter.Email))
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, `"status" = ?`)
+		args = append(args, filter.Status)
+	}
+	if !filter.UpdatedSince.IsZero() {
+		conditions = append(conditions, `"updated_on" >= ?`)
+		args = append(args, filter.UpdatedSince)
+	}
+	if len(filter.Metadata) > 0 {
+		conditions = append(conditions, `"metadata" @> ?`)
+		args = append(args, filter.Metadata)
+	}
+	return conditions, args
+}
+
+//emailError returns ErrEmailTaken if err is violation of the unique index of emails
+func emailError(err error) error {
+	if e, ok := err.(*pq.Error); ok && e.Code == "23505" && e.Constraint == "users_email_idx" {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+//exportFetchSize - rows read from the cursor at once
+const exportFetchSize = 500
+
+//exportCursors numbers cursors of exports, a transaction of the caller
+//may run several exports and their cursors live until it ends
+var exportCursors uint64
+
+func (p *PostgreSql) ExportUsers(ctx context.Context, filter UserFilter, fn func(user *User) error) error {
+	conditions, args := filterConditions(filter)
+	if !withDeleted(ctx) {
+		conditions = append([]string{`"deleted_on" IS NULL`}, conditions...)
+	}
+	cursor := "users_export_" + strconv.FormatUint(atomic.AddUint64(&exportCursors, 1), 10)
+	query := `DECLARE ` + cursor + ` NO SCROLL CURSOR FOR SELECT * FROM "users"`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY "id"`
+	return p.transaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Exec(query, args...).Error; err != nil {
+			return err
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			count, err := fetchExport(tx, cursor, fn)
+			if err != nil {
+				return err
+			}
+			if count < exportFetchSize {
+				return tx.Exec("CLOSE " + cursor).Error
+			}
+		}
+	})
+}
+
+func fetchExport(tx *gorm.DB, cursor string, fn func(user *User) error) (int, error) {
+	rows, err := tx.Raw("FETCH " + strconv.Itoa(exportFetchSize) + " FROM " + cursor).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var usr User
+		if err := tx.ScanRows(rows, &usr); err != nil {
+			return count, err
+		}
+		count++
+		if err := fn(&usr); err != nil {
+			return count, err
+		}
+	}
+	return count, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (p *PostgreSql) UpdateUser(ctx context.Context, user *User) error {
+	var after User
+	err := p.transaction(ctx, func(tx *gorm.DB) error {
+		before, err := lockUser(tx, user.Id, false)
+		if err != nil {
+			return err
+		}
+		if user.Version != 0 && user.Version != before.Version {
+			return ErrVersionConflict
+		}
+		after = *before
+		after.PublicUser = user.PublicUser
+		after.normalize()
+		after.UpdatedOn = time.Now()
+		after.Version++
+		err = tx.Exec(`UPDATE "users" SET "name" = ?, "email" = ?, "status" = ?, "metadata" = ?, `+
+			`"updated_on" = ?, "version" = ? WHERE "id" = ?`,
+			after.Name, after.Email, after.Status, after.Metadata, after.UpdatedOn, after.Version, after.Id).Error
+		if err != nil {
+			return emailError(err)
+		}
+		return writeAudit(ctx, tx, AuditUpdate, before, &after)
+	})
+	if err != nil {
+		return err
+	}
+	*user = after
+	return nil
+}
+
+func (p *PostgreSql) DeleteUser(ctx context.Context, id, version int) error {
+	return p.transaction(ctx, func(tx *gorm.DB) error {
+		before, err := lockUser(tx, id, false)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return ErrVersionConflict
+		}
+		after := *before
+		now := time.Now()
+		after.DeletedOn = &now
+		after.UpdatedOn = now
+		after.Version++
+		err = tx.Exec(`UPDATE "users" SET "deleted_on" = ?, "updated_on" = ?, "version" = ? WHERE "id" = ?`,
+			after.DeletedOn, after.UpdatedOn, after.Version, id).Error
+		if err != nil {
+			return err
+		}
+		return writeAudit(ctx, tx, AuditDelete, before, &after)
+	})
+}
+
+func (p *PostgreSql) RestoreUser(ctx context.Context, id int) (*User, error) {
+	var result *User
+	err := p.transaction(ctx, func(tx *gorm.DB) error {
+		before, err := lockUser(tx, id, true)
+		if err != nil {
+			return err
+		}
+		if before.DeletedOn == nil {
+			result = before
+			return nil
+		}
+		after := *before
+		after.DeletedOn = nil
+		after.UpdatedOn = time.Now()
+		after.Version++
+		err = tx.Exec(`UPDATE "users" SET "deleted_on" = NULL, "updated_on" = ?, "version" = ? WHERE "id" = ?`,
+			after.UpdatedOn, after.Version, id).Error
+		if err != nil {
+			return err
+		}
+		result = &after
+		return writeAudit(ctx, tx, AuditRestore, before, &after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *PostgreSql) PurgeUsers(ctx context.Context, before time.Time) (int64, error) {
+	var purged []User
+	err := p.transaction(ctx, func(tx *gorm.DB) error {
+		err := tx.Raw(`DELETE FROM "users" WHERE "deleted_on" < ? RETURNING *`, before).
+			Scan(&purged).Error
+		if err != nil {
+			return err
+		}
+		for i := range purged {
+			if err := writeAudit(ctx, tx, AuditPurge, &purged[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(purged)), nil
+}
+
+func (p *PostgreSql) History(ctx context.Context, userId, offset, limit int) ([]UserAudit, error) {
+	result := make([]UserAudit, 0, limit)
+	err := p.conn().Where("user_id = ?", userId).Order("id").
+		Limit(limit).Offset(offset).Find(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//lockUser selects user for update inside of transaction
+func lockUser(tx *gorm.DB, id int, withDeleted bool) (*User, error) {
+	result := User{}
+	db := tx.Set("gorm:query_option", "FOR UPDATE")
+	if !withDeleted {
+		db = db.Where("deleted_on IS NULL")
+	}
+	if err := db.First(&result, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+//writeAudit also writes the change into the outbox and remembers it
+//to publish on the bus after commit
+func writeAudit(ctx context.Context, tx *gorm.DB, action string, before, after *User) error {
+	markWritten(ctx)
+	audit, err := newUserAudit(ctx, action, before, after)
+	if err != nil {
+		return err
+	}
+	err = tx.Exec(`INSERT INTO "user_audits"
+		("user_id", "action", "actor", "request_id", "before", "after", "diff", "created_on")
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		audit.UserId, audit.Action, audit.Actor, audit.RequestId,
+		jsonb(audit.Before), jsonb(audit.After), jsonb(audit.Diff), audit.CreateOn).Error
+	if err != nil {
+		return err
+	}
+	change, ok := changeOf(action, before, after)
+	if !ok {
+		return nil
+	}
+	event, err := newOutboxEvent(&change)
+	if err != nil {
+		return err
+	}
+	err = tx.Exec(`INSERT INTO "outbox" ("user_id", "type", "payload", "created_on")
+		VALUES (?, ?, ?, ?)`,
+		event.UserId, event.Type, jsonb(event.Payload), event.CreateOn).Error
+	if err != nil {
+		return err
+	}
+	changes, err := txChanges(tx)
+	if err != nil {
+		return err
+	}
+	*changes = append(*changes, change)
+	return nil
+}
+
+//txChanges returns changes written in transaction started by WithTx,
+//changes of any other transaction would never be published
+func txChanges(tx *gorm.DB) (*[]Change, error) {
+	v, _ := tx.Get(changesSetting)
+	changes, ok := v.(*[]Change)
+	if !ok {
+		return nil, errNoTransaction
+	}
+	return changes, nil
+}
+
+//jsonb converts raw json into query argument, bytes would be sent as bytea
+func jsonb(raw json.RawMessage) interface{} {
+	if raw == nil {
+		return nil
+	}
+	return string(raw)
+}
+
+//users scopes queries to not deleted users unless WithDeleted is set
+func (p *PostgreSql) users(ctx context.Context) *gorm.DB {
+	return scopeUsers(ctx, p.conn())
+}
+
+func scopeUsers(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if withDeleted(ctx) {
+		return db
+	}
+	return db.Where("deleted_on IS NULL")
+}
+
+func (p *PostgreSql) Changes() *ChangeBus {
+	return p.bus
+}
+
 func (p *PostgreSql) Ping(ctx context.Context) error {
 	return p.pool.DB().PingContext(ctx)
 }
 
+func (p *PostgreSql) CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	db := p.conn().Exec(`INSERT INTO idempotency_keys
+		(key, fingerprint, status_code, body, created_on, expire_on)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint,
+			status_code = EXCLUDED.status_code, body = EXCLUDED.body,
+			created_on = EXCLUDED.created_on, expire_on = EXCLUDED.expire_on
+		WHERE idempotency_keys.expire_on < EXCLUDED.created_on`,
+		key.Key, key.Fingerprint, key.StatusCode, key.Body, key.CreateOn, key.ExpireOn)
+	if err := db.Error; err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return ErrDuplicateKey
+	}
+	return nil
+}
+
+func (p *PostgreSql) GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error) {
+	result := IdempotencyKey{}
+	db := p.conn().First(&result, "key = ? AND expire_on > ?", key, time.Now())
+	if err := db.Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (p *PostgreSql) UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	return p.conn().Model(&IdempotencyKey{}).Where("key = ?", key.Key).
+		Updates(map[string]interface{}{
+			"status_code": key.StatusCode,
+			"header":      key.Header,
+			"body":        key.Body,
+		}).Error
+}
+
+func (p *PostgreSql) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return p.conn().Where("key = ?", key).Delete(&IdempotencyKey{}).Error
+}
+
+func (p *PostgreSql) CreateWebhook(ctx context.Context, hook *Webhook) error {
+	return p.conn().Raw(`INSERT INTO "webhooks" ("url", "secret", "events", "active")
+		VALUES (?, ?, ?, ?) RETURNING "id", "created_on"`,
+		hook.Url, hook.Secret, hook.Events, hook.Active).Row().Scan(&hook.Id, &hook.CreateOn)
+}
+
+func (p *PostgreSql) GetWebhook(ctx context.Context, id int) (*Webhook, error) {
+	result := Webhook{}
+	if err := p.conn().First(&result, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (p *PostgreSql) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	result := make([]Webhook, 0)
+	if err := p.conn().Order("id").Find(&result).Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *PostgreSql) UpdateWebhook(ctx context.Context, hook *Webhook) error {
+	db := p.conn().Exec(`UPDATE "webhooks" SET "url" = ?, "secret" = ?, "events" = ?, "active" = ?
+		WHERE "id" = ?`, hook.Url, hook.Secret, hook.Events, hook.Active, hook.Id)
+	if err := db.Error; err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *PostgreSql) DeleteWebhook(ctx context.Context, id int) error {
+	db := p.conn().Exec(`DELETE FROM "webhooks" WHERE "id" = ?`, id)
+	if err := db.Error; err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *PostgreSql) InsertDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	err := p.conn().Raw(`INSERT INTO "webhook_deliveries"
+		("webhook_id", "event_id", "event", "payload", "status", "next_attempt_on")
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT ("webhook_id", "event_id") DO NOTHING
+		RETURNING "id", "created_on"`,
+		delivery.WebhookId, delivery.EventId, delivery.Event, jsonb(delivery.Payload),
+		delivery.Status, delivery.NextAttemptOn).Row().Scan(&delivery.Id, &delivery.CreateOn)
+	if err == sql.ErrNoRows {
+		//the event is already stored for this webhook
+		return nil
+	}
+	return err
+}
+
+func (p *PostgreSql) GetDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	result := WebhookDelivery{}
+	if err := p.conn().First(&result, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (p *PostgreSql) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	db := p.conn().Exec(`UPDATE "webhook_deliveries" SET "status" = ?, "attempts" = ?,
+		"response_code" = ?, "error" = ?, "next_attempt_on" = ?, "delivered_on" = ?
+		WHERE "id" = ?`,
+		delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.NextAttemptOn, delivery.DeliveredOn, delivery.Id)
+	if err := db.Error; err != nil {
+		return err
+	}
+	if db.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (p *PostgreSql) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	result := make([]WebhookDelivery, 0, limit)
+	err := p.conn().Raw(`UPDATE "webhook_deliveries" SET "next_attempt_on" = ?
+		WHERE "id" IN (SELECT "id" FROM "webhook_deliveries"
+			WHERE "status" = ? AND "next_attempt_on" <= ?
+			ORDER BY "next_attempt_on" LIMIT ? FOR UPDATE SKIP LOCKED)
+		RETURNING *`, now.Add(lease), DeliveryPending, now, limit).Scan(&result).Error
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (p *PostgreSql) Deliveries(ctx context.Context, webhookId int, status string, offset, limit int) ([]WebhookDelivery, error) {
+	result := make([]WebhookDelivery, 0, limit)
+	db := p.conn()
+	if webhookId != 0 {
+		db = db.Where("webhook_id = ?", webhookId)
+	}
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	if err := db.Order("id DESC").Limit(limit).Offset(offset).Find(&result).Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *PostgreSql) LockOutbox(ctx context.Context) (bool, error) {
+	if p.tx == nil {
+		return false, errNoTransaction
+	}
+	var locked bool
+	err := p.tx.Raw(`SELECT pg_try_advisory_xact_lock(?)`, outboxLockKey).Row().Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+func (p *PostgreSql) OutboxEvents(ctx context.Context, limit int, skipUsers []int) ([]OutboxEvent, error) {
+	result := make([]OutboxEvent, 0, limit)
+	query := p.conn().Order("id").Limit(limit)
+	if len(skipUsers) > 0 {
+		query = query.Where(`"user_id" NOT IN (?)`, skipUsers)
+	}
+	if err := query.Find(&result).Error; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (p *PostgreSql) DeleteOutboxEvents(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return p.conn().Exec(`DELETE FROM "outbox" WHERE "id" IN (?)`, ids).Error
+}
+
+//Close stops checks of replicas and closes connections to the database
+func (p *PostgreSql) Close() error {
+	p.replicas.close()
+	return p.pool.Close()
+}
+
 func NewPostgreDB(config *DbConfig, fn FuncLogging) (IRepository, error) {
-	conn := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable",
-		config.Host, config.Port, config.User, config.DbName, config.Password)
-	poolConn, err := gorm.Open("postgres", conn)
+	poolConn, err := gorm.Open("postgres", config.source())
 	if err != nil {
 		return nil, err
 	}
-	return &PostgreSql{pool: poolConn}, nil
+	if err := migrate(poolConn); err != nil {
+		poolConn.Close()
+		return nil, err
+	}
+	result := &PostgreSql{pool: poolConn, logFunc: fn, bus: NewChangeBus(0)}
+	if len(config.Replicas) > 0 {
+		if result.replicas, err = openReplicas(config.Replicas, fn); err != nil {
+			poolConn.Close()
+			return nil, err
+		}
+		go result.replicas.watch(replicaCheckInterval)
+	}
+	return result, nil
 }
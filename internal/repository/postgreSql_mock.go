@@ -5,70 +5,678 @@ import (
 	"errors"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type PostgreMock struct {
-	pool    []User
-	logFunc FuncLogging
+	pool   []User
+	keys   map[string]IdempotencyKey
+	audits []UserAudit
+	hooks  []Webhook
+	//deliveries are ordered by id
+	deliveries []WebhookDelivery
+	outbox     []OutboxEvent
+	outboxId   int64
+	mu         sync.Mutex
+	logFunc    FuncLogging
+	bus        *ChangeBus
+	//pending changes are published when the outermost WithTx succeeds
+	depth   int
+	pending []Change
+}
+
+//WithTx restores state of the mock if fn fails or panics,
+//changes made concurrently by other callers are lost too
+func (p *PostgreMock) WithTx(ctx context.Context, fn func(repo IRepository) error) error {
+	p.mu.Lock()
+	pool := append([]User(nil), p.pool...)
+	audits := append([]UserAudit(nil), p.audits...)
+	outbox := append([]OutboxEvent(nil), p.outbox...)
+	keys := make(map[string]IdempotencyKey, len(p.keys))
+	for k, v := range p.keys {
+		keys[k] = v
+	}
+	pending := len(p.pending)
+	p.depth++
+	p.mu.Unlock()
+	restore := func() {
+		p.mu.Lock()
+		p.pool, p.audits, p.keys, p.outbox = pool, audits, keys, outbox
+		p.pending = p.pending[:pending]
+		p.depth--
+		p.mu.Unlock()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			restore()
+			panic(r)
+		}
+	}()
+	if err := fn(p); err != nil {
+		restore()
+		return err
+	}
+	p.mu.Lock()
+	p.depth--
+	var changes []Change
+	if p.depth == 0 {
+		changes, p.pending = p.pending, nil
+	}
+	p.mu.Unlock()
+	p.bus.Publish(changes...)
+	return nil
 }
 
 func (p *PostgreMock) InsertUser(ctx context.Context, user *User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.pool {
+		if v.Id > user.Id {
+			user.Id = v.Id
+		}
+	}
+	user.normalize()
+	if p.emailTaken(user.Email, 0) {
+		return ErrEmailTaken
+	}
+	user.Id++
+	user.CreateOn = time.Now()
+	user.UpdatedOn = user.CreateOn
+	user.Version = 1
 	p.pool = append(p.pool, *user)
-	return nil
+	return p.audit(ctx, AuditInsert, nil, user)
+}
+
+func (p *PostgreMock) InsertUsers(ctx context.Context, users []User) error {
+	return p.WithTx(ctx, func(repo IRepository) error {
+		for i := range users {
+			if err := repo.InsertUser(ctx, &users[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (p *PostgreMock) GetUserById(ctx context.Context, id int) (*User, error) {
-	for _, v := range p.pool {
+	p.mu.Lock()
+	pool := append([]User(nil), p.pool...)
+	p.mu.Unlock()
+	for _, v := range pool {
 		time.Sleep(600 * time.Millisecond)
-		if v.Id == id {
+		if v.Id == id && (v.DeletedOn == nil || withDeleted(ctx)) {
 			return &v, nil
 		}
 	}
 	return nil, gorm.ErrRecordNotFound
 }
 
+func (p *PostgreMock) GetUsersByIds(ctx context.Context, ids []int) ([]User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	result := make([]User, 0, len(ids))
+	for _, v := range p.pool {
+		if wanted[v.Id] && (v.DeletedOn == nil || withDeleted(ctx)) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (p *PostgreMock) FindUsers(ctx context.Context, filter UserFilter, afterId, limit int) ([]User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]User, 0, limit)
+	for _, v := range p.pool {
+		if len(result) == limit {
+			break
+		}
+		if v.Id <= afterId || v.DeletedOn != nil && !withDeleted(ctx) {
+			continue
+		}
+		if matchesFilter(&v, filter) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+//SearchUsers ranks users naively: words matching the query count one
+//and similarity of trigrams is added to it
+func (p *PostgreMock) SearchUsers(ctx context.Context, query string, offset, limit int) ([]SearchResult, error) {
+	words := SearchWords(query)
+	text := strings.Join(words, " ")
+	p.mu.Lock()
+	found := make([]SearchResult, 0, len(p.pool))
+	for _, v := range p.pool {
+		if len(words) == 0 || v.DeletedOn != nil && !withDeleted(ctx) {
+			continue
+		}
+		rank := similarity(v.Name, text)
+		if matchesPrefixes(SearchWords(v.Name), words) {
+			rank++
+		} else if rank < similarityThreshold {
+			continue
+		}
+		found = append(found, SearchResult{User: v, Rank: rank})
+	}
+	p.mu.Unlock()
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Rank != found[j].Rank {
+			return found[i].Rank > found[j].Rank
+		}
+		return found[i].Id < found[j].Id
+	})
+	if offset >= len(found) {
+		return []SearchResult{}, nil
+	}
+	found = found[offset:]
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
 func (p *PostgreMock) Fetch(ctx context.Context, offset, limit int) ([]User, error) {
 	if limit > 3 {
 		limit = 3
 	}
-	if offset > 3 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	visible := make([]User, 0, len(p.pool))
+	for _, v := range p.pool {
+		if v.DeletedOn == nil || withDeleted(ctx) {
+			visible = append(visible, v)
+		}
+	}
+	if offset > len(visible) {
 		return nil, errors.New("data is empty")
 	}
-	return p.pool[offset:limit], nil
+	end := offset + limit
+	if end > len(visible) {
+		end = len(visible)
+	}
+	return visible[offset:end], nil
+}
+
+func (p *PostgreMock) ExportUsers(ctx context.Context, filter UserFilter, fn func(user *User) error) error {
+	p.mu.Lock()
+	pool := append([]User(nil), p.pool...)
+	p.mu.Unlock()
+	for i := range pool {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pool[i].DeletedOn != nil && !withDeleted(ctx) {
+			continue
+		}
+		if !matchesFilter(&pool[i], filter) {
+			continue
+		}
+		if err := fn(&pool[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//emailTaken reports whether a user other than id has the email
+func (p *PostgreMock) emailTaken(email string, id int) bool {
+	if email == "" {
+		return false
+	}
+	for _, v := range p.pool {
+		if v.Id != id && strings.EqualFold(v.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchesFilter checks filter the way FindUsers does, metadata values are compared as a whole
+func matchesFilter(user *User, filter UserFilter) bool {
+	if !strings.Contains(strings.ToLower(user.Name), strings.ToLower(filter.Name)) {
+		return false
+	}
+	if filter.Email != "" && !strings.EqualFold(user.Email, strings.TrimSpace(filter.Email)) {
+		return false
+	}
+	if filter.Status != "" && user.Status != filter.Status {
+		return false
+	}
+	if user.UpdatedOn.Before(filter.UpdatedSince) {
+		return false
+	}
+	for k, v := range filter.Metadata {
+		value, ok := user.Metadata[k]
+		if !ok || !reflect.DeepEqual(value, v) {
+			return false
+		}
+	}
+	return true
+}
+
+//Len returns count of not deleted users
+func (p *PostgreMock) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for _, v := range p.pool {
+		if v.DeletedOn == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *PostgreMock) Changes() *ChangeBus {
+	return p.bus
 }
 
 func (p *PostgreMock) Ping(ctx context.Context) error {
 	return nil
 }
 
+func (p *PostgreMock) UpdateUser(ctx context.Context, user *User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.pool {
+		if v.Id != user.Id || v.DeletedOn != nil {
+			continue
+		}
+		if user.Version != 0 && user.Version != v.Version {
+			return ErrVersionConflict
+		}
+		public := user.PublicUser
+		public.normalize()
+		if p.emailTaken(public.Email, v.Id) {
+			return ErrEmailTaken
+		}
+		p.pool[i].PublicUser = public
+		p.pool[i].UpdatedOn = time.Now()
+		p.pool[i].Version++
+		*user = p.pool[i]
+		return p.audit(ctx, AuditUpdate, &v, user)
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) DeleteUser(ctx context.Context, id, version int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.pool {
+		if v.Id != id || v.DeletedOn != nil {
+			continue
+		}
+		if version != 0 && version != v.Version {
+			return ErrVersionConflict
+		}
+		now := time.Now()
+		p.pool[i].DeletedOn = &now
+		p.pool[i].UpdatedOn = now
+		p.pool[i].Version++
+		return p.audit(ctx, AuditDelete, &v, &p.pool[i])
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) RestoreUser(ctx context.Context, id int) (*User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.pool {
+		if v.Id != id {
+			continue
+		}
+		result := p.pool[i]
+		if v.DeletedOn == nil {
+			return &result, nil
+		}
+		p.pool[i].DeletedOn = nil
+		p.pool[i].UpdatedOn = time.Now()
+		p.pool[i].Version++
+		result = p.pool[i]
+		return &result, p.audit(ctx, AuditRestore, &v, &result)
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+//PurgeUsers runs in WithTx, so users stay in the pool if any audit fails
+func (p *PostgreMock) PurgeUsers(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := p.WithTx(ctx, func(repo IRepository) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		kept := make([]User, 0, len(p.pool))
+		for _, v := range p.pool {
+			if v.DeletedOn != nil && v.DeletedOn.Before(before) {
+				if err := p.audit(ctx, AuditPurge, &v, nil); err != nil {
+					return err
+				}
+				purged++
+				continue
+			}
+			kept = append(kept, v)
+		}
+		p.pool = kept
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (p *PostgreMock) History(ctx context.Context, userId, offset, limit int) ([]UserAudit, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]UserAudit, 0, limit)
+	for _, v := range p.audits {
+		if v.UserId != userId {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(result) == limit {
+			break
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+//audit must be called with p.mu locked
+func (p *PostgreMock) audit(ctx context.Context, action string, before, after *User) error {
+	audit, err := newUserAudit(ctx, action, before, after)
+	if err != nil {
+		return err
+	}
+	audit.Id = len(p.audits) + 1
+	p.audits = append(p.audits, *audit)
+	change, ok := changeOf(action, before, after)
+	if !ok {
+		return nil
+	}
+	event, err := newOutboxEvent(&change)
+	if err != nil {
+		return err
+	}
+	p.outboxId++
+	event.Id = p.outboxId
+	p.outbox = append(p.outbox, *event)
+	if p.depth > 0 {
+		p.pending = append(p.pending, change)
+	} else {
+		p.bus.Publish(change)
+	}
+	return nil
+}
+
+func (p *PostgreMock) CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.keys[key.Key]; ok && old.ExpireOn.After(key.CreateOn) {
+		return ErrDuplicateKey
+	}
+	p.keys[key.Key] = *key
+	return nil
+}
+
+func (p *PostgreMock) GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.keys[key]
+	if !ok || !v.ExpireOn.After(time.Now()) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &v, nil
+}
+
+func (p *PostgreMock) UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.keys[key.Key]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	v.StatusCode = key.StatusCode
+	v.Header = key.Header
+	v.Body = key.Body
+	p.keys[key.Key] = v
+	return nil
+}
+
+func (p *PostgreMock) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.keys, key)
+	return nil
+}
+
+func (p *PostgreMock) CreateWebhook(ctx context.Context, hook *Webhook) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hook.Id = 1
+	if len(p.hooks) > 0 {
+		hook.Id = p.hooks[len(p.hooks)-1].Id + 1
+	}
+	hook.CreateOn = time.Now()
+	p.hooks = append(p.hooks, *hook)
+	return nil
+}
+
+func (p *PostgreMock) GetWebhook(ctx context.Context, id int) (*Webhook, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.hooks {
+		if v.Id == id {
+			return &v, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Webhook{}, p.hooks...), nil
+}
+
+func (p *PostgreMock) UpdateWebhook(ctx context.Context, hook *Webhook) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.hooks {
+		if v.Id == hook.Id {
+			hook.CreateOn = v.CreateOn
+			p.hooks[i] = *hook
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) DeleteWebhook(ctx context.Context, id int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.hooks {
+		if v.Id != id {
+			continue
+		}
+		p.hooks = append(p.hooks[:i], p.hooks[i+1:]...)
+		kept := p.deliveries[:0]
+		for _, d := range p.deliveries {
+			if d.WebhookId != id {
+				kept = append(kept, d)
+			}
+		}
+		p.deliveries = kept
+		return nil
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) InsertDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.deliveries {
+		if v.WebhookId == delivery.WebhookId && v.EventId == delivery.EventId {
+			return nil
+		}
+	}
+	delivery.Id = 1
+	if len(p.deliveries) > 0 {
+		delivery.Id = p.deliveries[len(p.deliveries)-1].Id + 1
+	}
+	delivery.CreateOn = time.Now()
+	p.deliveries = append(p.deliveries, *delivery)
+	return nil
+}
+
+func (p *PostgreMock) GetDelivery(ctx context.Context, id int64) (*WebhookDelivery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.deliveries {
+		if v.Id == id {
+			return &v, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.deliveries {
+		if v.Id == delivery.Id {
+			p.deliveries[i] = *delivery
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (p *PostgreMock) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]WebhookDelivery, 0, limit)
+	for i, v := range p.deliveries {
+		if len(result) == limit {
+			break
+		}
+		if v.Status != DeliveryPending || v.NextAttemptOn.After(now) {
+			continue
+		}
+		p.deliveries[i].NextAttemptOn = now.Add(lease)
+		result = append(result, p.deliveries[i])
+	}
+	return result, nil
+}
+
+func (p *PostgreMock) Deliveries(ctx context.Context, webhookId int, status string, offset, limit int) ([]WebhookDelivery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]WebhookDelivery, 0, limit)
+	for i := len(p.deliveries) - 1; i >= 0 && len(result) < limit; i-- {
+		v := p.deliveries[i]
+		if (webhookId != 0 && v.WebhookId != webhookId) || (status != "" && v.Status != status) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+//LockOutbox always succeeds: the mock is used by a single process
+func (p *PostgreMock) LockOutbox(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (p *PostgreMock) OutboxEvents(ctx context.Context, limit int, skipUsers []int) ([]OutboxEvent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	skipped := make(map[int]bool, len(skipUsers))
+	for _, id := range skipUsers {
+		skipped[id] = true
+	}
+	result := make([]OutboxEvent, 0, limit)
+	for _, v := range p.outbox {
+		if len(result) == limit {
+			break
+		}
+		if !skipped[v.UserId] {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (p *PostgreMock) DeleteOutboxEvents(ctx context.Context, ids []int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deleted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	result := p.outbox[:0]
+	for _, v := range p.outbox {
+		if !deleted[v.Id] {
+			result = append(result, v)
+		}
+	}
+	p.outbox = result
+	return nil
+}
+
 func NewPostgresDBMock() (IRepository, error) {
 	test := []User{
 		{PrivateUser{
-			Id:       1,
-			CreateOn: time.Unix(10, 10)},
-			PublicUser{Name: "Vasy"},
+			Id:        1,
+			CreateOn:  time.Unix(10, 10),
+			UpdatedOn: time.Unix(10, 10),
+			Version:   1},
+			PublicUser{Name: "Vasy", Status: StatusActive},
 		},
 		{PrivateUser{
-			Id:       2,
-			CreateOn: time.Unix(10, 10)},
-			PublicUser{Name: "VasyVasy"},
+			Id:        2,
+			CreateOn:  time.Unix(10, 10),
+			UpdatedOn: time.Unix(10, 10),
+			Version:   1},
+			PublicUser{Name: "VasyVasy", Status: StatusActive},
 		},
 		{PrivateUser{
-			Id:       3,
-			CreateOn: time.Unix(10, 10)},
-			PublicUser{Name: "Pety"},
+			Id:        3,
+			CreateOn:  time.Unix(10, 10),
+			UpdatedOn: time.Unix(10, 10),
+			Version:   1},
+			PublicUser{Name: "Pety", Status: StatusActive},
 		},
 		{PrivateUser{
-			Id:       4,
-			CreateOn: time.Unix(10, 10)},
-			PublicUser{Name: "PetyPety"},
+			Id:        4,
+			CreateOn:  time.Unix(10, 10),
+			UpdatedOn: time.Unix(10, 10),
+			Version:   1},
+			PublicUser{Name: "PetyPety", Status: StatusActive},
 		},
 		{PrivateUser{
-			Id:       5,
-			CreateOn: time.Unix(10, 10)},
-			PublicUser{Name: "Sany"},
+			Id:        5,
+			CreateOn:  time.Unix(10, 10),
+			UpdatedOn: time.Unix(10, 10),
+			Version:   1},
+			PublicUser{Name: "Sany", Status: StatusActive},
 		},
 	}
-	return &PostgreMock{pool: test}, nil
+	return &PostgreMock{pool: test, keys: map[string]IdempotencyKey{}, bus: NewChangeBus(0)}, nil
 }
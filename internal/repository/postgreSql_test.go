@@ -2,12 +2,17 @@ package repository
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	uuid "github.com/satori/go.uuid"
 	"log"
 	"reflect"
 	"regexp"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -46,13 +51,13 @@ func Setup() {
 	testDb.LogMode(false)
 	repo := &PostgreSql{pool: testDb, logFunc: func(text string) {
 		log.Println(text)
-	}}
+	}, bus: NewChangeBus(0)}
 	p.repo = repo
 }
 
 func TestPostgreSql_Fetch(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 3 OFFSET 0 `)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 3 OFFSET 0 `)).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
 			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name).
 			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name).
@@ -68,7 +73,7 @@ func TestPostgreSql_Fetch(t *testing.T) {
 
 func TestPostgreSql_Fetch_1(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 2 OFFSET 0`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 2 OFFSET 0`)).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
 			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name).
 			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
@@ -84,7 +89,7 @@ func TestPostgreSql_Fetch_1(t *testing.T) {
 //return 2
 func TestPostgreSql_Fetch2(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 2 OFFSET 1`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 2 OFFSET 1`)).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
 			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name).
 			AddRow(testuser[2].Id, testuser[2].CreateOn, testuser[2].Name))
@@ -100,7 +105,7 @@ func TestPostgreSql_Fetch2(t *testing.T) {
 //return 1
 func TestPostgreSql_Fetch3(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 3 OFFSET 2`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 3 OFFSET 2`)).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
 			AddRow(testuser[2].Id, testuser[2].CreateOn, testuser[2].Name))
 	res, err := p.repo.Fetch(context.Background(), 2, 3)
@@ -115,7 +120,7 @@ func TestPostgreSql_Fetch3(t *testing.T) {
 //return 0
 func TestPostgreSql_Fetch4(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 10 OFFSET 4`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 10 OFFSET 4`)).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}))
 	res, err := p.repo.Fetch(context.Background(), 4, 10)
 	if err != nil {
@@ -128,7 +133,7 @@ func TestPostgreSql_Fetch4(t *testing.T) {
 
 func TestPostgreSql_FetchError(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" LIMIT 3 OFFSET 0`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 3 OFFSET 0`)).
 		WillReturnError(gorm.ErrRecordNotFound)
 	res, err := p.repo.Fetch(context.Background(), 0, 3)
 	if err == nil {
@@ -141,7 +146,7 @@ func TestPostgreSql_FetchError(t *testing.T) {
 
 func TestPostgreSql_GetUserById(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (id = $1)`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1)`)).
 		WithArgs(2).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
 			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
@@ -156,7 +161,7 @@ func TestPostgreSql_GetUserById(t *testing.T) {
 
 func TestPostgreSql_GetUserById_Error(t *testing.T) {
 	Setup()
-	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (id = $1)`)).
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1)`)).
 		WithArgs(2).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}))
 	res, err := p.repo.GetUserById(context.Background(), 2)
@@ -185,19 +190,28 @@ func TestPostgreSql_InsertUser_Success(t *testing.T) {
 	user := User{}
 	user.Name = "Vasy"
 	user.CreateOn = time
-	strQuery := regexp.QuoteMeta(`INSERT  INTO "users" ("created_on","name") 
-		VALUES ($1,$2) RETURNING "users"."id"`)
+	strQuery := regexp.QuoteMeta(`INSERT INTO "users" ("name", "email", "status", "metadata") VALUES ($1, $2, $3, $4) RETURNING "id", "created_on", "updated_on", "version"`)
 	p.mock.ExpectBegin()
 	p.mock.ExpectQuery(strQuery).
-		WithArgs(user.CreateOn, user.Name).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).
-			AddRow(1))
+		WithArgs(user.Name, "", StatusActive, "{}").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "updated_on", "version"}).
+			AddRow(1, time, time, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WithArgs(1, AuditInsert, "system", "", nil, sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(1, ChangeCreated, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 	p.mock.ExpectCommit()
 	ctx := context.WithValue(context.Background(), "LogID", uuid.NewV4())
 	err := p.repo.InsertUser(ctx, &user)
 	if err != nil {
 		t.Errorf("expected nil got\n %s", err)
 	}
+	if user.Id != 1 || !user.CreateOn.Equal(time) {
+		t.Errorf("expected id 1 and created_on %v got %v", time, user)
+	}
 }
 
 func TestPostgreSql_InsertUser_Err(t *testing.T) {
@@ -206,11 +220,10 @@ func TestPostgreSql_InsertUser_Err(t *testing.T) {
 	user := User{}
 	user.Name = "Vasy"
 	user.CreateOn = time
-	strQuery := regexp.QuoteMeta(`INSERT  INTO "users" ("created_on","name") 
-		VALUES ($1,$2) RETURNING "users"."id"`)
+	strQuery := regexp.QuoteMeta(`INSERT INTO "users" ("name", "email", "status", "metadata") VALUES ($1, $2, $3, $4) RETURNING "id", "created_on", "updated_on", "version"`)
 	p.mock.ExpectBegin()
 	p.mock.ExpectQuery(strQuery).
-		WithArgs(user.CreateOn, user.Name).
+		WithArgs(user.Name, "", StatusActive, "{}").
 		WillReturnError(gorm.ErrInvalidTransaction)
 	p.mock.ExpectRollback()
 	ctx := context.WithValue(context.Background(), "LogID", uuid.NewV4())
@@ -226,11 +239,10 @@ func TestPostgreSql_InsertUser_Err_Uuid(t *testing.T) {
 	user := User{}
 	user.Name = "Vasy"
 	user.CreateOn = time
-	strQuery := regexp.QuoteMeta(`INSERT  INTO "users" ("created_on","name") 
-		VALUES ($1,$2) RETURNING "users"."id"`)
+	strQuery := regexp.QuoteMeta(`INSERT INTO "users" ("name", "email", "status", "metadata") VALUES ($1, $2, $3, $4) RETURNING "id", "created_on", "updated_on", "version"`)
 	p.mock.ExpectBegin()
 	p.mock.ExpectQuery(strQuery).
-		WithArgs(user.CreateOn, user.Name).
+		WithArgs(user.Name, "", StatusActive, "{}").
 		WillReturnError(gorm.ErrInvalidTransaction)
 	p.mock.ExpectRollback()
 	ctx := context.WithValue(context.Background(), "Lg", uuid.NewV4())
@@ -272,3 +284,665 @@ func TestNewPostgreDB_Error(t *testing.T) {
 		t.Errorf("expected nil, got:\n %#v", err)
 	}
 }
+
+func TestPostgreSql_CreateIdempotencyKey_Duplicate(t *testing.T) {
+	Setup()
+	now := time.Now()
+	key := IdempotencyKey{
+		Key:         "key-1",
+		Fingerprint: "abc",
+		CreateOn:    now,
+		ExpireOn:    now.Add(time.Hour),
+	}
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO idempotency_keys`)).
+		WithArgs(key.Key, key.Fingerprint, 0, sqlmock.AnyArg(), key.CreateOn, key.ExpireOn).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	err := p.repo.CreateIdempotencyKey(context.Background(), &key)
+	if err != ErrDuplicateKey {
+		t.Errorf("expected %v got %v", ErrDuplicateKey, err)
+	}
+}
+
+func TestPostgreSql_CreateIdempotencyKey_Success(t *testing.T) {
+	Setup()
+	now := time.Now()
+	key := IdempotencyKey{
+		Key:         "key-1",
+		Fingerprint: "abc",
+		CreateOn:    now,
+		ExpireOn:    now.Add(time.Hour),
+	}
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO idempotency_keys`)).
+		WithArgs(key.Key, key.Fingerprint, 0, sqlmock.AnyArg(), key.CreateOn, key.ExpireOn).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err := p.repo.CreateIdempotencyKey(context.Background(), &key)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+func TestPostgreSql_UpdateUser_VersionConflict(t *testing.T) {
+	Setup()
+	user := User{}
+	user.Id = 2
+	user.Version = 3
+	user.Name = "Pety"
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1) ORDER BY "users"."id" ASC LIMIT 1 FOR UPDATE`)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name", "version"}).
+			AddRow(2, testuser[1].CreateOn, testuser[1].Name, 4))
+	p.mock.ExpectRollback()
+	err := p.repo.UpdateUser(context.Background(), &user)
+	if err != ErrVersionConflict {
+		t.Errorf("expected %v got %v", ErrVersionConflict, err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_UpdateUser_Audit(t *testing.T) {
+	Setup()
+	user := User{}
+	user.Id = 2
+	user.Name = "Pety"
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1)`)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "updated_on", "name", "status", "metadata", "version"}).
+			AddRow(2, testuser[1].CreateOn, testuser[1].CreateOn, testuser[1].Name, StatusActive, []byte(`{}`), 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "name" = $1, "email" = $2, "status" = $3, "metadata" = $4, `+
+		`"updated_on" = $5, "version" = $6 WHERE "id" = $7`)).
+		WithArgs("Pety", "", StatusActive, "{}", sqlmock.AnyArg(), 2, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WithArgs(2, AuditUpdate, "admin", "req-1", sqlmock.AnyArg(), sqlmock.AnyArg(),
+			diffOf(`{"name":{"new":"Pety","old":"VasyVasy"},"version":{"new":2,"old":1}}`, "updated_on"),
+			sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(2, ChangeUpdated, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectCommit()
+	ctx := WithRequestID(WithActor(context.Background(), "admin"), "req-1")
+	if err := p.repo.UpdateUser(ctx, &user); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if user.Version != 2 {
+		t.Errorf("expected version 2 got %d", user.Version)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_DeleteUser_NotFound(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id = $1)`)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}))
+	p.mock.ExpectRollback()
+	err := p.repo.DeleteUser(context.Background(), 2, 0)
+	if err != gorm.ErrRecordNotFound {
+		t.Errorf("expected %v got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestPostgreSql_GetUserById_WithDeleted(t *testing.T) {
+	Setup()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (id = $1)`)).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
+	res, err := p.repo.GetUserById(WithDeleted(context.Background()), 2)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if res == nil || res.Id != 2 {
+		t.Errorf("expected %v \ngot %v", testuser[1], res)
+	}
+}
+
+func TestPostgreSql_PurgeUsers(t *testing.T) {
+	Setup()
+	before := time.Now()
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`DELETE FROM "users" WHERE "deleted_on" < $1 RETURNING *`)).
+		WithArgs(before).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
+			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	p.mock.ExpectCommit()
+	count, err := p.repo.PurgeUsers(context.Background(), before)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 got %d", count)
+	}
+}
+
+func TestPostgreSql_WithTx_CommitError(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectCommit().WillReturnError(gorm.ErrInvalidTransaction)
+	err := p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		return nil
+	})
+	if err != gorm.ErrInvalidTransaction {
+		t.Errorf("expected %v got %v", gorm.ErrInvalidTransaction, err)
+	}
+}
+
+func TestPostgreSql_WithTx_NestedRollback(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT sp_2`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT sp_2`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectCommit()
+	err := p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		err := repo.WithTx(context.Background(), func(repo IRepository) error {
+			return ErrVersionConflict
+		})
+		if err != ErrVersionConflict {
+			t.Errorf("expected %v got %v", ErrVersionConflict, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_WithTx_Panic(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectRollback()
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("expected panic boom got %v", r)
+		}
+		if err := p.mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("expected nil, got:\n %s", err)
+		}
+	}()
+	p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		panic("boom")
+	})
+}
+
+//insertUsersQuery is the batch insert statement with the given VALUES placeholders
+func insertUsersQuery(values string) string {
+	return regexp.QuoteMeta(`WITH "input" AS (SELECT nextval(pg_get_serial_sequence('users', 'id')) AS "id", * ` +
+		`FROM (VALUES ` + values + `) AS "values" ("ord", "name", "email", "status", "metadata")), ` +
+		`"inserted" AS (INSERT INTO "users" ("id", "name", "email", "status", "metadata") ` +
+		`SELECT "id", "name", "email", "status", "metadata" FROM "input" ` +
+		`RETURNING "id", "created_on", "updated_on", "version") ` +
+		`SELECT "input"."ord", "inserted".* FROM "inserted" JOIN "input" USING ("id")`)
+}
+
+func TestPostgreSql_InsertUsers(t *testing.T) {
+	Setup()
+	now := time.Now()
+	users := []User{{PublicUser: PublicUser{Name: "Vasy"}}, {PublicUser: PublicUser{Name: "Pety"}}}
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(insertUsersQuery(`($1::int, $2, $3, $4, $5::jsonb), ($6::int, $7, $8, $9, $10::jsonb)`)).
+		WithArgs(0, "Vasy", "", StatusActive, "{}", 1, "Pety", "", StatusActive, "{}").
+		//rows come in any order, positions tell which user is which
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "created_on", "updated_on", "version"}).
+			AddRow(1, 8, now, now, 1).
+			AddRow(0, 7, now, now, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectCommit()
+	if err := p.repo.InsertUsers(context.Background(), users); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if users[0].Id != 7 || users[1].Id != 8 {
+		t.Errorf("expected ids 7 and 8 got %v", users)
+	}
+}
+
+func TestPostgreSql_ExportUsers(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectExec(`DECLARE (users_export_\d+) ` + regexp.QuoteMeta(`NO SCROLL CURSOR FOR SELECT * FROM "users" WHERE "deleted_on" IS NULL AND "name" ILIKE $1 ORDER BY "id"`)).
+		WithArgs(`%50\%%`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectQuery(`FETCH 500 FROM users_export_\d+`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
+			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
+	p.mock.ExpectExec(`CLOSE users_export_\d+`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectCommit()
+	var res []User
+	err := p.repo.ExportUsers(context.Background(), UserFilter{Name: "50%"}, func(user *User) error {
+		res = append(res, *user)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if !reflect.DeepEqual(res, testuser[:2]) {
+		t.Errorf("expected %v \ngot %v", testuser[:2], res)
+	}
+}
+
+func TestPostgreSql_ExportUsers_CursorPerCall(t *testing.T) {
+	Setup()
+	next := atomic.LoadUint64(&exportCursors) + 1
+	p.mock.ExpectBegin()
+	//exports in one transaction declare different cursors
+	for i := uint64(0); i < 2; i++ {
+		cursor := "users_export_" + strconv.FormatUint(next+i, 10)
+		p.mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT sp_2`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		p.mock.ExpectExec(regexp.QuoteMeta(`DECLARE ` + cursor + ` NO SCROLL CURSOR`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		p.mock.ExpectQuery(regexp.QuoteMeta(`FETCH 500 FROM ` + cursor)).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		p.mock.ExpectExec(regexp.QuoteMeta(`CLOSE ` + cursor)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		p.mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT sp_2`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	p.mock.ExpectCommit()
+	err := p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		for i := 0; i < 2; i++ {
+			err := repo.ExportUsers(context.Background(), UserFilter{}, func(user *User) error {
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_GetUsersByIds(t *testing.T) {
+	Setup()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id IN ($1,$2)) ORDER BY "id"`)).
+		WithArgs(1, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
+			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name).
+			AddRow(testuser[2].Id, testuser[2].CreateOn, testuser[2].Name))
+	res, err := p.repo.GetUsersByIds(context.Background(), []int{1, 3})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if !reflect.DeepEqual(res, []User{testuser[0], testuser[2]}) {
+		t.Errorf("expected %v \ngot %v", []User{testuser[0], testuser[2]}, res)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+func TestPostgreSql_FindUsers(t *testing.T) {
+	Setup()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id > $1) AND ("name" ILIKE $2) ORDER BY "id" LIMIT 2`)).
+		WithArgs(1, `%va\_s%`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name))
+	res, err := p.repo.FindUsers(context.Background(), UserFilter{Name: "va_s"}, 1, 2)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if !reflect.DeepEqual(res, []User{testuser[1]}) {
+		t.Errorf("expected %v \ngot %v", []User{testuser[1]}, res)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+func TestPostgreSql_FindUsers_Filter(t *testing.T) {
+	Setup()
+	since := time.Now()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (deleted_on IS NULL) AND (id > $1) `+
+		`AND (lower("email") = lower($2)) AND ("status" = $3) AND ("updated_on" >= $4) AND ("metadata" @> $5) `+
+		`ORDER BY "id" LIMIT 2`)).
+		WithArgs(0, "vasy@example.com", StatusSuspended, since, `{"team":"a"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name", "metadata"}).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name, []byte(`{"team":"a","age":3}`)))
+	filter := UserFilter{Email: " vasy@example.com", Status: StatusSuspended, UpdatedSince: since,
+		Metadata: Metadata{"team": "a"}}
+	res, err := p.repo.FindUsers(context.Background(), filter, 0, 2)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if len(res) != 1 || !reflect.DeepEqual(res[0].Metadata, Metadata{"team": "a", "age": 3.0}) {
+		t.Errorf("expected user with metadata got %v", res)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+func TestPostgreSql_EmailTaken(t *testing.T) {
+	Setup()
+	user := User{PublicUser: PublicUser{Name: "Vasy", Email: "Vasy@example.com"}}
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "users"`)).
+		WithArgs("Vasy", "Vasy@example.com", StatusActive, "{}").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_idx"})
+	p.mock.ExpectRollback()
+	if err := p.repo.InsertUser(context.Background(), &user); err != ErrEmailTaken {
+		t.Errorf("expected %v got %v", ErrEmailTaken, err)
+	}
+	//other unique violations are not about emails
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "users"`)).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_pkey"})
+	p.mock.ExpectRollback()
+	if err := p.repo.InsertUser(context.Background(), &user); err == ErrEmailTaken || err == nil {
+		t.Errorf("expected violation of users_pkey got %v", err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+}
+
+//diffMatcher matches JSON diff of audit which has the expected changes
+//and changes of ignored fields with any values
+type diffMatcher struct {
+	expected map[string]interface{}
+	ignored  []string
+}
+
+func diffOf(expected string, ignored ...string) *diffMatcher {
+	result := &diffMatcher{ignored: ignored}
+	json.Unmarshal([]byte(expected), &result.expected)
+	return result
+}
+
+func (p *diffMatcher) Match(v driver.Value) bool {
+	var data []byte
+	switch v := v.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return false
+	}
+	diff := map[string]interface{}{}
+	if err := json.Unmarshal(data, &diff); err != nil {
+		return false
+	}
+	for _, key := range p.ignored {
+		if _, ok := diff[key]; !ok {
+			return false
+		}
+		delete(diff, key)
+	}
+	return reflect.DeepEqual(diff, p.expected)
+}
+
+func TestPostgreSql_InsertUsers_PublishedAfterCommit(t *testing.T) {
+	Setup()
+	sub, _, _ := p.repo.Changes().Subscribe(-1, 10)
+	defer sub.Close()
+	now := time.Now()
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(insertUsersQuery(`($1::int, $2, $3, $4, $5::jsonb)`)).
+		WithArgs(0, "Vasy", "", StatusActive, "{}").
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "created_on", "updated_on", "version"}).AddRow(0, 7, now, now, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectCommit().WillReturnError(gorm.ErrInvalidTransaction)
+	users := []User{{PublicUser: PublicUser{Name: "Vasy"}}}
+	if err := p.repo.InsertUsers(context.Background(), users); err != gorm.ErrInvalidTransaction {
+		t.Errorf("expected %v got %v", gorm.ErrInvalidTransaction, err)
+	}
+	if len(sub.C()) != 0 {
+		t.Errorf("expected no changes after failed commit got %d", len(sub.C()))
+	}
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(insertUsersQuery(`($1::int, $2, $3, $4, $5::jsonb)`)).
+		WithArgs(0, "Vasy", "", StatusActive, "{}").
+		WillReturnRows(sqlmock.NewRows([]string{"ord", "id", "created_on", "updated_on", "version"}).AddRow(0, 8, now, now, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectCommit()
+	if err := p.repo.InsertUsers(context.Background(), users); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	select {
+	case change := <-sub.C():
+		if change.Id != 1 || change.Type != ChangeCreated || change.User.Id != 8 {
+			t.Errorf("expected created user 8 got %v", change)
+		}
+	default:
+		t.Errorf("expected change after commit")
+	}
+}
+
+func TestPostgreSql_WithTx_NestedRollbackDropsChanges(t *testing.T) {
+	Setup()
+	sub, _, _ := p.repo.Changes().Subscribe(-1, 10)
+	defer sub.Close()
+	now := time.Now()
+	p.mock.ExpectBegin()
+	p.mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT sp_2`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT sp_3`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "users" ("name", "email", "status", "metadata") VALUES ($1, $2, $3, $4) RETURNING "id", "created_on", "updated_on", "version"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "updated_on", "version"}).AddRow(7, now, now, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`RELEASE SAVEPOINT sp_3`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectExec(regexp.QuoteMeta(`ROLLBACK TO SAVEPOINT sp_2`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	p.mock.ExpectCommit()
+	err := p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		repo.WithTx(context.Background(), func(repo IRepository) error {
+			if err := repo.InsertUser(context.Background(), &User{PublicUser: PublicUser{Name: "Vasy"}}); err != nil {
+				return err
+			}
+			return ErrVersionConflict
+		})
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+	if len(sub.C()) != 0 {
+		t.Errorf("expected no changes after rollback got %d", len(sub.C()))
+	}
+}
+
+func TestPostgreSql_CreateWebhook(t *testing.T) {
+	Setup()
+	now := time.Now()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "webhooks" ("url", "secret", "events", "active")`)).
+		WithArgs("http://example.com", "shh", "{\"created\",\"deleted\"}", true).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on"}).AddRow(3, now))
+	hook := &Webhook{Url: "http://example.com", Secret: "shh", Events: []string{"created", "deleted"}, Active: true}
+	if err := p.repo.CreateWebhook(context.Background(), hook); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if hook.Id != 3 || !hook.CreateOn.Equal(now) {
+		t.Errorf("expected id 3 got %v", hook)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_InsertDelivery_Conflict(t *testing.T) {
+	Setup()
+	now := time.Now()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "webhook_deliveries"
+		("webhook_id", "event_id", "event", "payload", "status", "next_attempt_on")
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT ("webhook_id", "event_id") DO NOTHING
+		RETURNING "id", "created_on"`)).
+		WithArgs(1, 42, "user.created", `{}`, DeliveryPending, now).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on"}))
+	delivery := &WebhookDelivery{WebhookId: 1, EventId: 42, Event: "user.created",
+		Payload: []byte(`{}`), Status: DeliveryPending, NextAttemptOn: now}
+	if err := p.repo.InsertDelivery(context.Background(), delivery); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if delivery.Id != 0 {
+		t.Errorf("expected no new delivery got %d", delivery.Id)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+}
+
+func TestPostgreSql_ClaimDeliveries(t *testing.T) {
+	Setup()
+	now := time.Now()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`UPDATE "webhook_deliveries" SET "next_attempt_on" = $1
+		WHERE "id" IN (SELECT "id" FROM "webhook_deliveries"
+			WHERE "status" = $2 AND "next_attempt_on" <= $3
+			ORDER BY "next_attempt_on" LIMIT $4 FOR UPDATE SKIP LOCKED)
+		RETURNING *`)).
+		WithArgs(now.Add(time.Minute), DeliveryPending, now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "status", "payload"}).
+			AddRow(5, 1, DeliveryPending, []byte(`{}`)).
+			AddRow(4, 1, DeliveryPending, []byte(`{}`)))
+	res, err := p.repo.ClaimDeliveries(context.Background(), now, time.Minute, 10)
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if len(res) != 2 || res[0].Id != 4 || res[1].Id != 5 || string(res[0].Payload) != `{}` {
+		t.Errorf("expected deliveries 4 and 5 got %v", res)
+	}
+}
+
+func TestPostgreSql_DeleteWebhook_NotFound(t *testing.T) {
+	Setup()
+	p.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "webhooks" WHERE "id" = $1`)).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := p.repo.DeleteWebhook(context.Background(), 7); err != gorm.ErrRecordNotFound {
+		t.Errorf("expected %v got %v", gorm.ErrRecordNotFound, err)
+	}
+}
+
+func TestPostgreSql_Outbox(t *testing.T) {
+	Setup()
+	now := time.Now()
+	p.mock.ExpectBegin()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT pg_try_advisory_xact_lock($1)`)).
+		WithArgs(outboxLockKey).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "outbox" ORDER BY "id" LIMIT 10`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "type", "payload", "created_on"}).
+			AddRow(3, 1, ChangeCreated, []byte(`{"id":1}`), now).
+			AddRow(4, 1, ChangeUpdated, []byte(`{"id":1}`), now))
+	p.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "outbox" WHERE "id" IN ($1,$2)`)).
+		WithArgs(3, 4).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "outbox" WHERE ("user_id" NOT IN ($1,$2)) ORDER BY "id" LIMIT 10`)).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "type", "payload", "created_on"}).
+			AddRow(5, 3, ChangeDeleted, []byte(`{"id":3}`), now))
+	p.mock.ExpectCommit()
+	err := p.repo.WithTx(context.Background(), func(repo IRepository) error {
+		locked, err := repo.LockOutbox(context.Background())
+		if err != nil || !locked {
+			t.Errorf("expected lock got %v, %v", locked, err)
+		}
+		events, err := repo.OutboxEvents(context.Background(), 10, nil)
+		if err != nil || len(events) != 2 || events[1].Type != ChangeUpdated {
+			t.Errorf("expected 2 events got %v, %v", events, err)
+		}
+		if err := repo.DeleteOutboxEvents(context.Background(), []int64{3, 4}); err != nil {
+			return err
+		}
+		events, err = repo.OutboxEvents(context.Background(), 10, []int{1, 2})
+		if err != nil || len(events) != 1 || events[0].UserId != 3 {
+			t.Errorf("expected event of user 3 got %v, %v", events, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nil, got:\n %s", err)
+	}
+	if _, err := p.repo.LockOutbox(context.Background()); err != errNoTransaction {
+		t.Errorf("expected %v got %v", errNoTransaction, err)
+	}
+}
+
+func TestPostgreSql_WriteAudit_OutsideWithTx(t *testing.T) {
+	Setup()
+	p.mock.ExpectBegin()
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_audits"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	p.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	//the transaction has no changes of WithTx, the change would be lost
+	tx := p.repo.(*PostgreSql).pool.Begin()
+	usr := &User{PrivateUser: PrivateUser{Id: 1, Version: 1}, PublicUser: PublicUser{Name: "Vasy"}}
+	if err := writeAudit(context.Background(), tx, AuditInsert, nil, usr); err != errNoTransaction {
+		t.Errorf("expected %v got %v", errNoTransaction, err)
+	}
+}
+
+func TestPostgreMock_PurgeUsers_AuditFails(t *testing.T) {
+	repo, _ := NewPostgresDBMock()
+	db := repo.(*PostgreMock)
+	deleted := time.Unix(20, 0)
+	db.pool[0].DeletedOn = &deleted
+	db.pool[1].DeletedOn = &deleted
+	//metadata which can't be written to the audit
+	db.pool[1].Metadata = Metadata{"bad": make(chan int)}
+	purged, err := db.PurgeUsers(context.Background(), time.Unix(30, 0))
+	if err == nil || purged != 0 {
+		t.Errorf("expected error got %d %v", purged, err)
+	}
+	if n := len(db.pool); n != 5 {
+		t.Errorf("expected 5 users got %d", n)
+	}
+	if n := len(db.audits); n != 0 {
+		t.Errorf("expected no audits got %d", n)
+	}
+	db.pool[1].Metadata = nil
+	if purged, err := db.PurgeUsers(context.Background(), time.Unix(30, 0)); err != nil || purged != 2 {
+		t.Errorf("expected 2 purged users got %d %v", purged, err)
+	}
+}
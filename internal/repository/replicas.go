@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+)
+
+//replica - read-only copy of the database, reads skip it while it is unhealthy
+type replica struct {
+	name    string
+	db      *gorm.DB
+	healthy int32
+}
+
+//replicaSet hands out healthy replicas in turn and checks them in background
+type replicaSet struct {
+	replicas []*replica
+	next     uint32
+	logFunc  FuncLogging
+	//stop ends watch, it is closed by close
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplicaSet(replicas []*replica, fn FuncLogging) *replicaSet {
+	return &replicaSet{replicas: replicas, logFunc: fn, stop: make(chan struct{})}
+}
+
+func openReplicas(configs []DbConfig, fn FuncLogging) (*replicaSet, error) {
+	result := newReplicaSet(nil, fn)
+	for i := range configs {
+		conn, err := sql.Open("postgres", configs[i].source())
+		if err != nil {
+			result.close()
+			return nil, err
+		}
+		//replica which is down at start is used after the first successful check
+		db, err := gorm.Open("postgres", conn)
+		r := &replica{name: fmt.Sprintf("%s:%d", configs[i].Host, configs[i].Port), db: db}
+		if err == nil {
+			r.healthy = 1
+		} else {
+			result.log("replica %s is down: %v", r.name, err)
+		}
+		result.replicas = append(result.replicas, r)
+	}
+	return result, nil
+}
+
+//pick returns the next healthy replica, nil if there is none
+func (p *replicaSet) pick() *replica {
+	if p == nil {
+		return nil
+	}
+	count := uint32(len(p.replicas))
+	for i := uint32(0); i < count; i++ {
+		r := p.replicas[(atomic.AddUint32(&p.next, 1)-1)%count]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r
+		}
+	}
+	return nil
+}
+
+//fail takes replica out of rotation until the check finds it alive
+func (p *replicaSet) fail(r *replica, err error) {
+	if atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+		p.log("replica %s is down: %v", r.name, err)
+	}
+}
+
+//check pings all replicas and updates their health
+func (p *replicaSet) check() {
+	for _, r := range p.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err := r.db.DB().PingContext(ctx)
+		cancel()
+		if err != nil {
+			p.fail(r, err)
+		} else if atomic.CompareAndSwapInt32(&r.healthy, 0, 1) {
+			p.log("replica %s is up", r.name)
+		}
+	}
+}
+
+//watch checks replicas until the set is closed
+func (p *replicaSet) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+//close stops watch and closes connections to replicas
+func (p *replicaSet) close() {
+	if p == nil {
+		return
+	}
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		for _, r := range p.replicas {
+			r.db.Close()
+		}
+	})
+}
+
+func (p *replicaSet) log(format string, args ...interface{}) {
+	if p.logFunc != nil {
+		p.logFunc(fmt.Sprintf(format, args...))
+	}
+}
+
+//writeMarker remembers that a user was changed with the context
+type writeMarker struct {
+	written int32
+}
+
+//WithReadYourWrites makes reads with the context go to the primary once a user
+//is changed with it, replicas may not have the change yet. It is meant
+//to be set for every request
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey, &writeMarker{})
+}
+
+func markWritten(ctx context.Context) {
+	if marker, ok := ctx.Value(readYourWritesKey).(*writeMarker); ok {
+		atomic.StoreInt32(&marker.written, 1)
+	}
+}
+
+//WithPrimary makes reads with the context go to the primary. Caches fill
+//with it: a user read from a lagging replica would stay stale for the whole TTL
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey, true)
+}
+
+func readsPrimary(ctx context.Context) bool {
+	if primary, _ := ctx.Value(primaryKey).(bool); primary {
+		return true
+	}
+	marker, ok := ctx.Value(readYourWritesKey).(*writeMarker)
+	return ok && atomic.LoadInt32(&marker.written) == 1
+}
+
+//read runs fn on a replica. The primary is used inside of transaction,
+//if there is no healthy replica, if the context reads its writes or is
+//WithPrimary and to retry fn failed on the replica
+func (p *PostgreSql) read(ctx context.Context, fn func(db *gorm.DB) error) error {
+	if p.tx != nil || readsPrimary(ctx) {
+		return fn(p.conn())
+	}
+	r := p.replicas.pick()
+	if r == nil {
+		return fn(p.pool)
+	}
+	err := fn(r.db)
+	if err == nil || gorm.IsRecordNotFoundError(err) || ctx.Err() != nil {
+		return err
+	}
+	p.replicas.fail(r, err)
+	return fn(p.pool)
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const fetchQuery = `SELECT * FROM "users" WHERE (deleted_on IS NULL) LIMIT 1 OFFSET 0`
+
+func setupReplica() (*PostgreSql, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	primaryDb, primary, _ := sqlmock.New()
+	replicaDb, replicaMock, _ := sqlmock.New()
+	primaryConn, _ := gorm.Open("postgres", primaryDb)
+	replicaConn, _ := gorm.Open("postgres", replicaDb)
+	primaryConn.LogMode(false)
+	replicaConn.LogMode(false)
+	repo := &PostgreSql{pool: primaryConn, bus: NewChangeBus(0), replicas: newReplicaSet(
+		[]*replica{{name: "replica", db: replicaConn, healthy: 1}}, nil)}
+	return repo, primary, replicaMock
+}
+
+func userRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "created_on", "name"}).
+		AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name)
+}
+
+func TestPostgreSql_Replicas(t *testing.T) {
+	type TestCase struct {
+		name    string
+		ctx     func() context.Context
+		expect  func(primary, replica sqlmock.Sqlmock)
+		healthy bool
+	}
+	tests := []TestCase{
+		{
+			name: "replica",
+			ctx:  context.Background,
+			expect: func(primary, replica sqlmock.Sqlmock) {
+				replica.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnRows(userRows())
+			},
+			healthy: true,
+		},
+		{
+			name: "read your writes",
+			ctx: func() context.Context {
+				ctx := WithReadYourWrites(context.Background())
+				markWritten(ctx)
+				return ctx
+			},
+			expect: func(primary, replica sqlmock.Sqlmock) {
+				primary.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnRows(userRows())
+			},
+			healthy: true,
+		},
+		{
+			name: "not written yet",
+			ctx: func() context.Context {
+				return WithReadYourWrites(context.Background())
+			},
+			expect: func(primary, replica sqlmock.Sqlmock) {
+				replica.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnRows(userRows())
+			},
+			healthy: true,
+		},
+		{
+			name: "primary",
+			ctx: func() context.Context {
+				return WithPrimary(context.Background())
+			},
+			expect: func(primary, replica sqlmock.Sqlmock) {
+				primary.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnRows(userRows())
+			},
+			healthy: true,
+		},
+		{
+			name: "failover",
+			ctx:  context.Background,
+			expect: func(primary, replica sqlmock.Sqlmock) {
+				replica.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnError(errors.New("connection refused"))
+				primary.ExpectQuery(regexp.QuoteMeta(fetchQuery)).WillReturnRows(userRows())
+			},
+			healthy: false,
+		},
+	}
+	for _, test := range tests {
+		repo, primary, replica := setupReplica()
+		test.expect(primary, replica)
+		res, err := repo.Fetch(test.ctx(), 0, 1)
+		if err != nil || len(res) != 1 || res[0].Id != testuser[0].Id {
+			t.Errorf("%s: expected user got %v %v", test.name, res, err)
+		}
+		if err := primary.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: primary %v", test.name, err)
+		}
+		if err := replica.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: replica %v", test.name, err)
+		}
+		if healthy := repo.replicas.pick() != nil; healthy != test.healthy {
+			t.Errorf("%s: expected healthy %v got %v", test.name, test.healthy, healthy)
+		}
+	}
+}
+
+func TestPostgreSql_Replicas_NotFound(t *testing.T) {
+	repo, primary, replica := setupReplica()
+	replica.ExpectQuery(`SELECT \* FROM "users"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name"}))
+	_, err := repo.GetUserById(context.Background(), 10)
+	if !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("expected %v got %v", gorm.ErrRecordNotFound, err)
+	}
+	if err := primary.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if repo.replicas.pick() == nil {
+		t.Error("expected replica to stay healthy")
+	}
+}
+
+func TestReplicaSet_Check(t *testing.T) {
+	repo, _, _ := setupReplica()
+	r := repo.replicas.replicas[0]
+	repo.replicas.fail(r, errors.New("down"))
+	if repo.replicas.pick() != nil {
+		t.Fatal("expected no healthy replica")
+	}
+	repo.replicas.check()
+	if repo.replicas.pick() != r {
+		t.Error("expected replica to be back after check")
+	}
+}
+
+func TestReplicaSet_Close(t *testing.T) {
+	repo, primary, _ := setupReplica()
+	primary.ExpectClose()
+	done := make(chan struct{})
+	go func() {
+		repo.replicas.watch(time.Millisecond)
+		close(done)
+	}()
+	if err := repo.Close(); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected watch to stop on Close")
+	}
+	//closing twice does nothing
+	repo.replicas.close()
+}
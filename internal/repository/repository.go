@@ -2,26 +2,211 @@ package repository
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
+var (
+	ErrDuplicateKey    = errors.New("duplicate key")
+	ErrVersionConflict = errors.New("version conflict")
+	//ErrEmailTaken - another user, maybe soft-deleted, has the email
+	ErrEmailTaken = errors.New("email is taken")
+	//ErrUnavailable - the database is down, the call was not made
+	ErrUnavailable   = errors.New("database is unavailable")
+	errNoTransaction = errors.New("transaction is required")
+)
+
 type User struct {
 	PrivateUser
 	PublicUser
 }
 
 type PrivateUser struct {
-	Id       int       `gorm:"column:id" json:"id, int" `
-	CreateOn time.Time `gorm:"column:created_on" json:"create_on"`
+	Id       int       `gorm:"column:id" json:"id"`
+	CreateOn time.Time `gorm:"column:created_on" json:"created_on"`
+	//UpdatedOn - time of the last change, it equals CreateOn for new users
+	UpdatedOn time.Time `gorm:"column:updated_on" json:"updated_on"`
+	Version   int       `gorm:"column:version" json:"version"`
+	//DeletedOn is set for soft-deleted users
+	DeletedOn *time.Time `gorm:"column:deleted_on" json:"deleted_on,omitempty"`
 }
 
+//statuses of users
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+)
+
+//PublicUser - fields set by clients, updates replace all of them
 type PublicUser struct {
 	Name string `gorm:"column:name" json:"name"`
+	//Email is optional, it is unique ignoring case
+	Email  string `gorm:"column:email" json:"email,omitempty"`
+	Status string `gorm:"column:status" json:"status"`
+	//Metadata - free-form attributes of the user
+	Metadata Metadata `gorm:"column:metadata" json:"metadata,omitempty"`
+}
+
+//ValidStatus reports whether status is known, empty status means active
+func ValidStatus(status string) bool {
+	return status == "" || status == StatusActive || status == StatusSuspended
+}
+
+//normalize fills defaults of fields which are not set
+func (p *PublicUser) normalize() {
+	p.Email = strings.TrimSpace(p.Email)
+	if p.Status == "" {
+		p.Status = StatusActive
+	}
+	if p.Metadata == nil {
+		p.Metadata = Metadata{}
+	}
+}
+
+//Metadata is stored as JSONB object
+type Metadata map[string]interface{}
+
+func (p Metadata) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+func (p *Metadata) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*p = Metadata{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("can't scan %T into metadata", src)
+	}
+	result := Metadata{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*p = result
+	return nil
+}
+
+//IdempotencyKey - stored response of a request sent with Idempotency-Key header,
+//StatusCode is 0 while the request is still in progress
+type IdempotencyKey struct {
+	Key         string    `gorm:"column:key;primary_key"`
+	Fingerprint string    `gorm:"column:fingerprint"`
+	StatusCode  int       `gorm:"column:status_code"`
+	Header      []byte    `gorm:"column:header"`
+	Body        []byte    `gorm:"column:body"`
+	CreateOn    time.Time `gorm:"column:created_on"`
+	ExpireOn    time.Time `gorm:"column:expire_on"`
+}
+
+//UserFilter - optional conditions of users export and search, empty fields are ignored
+type UserFilter struct {
+	//Name matches users whose name contains it, case-insensitive
+	Name string
+	//Email matches users with the email, case-insensitive
+	Email  string
+	Status string
+	//UpdatedSince matches users changed at the time or later
+	UpdatedSince time.Time
+	//Metadata matches users whose metadata contains all of its keys with the same values
+	Metadata Metadata
+}
+
+type ctxKey int
+
+const (
+	includeDeletedKey ctxKey = iota
+	actorKey
+	requestIDKey
+	readYourWritesKey
+	primaryKey
+)
+
+//WithDeleted makes GetUserById and Fetch return soft-deleted users too
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedKey, true)
+}
+
+//IncludesDeleted reports whether WithDeleted is set on the context
+func IncludesDeleted(ctx context.Context) bool {
+	return withDeleted(ctx)
+}
+
+func withDeleted(ctx context.Context) bool {
+	v, _ := ctx.Value(includeDeletedKey).(bool)
+	return v
 }
 
 type IRepository interface {
+	//WithTx runs fn atomically, fn must use the given repository
+	WithTx(ctx context.Context, fn func(repo IRepository) error) error
 	InsertUser(ctx context.Context, user *User) error
+	//InsertUsers inserts all users or none of them
+	InsertUsers(ctx context.Context, users []User) error
 	GetUserById(ctx context.Context, id int) (*User, error)
+	//GetUsersByIds returns found users ordered by id, missing ids are skipped
+	GetUsersByIds(ctx context.Context, ids []int) ([]User, error)
 	Fetch(ctx context.Context, offset, limit int) ([]User, error)
+	//FindUsers returns up to limit users matching filter with id greater
+	//than afterId ordered by id, it is used for keyset pagination
+	FindUsers(ctx context.Context, filter UserFilter, afterId, limit int) ([]User, error)
+	//SearchUsers returns users whose name has words starting with all words
+	//of the query or is similar to the query, best matches first
+	SearchUsers(ctx context.Context, query string, offset, limit int) ([]SearchResult, error)
+	//ExportUsers calls fn for every user matching filter ordered by id,
+	//iteration stops on the first error
+	ExportUsers(ctx context.Context, filter UserFilter, fn func(user *User) error) error
+	//UpdateUser and DeleteUser check the version of the stored user,
+	//version 0 means any version, ErrVersionConflict is returned on mismatch
+	UpdateUser(ctx context.Context, user *User) error
+	DeleteUser(ctx context.Context, id, version int) error
+	RestoreUser(ctx context.Context, id int) (*User, error)
+	//PurgeUsers hard-deletes users soft-deleted before the given time
+	PurgeUsers(ctx context.Context, before time.Time) (int64, error)
+	//History returns audit trail of the user, oldest first
+	History(ctx context.Context, userId, offset, limit int) ([]UserAudit, error)
+	//Changes returns bus which receives changes of users after they are committed
+	Changes() *ChangeBus
 	Ping(ctx context.Context) error
+	//CreateIdempotencyKey returns ErrDuplicateKey if the key exists and is not expired
+	CreateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error
+	GetIdempotencyKey(ctx context.Context, key string) (*IdempotencyKey, error)
+	UpdateIdempotencyKey(ctx context.Context, key *IdempotencyKey) error
+	DeleteIdempotencyKey(ctx context.Context, key string) error
+	CreateWebhook(ctx context.Context, hook *Webhook) error
+	GetWebhook(ctx context.Context, id int) (*Webhook, error)
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	UpdateWebhook(ctx context.Context, hook *Webhook) error
+	//DeleteWebhook deletes webhook with its deliveries
+	DeleteWebhook(ctx context.Context, id int) error
+	//InsertDelivery does nothing if the event is already stored for the webhook,
+	//Id of delivery is left zero then
+	InsertDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	GetDelivery(ctx context.Context, id int64) (*WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	//ClaimDeliveries returns up to limit pending deliveries due at now, oldest first,
+	//and postpones them by lease so that other dispatchers skip them meanwhile
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	//Deliveries returns delivery log of webhook, newest first,
+	//webhookId 0 means all webhooks and empty status means any
+	Deliveries(ctx context.Context, webhookId int, status string, offset, limit int) ([]WebhookDelivery, error)
+	//LockOutbox must be called in WithTx, it returns false if the outbox
+	//is locked by another transaction, the lock is held until the end of transaction
+	LockOutbox(ctx context.Context) (bool, error)
+	//OutboxEvents returns up to limit events of the outbox, oldest first,
+	//events of skipUsers are left out: the relay holds them back
+	OutboxEvents(ctx context.Context, limit int, skipUsers []int) ([]OutboxEvent, error)
+	DeleteOutboxEvents(ctx context.Context, ids []int64) error
 }
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"strings"
+	"unicode"
+)
+
+//similarityThreshold - users whose name is at least that similar to the query
+//are found even if no word matches, it is the default of pg_trgm
+const similarityThreshold = 0.3
+
+//SearchResult - user found by SearchUsers, higher Rank is a better match
+type SearchResult struct {
+	User
+	Rank float64 `gorm:"column:rank"`
+}
+
+//SearchWords splits text into lowercase words of letters and digits
+func SearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//prefixQuery builds tsquery which matches names having all the words
+//as prefixes of their words, words carry no operators of tsquery
+func prefixQuery(words []string) string {
+	result := make([]string, len(words))
+	for i, word := range words {
+		result[i] = word + ":*"
+	}
+	return strings.Join(result, " & ")
+}
+
+//trigrams of the text the way pg_trgm makes them: every word
+//is padded with two spaces in front and one at the end
+func trigrams(text string) map[string]bool {
+	result := map[string]bool{}
+	for _, word := range SearchWords(text) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			result[string(padded[i:i+3])] = true
+		}
+	}
+	return result
+}
+
+//similarity - share of common trigrams as similarity() of pg_trgm
+func similarity(a, b string) float64 {
+	left, right := trigrams(a), trigrams(b)
+	if len(left) == 0 || len(right) == 0 {
+		return 0
+	}
+	common := 0
+	for t := range left {
+		if right[t] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(left)+len(right)-common)
+}
+
+//matchesPrefixes reports whether every query word is a prefix of a word of the name
+func matchesPrefixes(name, query []string) bool {
+	for _, q := range query {
+		found := false
+		for _, word := range name {
+			if strings.HasPrefix(word, q) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"math"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestPostgreSql_SearchUsers(t *testing.T) {
+	Setup()
+	p.mock.ExpectQuery(regexp.QuoteMeta(`SELECT *, ts_rank(to_tsvector('simple', name), to_tsquery('simple', $1)) + similarity(name, $2) AS rank `+
+		`FROM "users" WHERE (deleted_on IS NULL) AND (to_tsvector('simple', name) @@ to_tsquery('simple', $3) OR name % $4) `+
+		`ORDER BY rank DESC, id LIMIT 2 OFFSET 1`)).
+		WithArgs("vas:* & v:*", "vas v", "vas:* & v:*", "vas v").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_on", "name", "rank"}).
+			AddRow(testuser[1].Id, testuser[1].CreateOn, testuser[1].Name, 0.5).
+			AddRow(testuser[0].Id, testuser[0].CreateOn, testuser[0].Name, 0.25))
+	res, err := p.repo.SearchUsers(context.Background(), "Vas, V!", 1, 2)
+	if err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	expected := []SearchResult{{User: testuser[1], Rank: 0.5}, {User: testuser[0], Rank: 0.25}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v \ngot %v", expected, res)
+	}
+	//the query without words matches nothing
+	res, err = p.repo.SearchUsers(context.Background(), " &:* ", 0, 2)
+	if err != nil || len(res) != 0 {
+		t.Errorf("expected no users got %v %v", res, err)
+	}
+	if err := p.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgreMock_SearchUsers(t *testing.T) {
+	db, _ := NewPostgresDBMock()
+	type TestCase struct {
+		Query  string
+		Offset int
+		Limit  int
+		Ids    []int
+	}
+	tests := []TestCase{
+		//prefixes of words rank over similar names
+		{Query: "vasy", Limit: 10, Ids: []int{1, 2}},
+		{Query: "PETY", Limit: 10, Ids: []int{3, 4}},
+		{Query: "pety", Offset: 1, Limit: 10, Ids: []int{4}},
+		//misspelled name is found by trigrams
+		{Query: "Sanny", Limit: 10, Ids: []int{5}},
+		//no name has both words, but they are similar to names with one of them
+		{Query: "Vasy Pety", Limit: 10, Ids: []int{1, 3, 2, 4}},
+		{Query: "zzz", Limit: 10, Ids: []int{}},
+		{Query: "", Limit: 10, Ids: []int{}},
+	}
+	for _, test := range tests {
+		res, err := db.SearchUsers(context.Background(), test.Query, test.Offset, test.Limit)
+		if err != nil {
+			t.Fatalf("%q: expected nil got %v", test.Query, err)
+		}
+		ids := make([]int, len(res))
+		for i := range res {
+			ids[i] = res[i].Id
+		}
+		if !reflect.DeepEqual(ids, test.Ids) {
+			t.Errorf("%q: expected %v got %v", test.Query, test.Ids, ids)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	type TestCase struct {
+		A, B   string
+		Result float64
+	}
+	tests := []TestCase{
+		{A: "word", B: "word", Result: 1},
+		{A: "word", B: "WORD!", Result: 1},
+		{A: "word", B: "", Result: 0},
+		//"  w", " wo", "wor", "ord", "rd " and " wo", "wor" of "  w", " wo", "wor", "ore", "re "
+		{A: "word", B: "wore", Result: 3.0 / 7},
+	}
+	for _, test := range tests {
+		if res := similarity(test.A, test.B); math.Abs(res-test.Result) > 1e-9 {
+			t.Errorf("%q %q: expected %v got %v", test.A, test.B, test.Result, res)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+//limits of requests of HTTP, gRPC and GraphQL APIs
+const (
+	//RequestTimeout - time given to the database for one request
+	RequestTimeout = 2 * time.Second
+	//MaxPageSize - max count of users in one page
+	MaxPageSize = 25
+)
+
+//errors of validation, all APIs report them as bad input
+var (
+	ErrNameRequired = errors.New("name is required")
+	ErrBadEmail     = errors.New("bad email")
+	ErrBadStatus    = errors.New("status must be active or suspended")
+)
+
+//ValidateName returns trimmed name, every user must have one
+func ValidateName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrNameRequired
+	}
+	return name, nil
+}
+
+//ValidateEmail returns trimmed email, it is empty or a bare address:
+//"Vasy <vasy@example.com>" is not an email of the user
+func ValidateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrBadEmail
+	}
+	return email, nil
+}
+
+//ValidateStatus returns ErrBadStatus if status is not known
+func ValidateStatus(status string) error {
+	if !ValidStatus(status) {
+		return ErrBadStatus
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package repository
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Validate func(string) (string, error)
+		Result   string
+		Err      error
+	}{
+		{" Vasy ", ValidateName, "Vasy", nil},
+		{"  ", ValidateName, "", ErrNameRequired},
+		{" vasy@example.com ", ValidateEmail, "vasy@example.com", nil},
+		{"", ValidateEmail, "", nil},
+		{"Vasy <vasy@example.com>", ValidateEmail, "", ErrBadEmail},
+		{"vasy", ValidateEmail, "", ErrBadEmail},
+	}
+	for _, test := range tests {
+		if res, err := test.Validate(test.Value); res != test.Result || err != test.Err {
+			t.Errorf("%q: expected %q %v got %q %v", test.Value, test.Result, test.Err, res, err)
+		}
+	}
+	for status, expected := range map[string]error{"": nil, StatusSuspended: nil, "banned": ErrBadStatus} {
+		if err := ValidateStatus(status); err != expected {
+			t.Errorf("%q: expected %v got %v", status, expected, err)
+		}
+	}
+}
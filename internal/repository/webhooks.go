@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	//DeliveryDead - delivery which ran out of attempts, it stays in the dead-letter list
+	//until it is retried by hand
+	DeliveryDead = "dead"
+)
+
+//Webhook - subscription of a downstream system to changes of users,
+//Events holds change types: created, updated, deleted
+type Webhook struct {
+	Id       int            `gorm:"column:id"`
+	Url      string         `gorm:"column:url"`
+	Secret   string         `gorm:"column:secret"`
+	Events   pq.StringArray `gorm:"column:events;type:text[]"`
+	Active   bool           `gorm:"column:active"`
+	CreateOn time.Time      `gorm:"column:created_on"`
+}
+
+//Accepts reports whether webhook is subscribed to the change type
+func (p *Webhook) Accepts(changeType string) bool {
+	if !p.Active {
+		return false
+	}
+	for _, v := range p.Events {
+		if v == changeType {
+			return true
+		}
+	}
+	return false
+}
+
+//WebhookDelivery - one change sent to one webhook, it is kept as the delivery log,
+//ResponseCode and Error describe the last attempt
+type WebhookDelivery struct {
+	Id            int64           `gorm:"column:id"`
+	WebhookId     int             `gorm:"column:webhook_id"`
+	EventId       int64           `gorm:"column:event_id"`
+	Event         string          `gorm:"column:event"`
+	Payload       json.RawMessage `gorm:"column:payload"`
+	Status        string          `gorm:"column:status"`
+	Attempts      int             `gorm:"column:attempts"`
+	ResponseCode  int             `gorm:"column:response_code"`
+	Error         string          `gorm:"column:error"`
+	CreateOn      time.Time       `gorm:"column:created_on"`
+	NextAttemptOn time.Time       `gorm:"column:next_attempt_on"`
+	DeliveredOn   *time.Time      `gorm:"column:delivered_on"`
+}
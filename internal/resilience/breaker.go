@@ -0,0 +1,110 @@
+package resilience
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"sync"
+	"time"
+)
+
+const (
+	defaultThreshold = 5
+	defaultCooldown  = 10 * time.Second
+)
+
+//states of the breaker
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+//BreakerState - snapshot of the breaker
+type BreakerState struct {
+	State string `json:"state"`
+	//Failures - outages in a row
+	Failures int        `json:"failures"`
+	OpenedOn *time.Time `json:"opened_on,omitempty"`
+	//RetryAfter - time left until the next probe of the database, 0 if it is not open
+	RetryAfter time.Duration `json:"-"`
+}
+
+//Breaker opens after Threshold outages in a row and fast-fails calls
+//for Cooldown, then lets one call probe the database: it closes
+//the breaker on success and opens it again on outage
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedOn time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func NewBreaker() *Breaker {
+	return &Breaker{Threshold: defaultThreshold, Cooldown: defaultCooldown, now: time.Now}
+}
+
+//Allow returns repository.ErrUnavailable if the call must not be made,
+//otherwise the caller must report the result with Done
+func (p *Breaker) Allow() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.state() {
+	case StateOpen:
+		return repository.ErrUnavailable
+	case StateHalfOpen:
+		if p.probing {
+			return repository.ErrUnavailable
+		}
+		p.probing = true
+	}
+	return nil
+}
+
+//Done records result of the call allowed by Allow,
+//calls stopped by their context tell nothing about the database
+func (p *Breaker) Done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probing = false
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	if !isOutage(err) {
+		p.failures = 0
+		p.openedOn = time.Time{}
+		return
+	}
+	p.failures++
+	if p.failures >= p.Threshold || !p.openedOn.IsZero() {
+		p.openedOn = p.now()
+	}
+}
+
+//State returns current state of the breaker
+func (p *Breaker) State() BreakerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := BreakerState{State: p.state(), Failures: p.failures}
+	if !p.openedOn.IsZero() {
+		openedOn := p.openedOn
+		result.OpenedOn = &openedOn
+	}
+	if result.State == StateOpen {
+		result.RetryAfter = p.openedOn.Add(p.Cooldown).Sub(p.now())
+	}
+	return result
+}
+
+func (p *Breaker) state() string {
+	switch {
+	case p.openedOn.IsZero():
+		return StateClosed
+	case p.now().Sub(p.openedOn) < p.Cooldown:
+		return StateOpen
+	}
+	return StateHalfOpen
+}
@@ -0,0 +1,102 @@
+//Package resilience retries transient failures of the database
+//and stops calling it while it is down
+package resilience
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+//kind of failure of a database call
+type kind int
+
+const (
+	//permanent - the call failed for a reason retries do not fix, e.g. not found
+	permanent kind = iota
+	//aborted - the call was rolled back by the database, it is safe to repeat any call
+	aborted
+	//refused - the call did not reach the database, it is safe to repeat any call
+	refused
+	//broken - the connection broke during the call, it may be already applied,
+	//so only reads are repeated
+	broken
+)
+
+//classify tells how err of a database call may be handled
+func classify(err error) kind {
+	switch err {
+	case nil, context.Canceled, context.DeadlineExceeded:
+		return permanent
+	case driver.ErrBadConn:
+		//database/sql returns it if the call was not sent
+		return refused
+	case io.EOF, io.ErrUnexpectedEOF:
+		return broken
+	}
+	switch e := err.(type) {
+	case *pq.Error:
+		return classifyCode(e.Code)
+	case pq.Error:
+		return classifyCode(e.Code)
+	case *net.OpError:
+		if e.Op == "dial" {
+			return refused
+		}
+		return classifyErrno(e.Err)
+	case net.Error:
+		return broken
+	}
+	return classifyErrno(err)
+}
+
+func classifyCode(code pq.ErrorCode) kind {
+	switch code {
+	case "40001", "40P01": //serialization_failure, deadlock_detected
+		return aborted
+	case "57P03", "53300": //cannot_connect_now, too_many_connections
+		return refused
+	case "57P01", "57P02": //admin_shutdown, crash_shutdown
+		return broken
+	}
+	if code.Class() == "08" { //connection_exception
+		return broken
+	}
+	return permanent
+}
+
+func classifyErrno(err error) kind {
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	switch err {
+	case syscall.ECONNREFUSED:
+		return refused
+	case syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE:
+		return broken
+	}
+	return permanent
+}
+
+//retryable reports whether the call failed with err may be repeated,
+//writes are repeated only if they were surely not applied
+func retryable(err error, write bool) bool {
+	switch classify(err) {
+	case aborted, refused:
+		return true
+	case broken:
+		return !write
+	}
+	return false
+}
+
+//isOutage reports whether err means that the database is down,
+//aborted transactions are a sign of contention, not of an outage
+func isOutage(err error) bool {
+	k := classify(err)
+	return k == refused || k == broken
+}
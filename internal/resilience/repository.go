@@ -0,0 +1,259 @@
+package resilience
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"time"
+)
+
+//Repository retries transient failures of the wrapped repository
+//and fast-fails with repository.ErrUnavailable while the breaker is open.
+//Retries stop when the next one would not fit into the context.
+//Transactions are repeated as a whole, so fn of WithTx may be called
+//several times, the repository passed to fn is not wrapped
+type Repository struct {
+	repository.IRepository
+	Retry   Policy
+	Breaker *Breaker
+}
+
+func NewRepository(repo repository.IRepository) *Repository {
+	return &Repository{IRepository: repo, Retry: DefaultPolicy(), Breaker: NewBreaker()}
+}
+
+func reads(err error) bool {
+	return retryable(err, false)
+}
+
+func writes(err error) bool {
+	return retryable(err, true)
+}
+
+//call runs fn until it succeeds or fails with an error which retry rejects
+func (p *Repository) call(ctx context.Context, retry func(err error) bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := p.Breaker.Allow(); err != nil {
+			return err
+		}
+		err := fn()
+		if ctx.Err() != nil {
+			p.Breaker.Done(ctx.Err())
+			return err
+		}
+		p.Breaker.Done(err)
+		if !retry(err) || attempt >= p.Retry.Attempts ||
+			!sleep(ctx, p.Retry.backoff(attempt-1)) {
+			return err
+		}
+	}
+}
+
+func (p *Repository) WithTx(ctx context.Context, fn func(repo repository.IRepository) error) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.WithTx(ctx, fn)
+	})
+}
+
+func (p *Repository) InsertUser(ctx context.Context, user *repository.User) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.InsertUser(ctx, user)
+	})
+}
+
+func (p *Repository) InsertUsers(ctx context.Context, users []repository.User) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.InsertUsers(ctx, users)
+	})
+}
+
+func (p *Repository) GetUserById(ctx context.Context, id int) (result *repository.User, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.GetUserById(ctx, id)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) GetUsersByIds(ctx context.Context, ids []int) (result []repository.User, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.GetUsersByIds(ctx, ids)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) Fetch(ctx context.Context, offset, limit int) (result []repository.User, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.Fetch(ctx, offset, limit)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) FindUsers(ctx context.Context, filter repository.UserFilter, afterId, limit int) (result []repository.User, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.FindUsers(ctx, filter, afterId, limit)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) SearchUsers(ctx context.Context, query string, offset, limit int) (result []repository.SearchResult, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.SearchUsers(ctx, query, offset, limit)
+		return err
+	})
+	return result, err
+}
+
+//ExportUsers is retried only until the first user is passed to fn
+func (p *Repository) ExportUsers(ctx context.Context, filter repository.UserFilter, fn func(user *repository.User) error) error {
+	started := false
+	retry := func(err error) bool {
+		return !started && reads(err)
+	}
+	return p.call(ctx, retry, func() error {
+		return p.IRepository.ExportUsers(ctx, filter, func(user *repository.User) error {
+			started = true
+			return fn(user)
+		})
+	})
+}
+
+func (p *Repository) UpdateUser(ctx context.Context, user *repository.User) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.UpdateUser(ctx, user)
+	})
+}
+
+func (p *Repository) DeleteUser(ctx context.Context, id, version int) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.DeleteUser(ctx, id, version)
+	})
+}
+
+func (p *Repository) RestoreUser(ctx context.Context, id int) (result *repository.User, err error) {
+	err = p.call(ctx, writes, func() error {
+		result, err = p.IRepository.RestoreUser(ctx, id)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) PurgeUsers(ctx context.Context, before time.Time) (result int64, err error) {
+	err = p.call(ctx, writes, func() error {
+		result, err = p.IRepository.PurgeUsers(ctx, before)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) History(ctx context.Context, userId, offset, limit int) (result []repository.UserAudit, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.History(ctx, userId, offset, limit)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) Ping(ctx context.Context) error {
+	return p.call(ctx, reads, func() error {
+		return p.IRepository.Ping(ctx)
+	})
+}
+
+func (p *Repository) CreateIdempotencyKey(ctx context.Context, key *repository.IdempotencyKey) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.CreateIdempotencyKey(ctx, key)
+	})
+}
+
+func (p *Repository) GetIdempotencyKey(ctx context.Context, key string) (result *repository.IdempotencyKey, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.GetIdempotencyKey(ctx, key)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) UpdateIdempotencyKey(ctx context.Context, key *repository.IdempotencyKey) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.UpdateIdempotencyKey(ctx, key)
+	})
+}
+
+func (p *Repository) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.DeleteIdempotencyKey(ctx, key)
+	})
+}
+
+func (p *Repository) CreateWebhook(ctx context.Context, hook *repository.Webhook) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.CreateWebhook(ctx, hook)
+	})
+}
+
+func (p *Repository) GetWebhook(ctx context.Context, id int) (result *repository.Webhook, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.GetWebhook(ctx, id)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) ListWebhooks(ctx context.Context) (result []repository.Webhook, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.ListWebhooks(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) UpdateWebhook(ctx context.Context, hook *repository.Webhook) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.UpdateWebhook(ctx, hook)
+	})
+}
+
+func (p *Repository) DeleteWebhook(ctx context.Context, id int) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.DeleteWebhook(ctx, id)
+	})
+}
+
+func (p *Repository) InsertDelivery(ctx context.Context, delivery *repository.WebhookDelivery) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.InsertDelivery(ctx, delivery)
+	})
+}
+
+func (p *Repository) GetDelivery(ctx context.Context, id int64) (result *repository.WebhookDelivery, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.GetDelivery(ctx, id)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) UpdateDelivery(ctx context.Context, delivery *repository.WebhookDelivery) error {
+	return p.call(ctx, writes, func() error {
+		return p.IRepository.UpdateDelivery(ctx, delivery)
+	})
+}
+
+func (p *Repository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) (result []repository.WebhookDelivery, err error) {
+	err = p.call(ctx, writes, func() error {
+		result, err = p.IRepository.ClaimDeliveries(ctx, now, lease, limit)
+		return err
+	})
+	return result, err
+}
+
+func (p *Repository) Deliveries(ctx context.Context, webhookId int, status string, offset, limit int) (result []repository.WebhookDelivery, err error) {
+	err = p.call(ctx, reads, func() error {
+		result, err = p.IRepository.Deliveries(ctx, webhookId, status, offset, limit)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,253 @@
+package resilience
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//failingRepository fails calls with errs in turn, then passes them to the mock
+type failingRepository struct {
+	repository.IRepository
+	errs  []error
+	calls int
+}
+
+func (p *failingRepository) fail() error {
+	p.calls++
+	if len(p.errs) == 0 {
+		return nil
+	}
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	return err
+}
+
+func (p *failingRepository) Fetch(ctx context.Context, offset, limit int) ([]repository.User, error) {
+	if err := p.fail(); err != nil {
+		return nil, err
+	}
+	return p.IRepository.Fetch(ctx, offset, limit)
+}
+
+func (p *failingRepository) UpdateUser(ctx context.Context, user *repository.User) error {
+	if err := p.fail(); err != nil {
+		return err
+	}
+	return p.IRepository.UpdateUser(ctx, user)
+}
+
+func (p *failingRepository) Ping(ctx context.Context) error {
+	return p.fail()
+}
+
+func (p *failingRepository) ExportUsers(ctx context.Context, filter repository.UserFilter, fn func(user *repository.User) error) error {
+	calls := p.calls
+	err := p.fail()
+	if calls > 0 {
+		//the first call fails before users are passed, the next ones after the first user
+		if err := p.IRepository.ExportUsers(ctx, filter, func(user *repository.User) error {
+			if err := fn(user); err != nil {
+				return err
+			}
+			return io.ErrUnexpectedEOF
+		}); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func newTestRepository(errs ...error) (*Repository, *failingRepository) {
+	db, _ := repository.NewPostgresDBMock()
+	failing := &failingRepository{IRepository: db, errs: errs}
+	repo := NewRepository(failing)
+	repo.Retry = Policy{Attempts: 3, BaseWait: time.Millisecond, MaxWait: time.Millisecond}
+	return repo, failing
+}
+
+var (
+	errReset      = &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}
+	errRefused    = &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+	errSerializer = &pq.Error{Code: "40001"}
+)
+
+func TestClassify(t *testing.T) {
+	type TestCase struct {
+		Err   error
+		Read  bool
+		Write bool
+	}
+	tests := []TestCase{
+		{Err: nil},
+		{Err: gorm.ErrRecordNotFound},
+		{Err: repository.ErrVersionConflict},
+		{Err: &pq.Error{Code: "23505"}},
+		{Err: errSerializer, Read: true, Write: true},
+		{Err: &pq.Error{Code: "40P01"}, Read: true, Write: true},
+		{Err: &pq.Error{Code: "57P03"}, Read: true, Write: true},
+		{Err: &pq.Error{Code: "57P01"}, Read: true},
+		{Err: &pq.Error{Code: "08006"}, Read: true},
+		{Err: driver.ErrBadConn, Read: true, Write: true},
+		{Err: errRefused, Read: true, Write: true},
+		{Err: errReset, Read: true},
+		{Err: io.ErrUnexpectedEOF, Read: true},
+		{Err: context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		if res := retryable(test.Err, false); res != test.Read {
+			t.Errorf("%v: expected read retry %v got %v", test.Err, test.Read, res)
+		}
+		if res := retryable(test.Err, true); res != test.Write {
+			t.Errorf("%v: expected write retry %v got %v", test.Err, test.Write, res)
+		}
+	}
+}
+
+func TestRepository_Retry(t *testing.T) {
+	type TestCase struct {
+		Name  string
+		Errs  []error
+		Write bool
+		Err   error
+		Calls int
+	}
+	tests := []TestCase{
+		{Name: "read after reset", Errs: []error{errReset}, Calls: 2},
+		{Name: "read gives up", Errs: []error{errReset, errReset, errReset, errReset}, Err: errReset, Calls: 3},
+		{Name: "read not found", Errs: []error{gorm.ErrRecordNotFound}, Err: gorm.ErrRecordNotFound, Calls: 1},
+		{Name: "write after serialization failure", Errs: []error{errSerializer}, Write: true, Calls: 2},
+		{Name: "write after refused", Errs: []error{errRefused}, Write: true, Calls: 2},
+		{Name: "write is not repeated after reset", Errs: []error{errReset}, Write: true, Err: errReset, Calls: 1},
+	}
+	for _, test := range tests {
+		repo, failing := newTestRepository(test.Errs...)
+		var err error
+		if test.Write {
+			err = repo.UpdateUser(context.Background(), &repository.User{PrivateUser: repository.PrivateUser{Id: 1},
+				PublicUser: repository.PublicUser{Name: "Vasy"}})
+		} else {
+			_, err = repo.Fetch(context.Background(), 0, 2)
+		}
+		if err != test.Err {
+			t.Errorf("%s: expected %v got %v", test.Name, test.Err, err)
+		}
+		if failing.calls != test.Calls {
+			t.Errorf("%s: expected %d calls got %d", test.Name, test.Calls, failing.calls)
+		}
+	}
+}
+
+func TestRepository_RetryDeadline(t *testing.T) {
+	repo, failing := newTestRepository(errReset, errReset)
+	repo.Retry.BaseWait, repo.Retry.MaxWait = time.Second, time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := repo.Fetch(ctx, 0, 2); err != errReset {
+		t.Errorf("expected %v got %v", errReset, err)
+	}
+	if failing.calls != 1 || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("expected to give up at once, got %d calls in %v", failing.calls, time.Since(start))
+	}
+}
+
+func TestRepository_ExportUsers(t *testing.T) {
+	repo, failing := newTestRepository(errReset, errReset)
+	count := 0
+	err := repo.ExportUsers(context.Background(), repository.UserFilter{}, func(user *repository.User) error {
+		count++
+		return nil
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+	if failing.calls != 2 || count != 1 {
+		t.Errorf("expected retry before the first user only, got %d calls and %d users", failing.calls, count)
+	}
+}
+
+func TestRepository_Breaker(t *testing.T) {
+	repo, failing := newTestRepository(errReset, errReset, errReset, errReset, errReset, errReset)
+	repo.Retry.Attempts = 1
+	repo.Breaker.Threshold = 3
+	repo.Breaker.Cooldown = time.Minute
+	now := time.Now()
+	repo.Breaker.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := repo.Ping(ctx); err != errReset {
+			t.Fatalf("expected %v got %v", errReset, err)
+		}
+	}
+	if err := repo.Ping(ctx); err != repository.ErrUnavailable {
+		t.Errorf("expected %v got %v", repository.ErrUnavailable, err)
+	}
+	state := repo.Breaker.State()
+	if state.State != StateOpen || state.Failures != 3 || state.RetryAfter != time.Minute {
+		t.Errorf("expected open breaker got %+v", state)
+	}
+	if failing.calls != 3 {
+		t.Errorf("expected open breaker to skip calls, got %d calls", failing.calls)
+	}
+
+	//the probe fails and opens the breaker again
+	now = now.Add(time.Minute)
+	if state := repo.Breaker.State(); state.State != StateHalfOpen {
+		t.Errorf("expected half-open breaker got %+v", state)
+	}
+	if err := repo.Ping(ctx); err != errReset {
+		t.Errorf("expected %v got %v", errReset, err)
+	}
+	if state := repo.Breaker.State(); state.State != StateOpen {
+		t.Errorf("expected open breaker got %+v", state)
+	}
+
+	//the successful probe closes it
+	failing.errs = nil
+	now = now.Add(time.Minute)
+	if err := repo.Ping(ctx); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if state := repo.Breaker.State(); state.State != StateClosed || state.Failures != 0 || state.OpenedOn != nil {
+		t.Errorf("expected closed breaker got %+v", state)
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	breaker := NewBreaker()
+	breaker.Threshold = 1
+	now := time.Now()
+	breaker.now = func() time.Time {
+		return now
+	}
+	breaker.Allow()
+	breaker.Done(errRefused)
+	now = now.Add(breaker.Cooldown)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("expected probe to be allowed got %v", err)
+	}
+	if err := breaker.Allow(); err != repository.ErrUnavailable {
+		t.Errorf("expected one probe at a time got %v", err)
+	}
+	//canceled probe tells nothing and lets the next one in
+	breaker.Done(context.Canceled)
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("expected probe to be allowed got %v", err)
+	}
+	breaker.Done(errors.New("syntax error"))
+	if state := breaker.State(); state.State != StateClosed {
+		t.Errorf("expected closed breaker got %+v", state)
+	}
+}
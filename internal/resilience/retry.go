@@ -0,0 +1,56 @@
+package resilience
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultAttempts = 3
+	defaultBaseWait = 50 * time.Millisecond
+	defaultMaxWait  = time.Second
+)
+
+//Policy - how failed calls are retried
+type Policy struct {
+	//Attempts - max count of calls including the first one
+	Attempts int
+	//BaseWait - pause before the second call, it doubles with every call
+	BaseWait time.Duration
+	//MaxWait - the longest pause
+	MaxWait time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{Attempts: defaultAttempts, BaseWait: defaultBaseWait, MaxWait: defaultMaxWait}
+}
+
+//backoff - BaseWait*2^attempt limited by MaxWait, a random half of it is cut off
+//so that callers which failed together do not retry together
+func (p Policy) backoff(attempt int) time.Duration {
+	wait := p.BaseWait << uint(attempt)
+	if wait > p.MaxWait || wait <= 0 {
+		wait = p.MaxWait
+	}
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+//sleep waits before the next attempt, it returns false without waiting
+//if the context is done or would be done before the attempt
+func sleep(ctx context.Context, wait time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
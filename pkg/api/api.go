@@ -0,0 +1,149 @@
+//Package api describes public representation of the users API,
+//it does not depend on the storage model
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//User - user as returned by the API, timestamps are RFC 3339 in UTC
+type User struct {
+	Id        int        `json:"id" xml:"id" yaml:"id"`
+	Name      string     `json:"name" xml:"name" yaml:"name"`
+	Email     string     `json:"email,omitempty" xml:"email,omitempty" yaml:"email,omitempty"`
+	Status    string     `json:"status" xml:"status" yaml:"status"`
+	CreatedOn time.Time  `json:"created_on" xml:"created_on" yaml:"created_on"`
+	UpdatedOn time.Time  `json:"updated_on" xml:"updated_on" yaml:"updated_on"`
+	Version   int        `json:"version" xml:"version" yaml:"version"`
+	DeletedOn *time.Time `json:"deleted_on,omitempty" xml:"deleted_on,omitempty" yaml:"deleted_on,omitempty"`
+	//Metadata is not encoded as xml, encoding/xml can't marshal maps
+	Metadata map[string]interface{} `json:"metadata,omitempty" xml:"-" yaml:"metadata,omitempty"`
+}
+
+//UserInput - body of create and update requests,
+//empty status means active
+type UserInput struct {
+	Name   string `json:"name" xml:"name" yaml:"name"`
+	Email  string `json:"email,omitempty" xml:"email,omitempty" yaml:"email,omitempty"`
+	Status string `json:"status,omitempty" xml:"status,omitempty" yaml:"status,omitempty"`
+	//Metadata is not decoded from xml, PUT keeps the stored one then
+	Metadata map[string]interface{} `json:"metadata,omitempty" xml:"-" yaml:"metadata,omitempty"`
+}
+
+//UserAudit - record of user history
+type UserAudit struct {
+	Id        int             `json:"id" xml:"id"`
+	UserId    int             `json:"user_id" xml:"user_id"`
+	Action    string          `json:"action" xml:"action"`
+	Actor     string          `json:"actor" xml:"actor"`
+	RequestId string          `json:"request_id" xml:"request_id"`
+	Before    json.RawMessage `json:"before,omitempty" xml:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty" xml:"after,omitempty"`
+	Diff      json.RawMessage `json:"diff,omitempty" xml:"diff,omitempty"`
+	CreatedOn time.Time       `json:"created_on" xml:"created_on"`
+}
+
+//SearchResult - user found by /users/search, results with higher rank match better.
+//Highlight is the name escaped as HTML with matched parts wrapped in <mark>
+type SearchResult struct {
+	User      User    `json:"user" xml:"user"`
+	Rank      float64 `json:"rank" xml:"rank"`
+	Highlight string  `json:"highlight" xml:"highlight"`
+}
+
+//BatchResult - result of one item of POST /users:batch
+type BatchResult struct {
+	Index  int    `json:"index" xml:"index" yaml:"index"`
+	Status int    `json:"status" xml:"status" yaml:"status"`
+	User   *User  `json:"user,omitempty" xml:"user,omitempty" yaml:"user,omitempty"`
+	Error  string `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+}
+
+//Message types of WebSocket /users/subscribe
+const (
+	MessageSubscribe    = "subscribe"
+	MessageUnsubscribe  = "unsubscribe"
+	MessagePing         = "ping"
+	MessageSubscribed   = "subscribed"
+	MessageUnsubscribed = "unsubscribed"
+	MessagePong         = "pong"
+	MessageChange       = "change"
+	MessageError        = "error"
+)
+
+//SubscriptionRequest - message sent by client over WebSocket,
+//RequestId is optional and is echoed in the reply
+type SubscriptionRequest struct {
+	Type      string `json:"type"`
+	RequestId string `json:"request_id,omitempty"`
+	Ids       []int  `json:"ids,omitempty"`
+}
+
+//SubscriptionMessage - message sent by server over WebSocket: reply to a request
+//with all subscribed ids, change of a subscribed user or error
+type SubscriptionMessage struct {
+	Type      string `json:"type"`
+	RequestId string `json:"request_id,omitempty"`
+	Ids       []int  `json:"ids,omitempty"`
+	EventId   int64  `json:"event_id,omitempty"`
+	Change    string `json:"change,omitempty"`
+	User      *User  `json:"user,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//Webhook - subscription to changes of users, Secret is returned only on creation
+type Webhook struct {
+	Id        int       `json:"id" xml:"id"`
+	Url       string    `json:"url" xml:"url"`
+	Events    []string  `json:"events" xml:"events>event"`
+	Active    bool      `json:"active" xml:"active"`
+	Secret    string    `json:"secret,omitempty" xml:"secret,omitempty"`
+	CreatedOn time.Time `json:"created_on" xml:"created_on"`
+}
+
+//WebhookInput - body of create and update requests of webhooks,
+//events default to created and deleted, empty secret is generated on creation
+//and kept on update
+type WebhookInput struct {
+	Url    string   `json:"url" xml:"url"`
+	Events []string `json:"events,omitempty" xml:"events>event,omitempty"`
+	Secret string   `json:"secret,omitempty" xml:"secret,omitempty"`
+	Active *bool    `json:"active,omitempty" xml:"active,omitempty"`
+}
+
+//WebhookDelivery - record of the delivery log, response_code and error
+//describe the last attempt
+type WebhookDelivery struct {
+	Id            int64      `json:"id" xml:"id"`
+	WebhookId     int        `json:"webhook_id" xml:"webhook_id"`
+	EventId       int64      `json:"event_id" xml:"event_id"`
+	Event         string     `json:"event" xml:"event"`
+	Status        string     `json:"status" xml:"status"`
+	Attempts      int        `json:"attempts" xml:"attempts"`
+	ResponseCode  int        `json:"response_code,omitempty" xml:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty" xml:"error,omitempty"`
+	CreatedOn     time.Time  `json:"created_on" xml:"created_on"`
+	NextAttemptOn *time.Time `json:"next_attempt_on,omitempty" xml:"next_attempt_on,omitempty"`
+	DeliveredOn   *time.Time `json:"delivered_on,omitempty" xml:"delivered_on,omitempty"`
+}
+
+//WebhookEvent - body of a webhook delivery, Event is user.created, user.updated
+//or user.deleted. Id is unique per change, an event may be delivered more
+//than once and receivers use Id to skip duplicates
+type WebhookEvent struct {
+	Id        int64     `json:"id"`
+	Event     string    `json:"event"`
+	CreatedOn time.Time `json:"created_on"`
+	User      User      `json:"user"`
+}
+
+//Readiness - body of /readyz, breaker is closed, open or half-open,
+//failures count outages of the database in a row
+type Readiness struct {
+	Status   string     `json:"status"`
+	Database string     `json:"database"`
+	Breaker  string     `json:"breaker,omitempty"`
+	Failures int        `json:"failures"`
+	OpenedOn *time.Time `json:"opened_on,omitempty"`
+}
@@ -0,0 +1,609 @@
+package api
+
+//OpenAPI - OpenAPI 3 description of the HTTP API served at /openapi.json,
+//errors are returned as plain text with the status code
+const OpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "godocker users API",
+    "version": "1"
+  },
+  "paths": {
+    "/ping": {
+      "get": {
+        "summary": "Liveness check",
+        "responses": {
+          "200": {"description": "Server is alive"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness check, the server is not ready while the database is down or the circuit breaker is open",
+        "responses": {
+          "200": {"$ref": "#/components/responses/Readiness"},
+          "503": {"$ref": "#/components/responses/Readiness"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "OpenAPI document", "content": {"application/json": {}}}
+        }
+      }
+    },
+    "/debug/vars": {
+      "get": {
+        "summary": "Counters of the process in expvar format, user_cache holds hits and misses of the cache of users",
+        "security": [{"admin": []}],
+        "responses": {
+          "200": {"description": "Counters", "content": {"application/json": {}}},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/schemas/user.json": {
+      "get": {
+        "summary": "JSON Schema of User",
+        "responses": {
+          "200": {"description": "JSON Schema document", "content": {"application/schema+json": {}}}
+        }
+      }
+    },
+    "/users": {
+      "get": {
+        "summary": "List users",
+        "parameters": [
+          {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Offset"},
+          {"$ref": "#/components/parameters/Limit"},
+          {"$ref": "#/components/parameters/IncludeDeleted"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Page of users",
+            "headers": {
+              "ETag": {"description": "Changes with ids and versions of users of the page", "schema": {"type": "string"}}
+            },
+            "content": {
+              "application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/User"}}},
+              "application/xml": {},
+              "text/csv": {},
+              "application/msgpack": {},
+              "application/x-ndjson": {}
+            }
+          },
+          "304": {"description": "Not modified, the page matches If-None-Match"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "406": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/": {
+      "post": {
+        "summary": "Create user",
+        "parameters": [
+          {"name": "Idempotency-Key", "in": "header", "schema": {"type": "string"}}
+        ],
+        "requestBody": {"$ref": "#/components/requestBodies/UserInput"},
+        "responses": {
+          "201": {
+            "description": "Created user",
+            "headers": {
+              "Location": {"schema": {"type": "string"}},
+              "ETag": {"schema": {"type": "string"}}
+            },
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "406": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users:batch": {
+      "post": {
+        "summary": "Create many users",
+        "description": "Every item has its own result, items with bad input, a taken email or an email repeated in the batch fail with 400 or 409 and the others are created.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/UserInput"}}},
+            "application/x-ndjson": {"schema": {"$ref": "#/components/schemas/UserInput"}}
+          }
+        },
+        "responses": {
+          "201": {"$ref": "#/components/responses/BatchResult"},
+          "207": {"$ref": "#/components/responses/BatchResult"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/search": {
+      "get": {
+        "summary": "Search users by words of the name or by similar names, best matches first",
+        "parameters": [
+          {"name": "q", "in": "query", "required": true, "schema": {"type": "string", "minLength": 1}},
+          {"$ref": "#/components/parameters/Offset"},
+          {"$ref": "#/components/parameters/Limit"},
+          {"$ref": "#/components/parameters/IncludeDeleted"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Found users",
+            "content": {
+              "application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SearchResult"}}},
+              "application/xml": {},
+              "application/msgpack": {},
+              "application/x-ndjson": {}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "406": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/export": {
+      "get": {
+        "summary": "Stream all users",
+        "parameters": [
+          {"name": "name", "in": "query", "schema": {"type": "string"}},
+          {"name": "email", "in": "query", "description": "Case-insensitive", "schema": {"type": "string"}},
+          {"name": "status", "in": "query", "schema": {"type": "string", "enum": ["active", "suspended"]}},
+          {"name": "updated_since", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "metadata", "in": "query", "description": "JSON object the metadata must contain", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/IncludeDeleted"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Users one by one",
+            "content": {
+              "application/x-ndjson": {"schema": {"$ref": "#/components/schemas/User"}},
+              "text/csv": {}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "406": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/events": {
+      "get": {
+        "summary": "Stream changes of users as Server-Sent Events",
+        "description": "Events created, updated and deleted carry the user as data and a growing id. Event reset means some changes since Last-Event-ID are lost.",
+        "parameters": [
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "integer", "minimum": 0}},
+          {"name": "last_event_id", "in": "query", "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Event stream",
+            "content": {"text/event-stream": {"schema": {"type": "string"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/subscribe": {
+      "get": {
+        "summary": "Subscribe to changes of users over WebSocket",
+        "description": "Client sends {\"type\": \"subscribe\" | \"unsubscribe\" | \"ping\", \"request_id\": \"...\", \"ids\": [1, 2]}. Server replies with subscribed, unsubscribed, pong or error and pushes {\"type\": \"change\", \"event_id\": 1, \"change\": \"updated\", \"user\": {...}} for subscribed ids. Close code 1013 means the client did not keep up.",
+        "responses": {
+          "101": {"description": "Switching to WebSocket"},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Get user",
+        "parameters": [
+          {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}},
+          {"name": "If-Modified-Since", "in": "header", "description": "Ignored if If-None-Match is sent", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/IncludeDeleted"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/User"},
+          "304": {"description": "Not modified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "406": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Update user",
+        "description": "Replaces name, email, status and metadata. An application/xml body has no metadata, the stored metadata is kept then.",
+        "parameters": [{"$ref": "#/components/parameters/IfMatch"}],
+        "requestBody": {"$ref": "#/components/requestBodies/UserInput"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/User"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "415": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Soft-delete user",
+        "parameters": [{"$ref": "#/components/parameters/IfMatch"}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{id}:restore": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "post": {
+        "summary": "Restore soft-deleted user",
+        "security": [{"admin": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/User"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/graphql": {
+      "post": {
+        "summary": "GraphQL endpoint, schema has user, users and mutations of users",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "required": ["query"],
+                "properties": {
+                  "query": {"type": "string"},
+                  "operationName": {"type": "string"},
+                  "variables": {"type": "object"}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {"description": "GraphQL response with data and errors", "content": {"application/json": {}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/users/{id}/history": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Audit trail of user",
+        "parameters": [
+          {"$ref": "#/components/parameters/Offset"},
+          {"$ref": "#/components/parameters/Limit"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Changes of user",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/UserAudit"}}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks": {
+      "get": {
+        "summary": "List webhooks",
+        "security": [{"admin": []}],
+        "responses": {
+          "200": {
+            "description": "Webhooks without secrets",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}
+          },
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create webhook",
+        "description": "Deliveries are POSTed with X-Webhook-Event, X-Webhook-Delivery, X-Webhook-Timestamp and X-Webhook-Signature: sha256= and hex HMAC-SHA256 of timestamp, a dot and body keyed with the secret.",
+        "security": [{"admin": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/WebhookInput"},
+        "responses": {
+          "201": {
+            "description": "Created webhook with its secret",
+            "headers": {"Location": {"schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Get webhook",
+        "security": [{"admin": []}],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Webhook"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Update webhook, empty secret keeps the current one",
+        "security": [{"admin": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/WebhookInput"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/Webhook"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete webhook with its deliveries",
+        "security": [{"admin": []}],
+        "responses": {
+          "204": {"description": "Deleted"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/{id}/deliveries": {
+      "parameters": [{"$ref": "#/components/parameters/Id"}],
+      "get": {
+        "summary": "Delivery log of webhook, newest first",
+        "security": [{"admin": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Offset"},
+          {"$ref": "#/components/parameters/Limit"},
+          {"name": "status", "in": "query", "schema": {"type": "string", "enum": ["pending", "succeeded", "dead"]}}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/WebhookDeliveries"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/{id}/deliveries/{delivery_id}:retry": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Id"},
+        {"name": "delivery_id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}}
+      ],
+      "post": {
+        "summary": "Send delivery again with a fresh count of attempts",
+        "security": [{"admin": []}],
+        "responses": {
+          "202": {
+            "description": "Pending delivery",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/WebhookDelivery"}}}
+          },
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/webhooks/dead-letters": {
+      "get": {
+        "summary": "Deliveries of all webhooks which ran out of attempts, newest first",
+        "security": [{"admin": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Offset"},
+          {"$ref": "#/components/parameters/Limit"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/WebhookDeliveries"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "admin": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "Id": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+      "Offset": {"name": "offset", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0}},
+      "Limit": {"name": "limit", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0, "maximum": 25}},
+      "IncludeDeleted": {"name": "include_deleted", "in": "query", "description": "Admin only", "schema": {"type": "boolean"}},
+      "IfMatch": {"name": "If-Match", "in": "header", "schema": {"type": "string"}}
+    },
+    "requestBodies": {
+      "UserInput": {
+        "required": true,
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/UserInput"}},
+          "application/xml": {},
+          "application/msgpack": {}
+        }
+      },
+      "WebhookInput": {
+        "required": true,
+        "content": {
+          "application/json": {"schema": {"$ref": "#/components/schemas/WebhookInput"}},
+          "application/xml": {},
+          "application/msgpack": {}
+        }
+      }
+    },
+    "responses": {
+      "User": {
+        "description": "User",
+        "headers": {
+          "ETag": {"schema": {"type": "string"}},
+          "Last-Modified": {"description": "Time of the last change, not sent for users changed before it was stored", "schema": {"type": "string"}},
+          "Cache-Control": {"schema": {"type": "string"}}
+        },
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}
+      },
+      "BatchResult": {
+        "description": "Result of every item",
+        "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResult"}}}}
+      },
+      "Webhook": {
+        "description": "Webhook without secret",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}
+      },
+      "WebhookDeliveries": {
+        "description": "Deliveries",
+        "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}
+      },
+      "Readiness": {
+        "description": "State of the database and of the circuit breaker in front of it",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}
+      },
+      "Error": {
+        "description": "Error message",
+        "content": {"text/plain": {"schema": {"type": "string"}}}
+      }
+    },
+    "schemas": {
+      "User": {
+        "type": "object",
+        "required": ["id", "name", "status", "created_on", "updated_on", "version"],
+        "additionalProperties": false,
+        "properties": {
+          "id": {"type": "integer", "minimum": 1},
+          "name": {"type": "string", "minLength": 1},
+          "email": {"type": "string", "format": "email"},
+          "status": {"type": "string", "enum": ["active", "suspended"]},
+          "created_on": {"type": "string", "format": "date-time"},
+          "updated_on": {"type": "string", "format": "date-time"},
+          "version": {"type": "integer", "minimum": 1},
+          "deleted_on": {"type": "string", "format": "date-time"},
+          "metadata": {"type": "object", "description": "Omitted from application/xml"}
+        }
+      },
+      "UserInput": {
+        "type": "object",
+        "required": ["name"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "email": {"type": "string", "format": "email", "description": "Unique regardless of case"},
+          "status": {"type": "string", "enum": ["active", "suspended"], "default": "active"},
+          "metadata": {"type": "object", "description": "Not supported by application/xml, PUT keeps the stored metadata then"}
+        }
+      },
+      "UserAudit": {
+        "type": "object",
+        "required": ["id", "user_id", "action", "actor", "request_id", "created_on"],
+        "properties": {
+          "id": {"type": "integer"},
+          "user_id": {"type": "integer"},
+          "action": {"type": "string", "enum": ["insert", "update", "delete", "restore", "purge"]},
+          "actor": {"type": "string"},
+          "request_id": {"type": "string"},
+          "before": {"type": "object"},
+          "after": {"type": "object"},
+          "diff": {"type": "object"},
+          "created_on": {"type": "string", "format": "date-time"}
+        }
+      },
+      "BatchResult": {
+        "type": "object",
+        "required": ["index", "status"],
+        "properties": {
+          "index": {"type": "integer"},
+          "status": {"type": "integer"},
+          "user": {"$ref": "#/components/schemas/User"},
+          "error": {"type": "string"}
+        }
+      },
+      "SearchResult": {
+        "type": "object",
+        "required": ["user", "rank", "highlight"],
+        "properties": {
+          "user": {"$ref": "#/components/schemas/User"},
+          "rank": {"type": "number"},
+          "highlight": {"type": "string", "description": "Name escaped as HTML, matched parts are wrapped in mark"}
+        }
+      },
+      "Readiness": {
+        "type": "object",
+        "required": ["status", "database", "failures"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ready", "unavailable"]},
+          "database": {"type": "string", "enum": ["up", "down"]},
+          "breaker": {"type": "string", "enum": ["closed", "open", "half-open"]},
+          "failures": {"type": "integer"},
+          "opened_on": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "required": ["id", "url", "events", "active", "created_on"],
+        "properties": {
+          "id": {"type": "integer"},
+          "url": {"type": "string", "format": "uri"},
+          "events": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookEventType"}},
+          "active": {"type": "boolean"},
+          "secret": {"type": "string"},
+          "created_on": {"type": "string", "format": "date-time"}
+        }
+      },
+      "WebhookInput": {
+        "type": "object",
+        "required": ["url"],
+        "additionalProperties": false,
+        "properties": {
+          "url": {"type": "string", "format": "uri"},
+          "events": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookEventType"}, "default": ["created", "deleted"]},
+          "secret": {"type": "string"},
+          "active": {"type": "boolean", "default": true}
+        }
+      },
+      "WebhookEventType": {"type": "string", "enum": ["created", "updated", "deleted"]},
+      "WebhookDelivery": {
+        "type": "object",
+        "required": ["id", "webhook_id", "event_id", "event", "status", "attempts", "created_on"],
+        "properties": {
+          "id": {"type": "integer"},
+          "webhook_id": {"type": "integer"},
+          "event_id": {"type": "integer"},
+          "event": {"type": "string", "enum": ["user.created", "user.updated", "user.deleted"]},
+          "status": {"type": "string", "enum": ["pending", "succeeded", "dead"]},
+          "attempts": {"type": "integer"},
+          "response_code": {"type": "integer"},
+          "error": {"type": "string"},
+          "created_on": {"type": "string", "format": "date-time"},
+          "next_attempt_on": {"type": "string", "format": "date-time"},
+          "delivered_on": {"type": "string", "format": "date-time"}
+        }
+      },
+      "WebhookEvent": {
+        "type": "object",
+        "description": "Body of a delivery. An event may be delivered more than once, id is the same for all copies of it and is used to skip duplicates",
+        "required": ["id", "event", "created_on", "user"],
+        "properties": {
+          "id": {"type": "integer", "format": "int64"},
+          "event": {"type": "string", "enum": ["user.created", "user.updated", "user.deleted"]},
+          "created_on": {"type": "string", "format": "date-time"},
+          "user": {"$ref": "#/components/schemas/User"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,27 @@
+package api
+
+//UserSchemaVersion is increased on every incompatible change of User
+const UserSchemaVersion = 2
+
+//UserSchema - JSON Schema of User served at /schemas/user.json
+const UserSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "/schemas/user.json",
+  "title": "User",
+  "version": 2,
+  "type": "object",
+  "required": ["id", "name", "status", "created_on", "updated_on", "version"],
+  "additionalProperties": false,
+  "properties": {
+    "id": {"type": "integer", "minimum": 1},
+    "name": {"type": "string", "minLength": 1},
+    "email": {"type": "string", "format": "email"},
+    "status": {"type": "string", "enum": ["active", "suspended"]},
+    "created_on": {"type": "string", "format": "date-time"},
+    "updated_on": {"type": "string", "format": "date-time"},
+    "version": {"type": "integer", "minimum": 1},
+    "deleted_on": {"type": "string", "format": "date-time"},
+    "metadata": {"type": "object"}
+  }
+}
+`
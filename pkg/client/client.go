@@ -0,0 +1,187 @@
+//Package client is a typed client of the users API
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryWait  = 100 * time.Millisecond
+	maxRetryWait      = 5 * time.Second
+)
+
+type Client struct {
+	//BaseURL - address of the server, e.g. http://localhost:8081
+	BaseURL string
+	//HTTPClient is used for requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	//Token - bearer token of administrator, sent if not empty
+	Token string
+	//MaxRetries - retries of a request after 5xx or 429, 0 means default, negative disables retries
+	MaxRetries int
+	//RetryWait - first pause between retries, it is doubled on every retry
+	RetryWait time.Duration
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (p *Client) httpClient() *http.Client {
+	if p.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return p.HTTPClient
+}
+
+func (p *Client) maxRetries() int {
+	if p.MaxRetries == 0 {
+		return defaultMaxRetries
+	}
+	if p.MaxRetries < 0 {
+		return 0
+	}
+	return p.MaxRetries
+}
+
+func (p *Client) retryWait() time.Duration {
+	if p.RetryWait <= 0 {
+		return defaultRetryWait
+	}
+	return p.RetryWait
+}
+
+//request describes one call, body is kept as bytes so it can be resent
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+	//idempotent requests are retried after any failure,
+	//others only after 429 when the server did not process them
+	idempotent bool
+}
+
+func newRequest(method, path string, body interface{}) (*request, error) {
+	req := &request{
+		method:     method,
+		path:       path,
+		header:     http.Header{},
+		idempotent: method != http.MethodPost,
+	}
+	req.header.Set("Accept", "application/json")
+	if body != nil {
+		encode, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		req.body = encode
+		req.header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+//do sends request retrying 5xx, 429 and network errors with exponential backoff,
+//decodes successful response into out if it is not nil
+func (p *Client) do(ctx context.Context, req *request, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		wait, retry, err := p.try(ctx, req, out)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retry || attempt >= p.maxRetries() {
+			return err
+		}
+		if wait <= 0 {
+			wait = p.backoff(attempt)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+//try makes one attempt, tells if it should be retried and after which
+//pause if the server sent Retry-After
+func (p *Client) try(ctx context.Context, req *request, out interface{}) (time.Duration, bool, error) {
+	resp, err := p.send(ctx, req)
+	if err != nil {
+		return 0, req.idempotent, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, req.idempotent, err
+	}
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode == http.StatusTooManyRequests ||
+			req.idempotent && retryable(resp.StatusCode)
+		return retryAfter(resp), retry, newError(resp.StatusCode, body)
+	}
+	if out == nil || len(body) == 0 {
+		return 0, false, nil
+	}
+	return 0, false, json.Unmarshal(body, out)
+}
+
+func (p *Client) send(ctx context.Context, req *request) (*http.Response, error) {
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequest(req.method, p.BaseURL+req.path, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if p.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	return p.httpClient().Do(httpReq)
+}
+
+func retryable(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+//backoff - RetryWait*2^attempt with full jitter
+func (p *Client) backoff(attempt int) time.Duration {
+	wait := p.retryWait() << uint(attempt)
+	if wait <= 0 || wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+//retryAfter reads Retry-After in seconds
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/NektarinR/godocker/pkg/server"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, wrap func(http.Handler) http.Handler) (*Client, func()) {
+	db, _ := repository.NewPostgresDBMock()
+	var handler http.Handler = server.NewServer(db)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	ts := httptest.NewServer(handler)
+	c := New(ts.URL)
+	c.RetryWait = time.Millisecond
+	return c, ts.Close
+}
+
+//failFirst answers the first n requests with status without calling the server
+func failFirst(n, status int, seen *[]*http.Request) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*seen = append(*seen, r)
+			fail := len(*seen) <= n
+			mu.Unlock()
+			if fail {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	c, closeServer := newTestClient(t, nil)
+	defer closeServer()
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
+
+func TestClient_Users(t *testing.T) {
+	c, closeServer := newTestClient(t, nil)
+	defer closeServer()
+	ctx := context.Background()
+	created, err := c.CreateUser(ctx, api.UserInput{Name: "Kolya"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if created.Id != 6 || created.Name != "Kolya" || created.Version != 1 {
+		t.Errorf("expected created user with id 6, got %v\n", created)
+	}
+	usr, err := c.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if usr.Id != 1 || usr.Name != "Vasy" {
+		t.Errorf("expected Vasy, got %v\n", usr)
+	}
+	updated, err := c.UpdateUser(ctx, 2, api.UserInput{Name: "Pety"}, 1)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if updated.Name != "Pety" || updated.Version != 2 {
+		t.Errorf("expected Pety of version 2, got %v\n", updated)
+	}
+	_, err = c.UpdateUser(ctx, 2, api.UserInput{Name: "Vasy"}, 1)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected %v, got %v\n", ErrPreconditionFailed, err)
+	}
+	if err := c.DeleteUser(ctx, 2, 0); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	err = c.DeleteUser(ctx, 2, 0)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v\n", ErrNotFound, err)
+	}
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected *Error with status 404, got %#v\n", err)
+	}
+}
+
+func TestClient_UserIterator(t *testing.T) {
+	c, closeServer := newTestClient(t, nil)
+	defer closeServer()
+	it := c.Users(context.Background(), 2)
+	var ids []int
+	for it.Next() {
+		ids = append(ids, it.User().Id)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Errorf("expected users 1..5, got %v\n", ids)
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, failFirst(2, http.StatusServiceUnavailable, &seen))
+	defer closeServer()
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected 3 attempts, got %d\n", len(seen))
+	}
+}
+
+func TestClient_RetryCreateUserSameKey(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, failFirst(1, http.StatusTooManyRequests, &seen))
+	defer closeServer()
+	if _, err := c.CreateUser(context.Background(), api.UserInput{Name: "Kolya"}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 attempts, got %d\n", len(seen))
+	}
+	first, second := seen[0].Header.Get("Idempotency-Key"), seen[1].Header.Get("Idempotency-Key")
+	if first == "" || first != second {
+		t.Errorf("expected the same Idempotency-Key, got %q and %q\n", first, second)
+	}
+}
+
+func TestClient_RetryGivesUp(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = append(seen, r)
+			http.Error(w, "server is busy", http.StatusInternalServerError)
+		})
+	})
+	defer closeServer()
+	c.MaxRetries = 2
+	err := c.Ping(context.Background())
+	if !errors.Is(err, ErrServerBusy) {
+		t.Errorf("expected %v, got %v\n", ErrServerBusy, err)
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected 3 attempts, got %d\n", len(seen))
+	}
+}
+
+func TestClient_NoRetryOnClientError(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, failFirst(1, http.StatusBadRequest, &seen))
+	defer closeServer()
+	err := c.Ping(context.Background())
+	if !errors.Is(err, ErrBadRequest) {
+		t.Errorf("expected %v, got %v\n", ErrBadRequest, err)
+	}
+	if len(seen) != 1 {
+		t.Errorf("expected 1 attempt, got %d\n", len(seen))
+	}
+}
+
+func TestClient_RetryStopsWithContext(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, failFirst(100, http.StatusServiceUnavailable, &seen))
+	defer closeServer()
+	c.RetryWait = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := c.Ping(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v\n", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected retries to stop with context, took %v\n", time.Since(start))
+	}
+}
+
+func TestClient_CreateUsers(t *testing.T) {
+	c, closeServer := newTestClient(t, nil)
+	defer closeServer()
+	results, err := c.CreateUsers(context.Background(), []api.UserInput{{Name: "Kolya"}, {Name: " "}})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %v\n", results)
+	}
+	if results[0].Status != http.StatusCreated || results[0].User == nil || results[0].User.Id != 6 {
+		t.Errorf("expected created user with id 6, got %v\n", results[0])
+	}
+	if results[1].Status != http.StatusBadRequest || results[1].Error == "" {
+		t.Errorf("expected bad request, got %v\n", results[1])
+	}
+}
+
+func TestClient_CreateUsersNotRetriedAfterServerError(t *testing.T) {
+	var seen []*http.Request
+	c, closeServer := newTestClient(t, failFirst(1, http.StatusServiceUnavailable, &seen))
+	defer closeServer()
+	_, err := c.CreateUsers(context.Background(), []api.UserInput{{Name: "Kolya"}})
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected *Error with status 503, got %#v\n", err)
+	}
+	if len(seen) != 1 {
+		t.Errorf("expected 1 attempt, got %d\n", len(seen))
+	}
+}
+
+func TestClient_ExportUsers(t *testing.T) {
+	c, closeServer := newTestClient(t, nil)
+	defer closeServer()
+	var names []string
+	err := c.ExportUsers(context.Background(), "pety", func(usr *api.User) error {
+		names = append(names, usr.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(names) != 2 || names[0] != "Pety" || names[1] != "PetyPety" {
+		t.Errorf("expected Pety and PetyPety, got %v\n", names)
+	}
+}
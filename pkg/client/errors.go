@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+//errors returned by the server, check them with errors.Is
+var (
+	ErrBadRequest           = errors.New("bad request")
+	ErrForbidden            = errors.New("forbidden")
+	ErrNotFound             = errors.New("not found")
+	ErrNotAcceptable        = errors.New("not acceptable")
+	ErrConflict             = errors.New("conflict")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrTooLarge             = errors.New("request entity too large")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrTooManyRequests      = errors.New("too many requests")
+	ErrServerBusy           = errors.New("server is busy")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusNotAcceptable:         ErrNotAcceptable,
+	http.StatusConflict:              ErrConflict,
+	http.StatusPreconditionFailed:    ErrPreconditionFailed,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusUnsupportedMediaType:  ErrUnsupportedMediaType,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+}
+
+//Error - unsuccessful response, Message is the text written by the server
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return http.StatusText(e.StatusCode) + ": " + e.Message
+}
+
+//Is maps status code to the sentinel errors of the package
+func (e *Error) Is(target error) bool {
+	if target == ErrServerBusy {
+		return e.StatusCode == http.StatusInternalServerError && e.Message == ErrServerBusy.Error()
+	}
+	return statusErrors[e.StatusCode] == target && target != nil
+}
+
+func newError(status int, body []byte) *Error {
+	return &Error{StatusCode: status, Message: strings.TrimSpace(string(body))}
+}
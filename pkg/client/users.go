@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/pkg/api"
+	uuid "github.com/satori/go.uuid"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//MaxPageSize - the server never returns more users per page
+const MaxPageSize = 25
+
+func userPath(id int) string {
+	return "/users/" + strconv.Itoa(id)
+}
+
+//ifMatch sets precondition on version, 0 means any version
+func ifMatch(req *request, version int) {
+	if version != 0 {
+		req.header.Set("If-Match", `"`+strconv.Itoa(version)+`"`)
+	}
+}
+
+func (p *Client) Ping(ctx context.Context) error {
+	req, _ := newRequest(http.MethodGet, "/ping", nil)
+	return p.do(ctx, req, nil)
+}
+
+//ListUsers returns one page of users
+func (p *Client) ListUsers(ctx context.Context, offset, limit int) ([]api.User, error) {
+	path := "/users?offset=" + strconv.Itoa(offset) + "&limit=" + strconv.Itoa(limit)
+	req, _ := newRequest(http.MethodGet, path, nil)
+	var users []api.User
+	if err := p.do(ctx, req, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (p *Client) GetUser(ctx context.Context, id int) (*api.User, error) {
+	req, _ := newRequest(http.MethodGet, userPath(id), nil)
+	usr := &api.User{}
+	if err := p.do(ctx, req, usr); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+//CreateUser sends Idempotency-Key, so retries never create the user twice
+func (p *Client) CreateUser(ctx context.Context, input api.UserInput) (*api.User, error) {
+	req, err := newRequest(http.MethodPost, "/users/", input)
+	if err != nil {
+		return nil, err
+	}
+	req.header.Set("Idempotency-Key", uuid.NewV4().String())
+	req.idempotent = true
+	usr := &api.User{}
+	if err := p.do(ctx, req, usr); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+//UpdateUser replaces user, version is checked with If-Match unless it is 0
+func (p *Client) UpdateUser(ctx context.Context, id int, input api.UserInput, version int) (*api.User, error) {
+	req, err := newRequest(http.MethodPut, userPath(id), input)
+	if err != nil {
+		return nil, err
+	}
+	ifMatch(req, version)
+	usr := &api.User{}
+	if err := p.do(ctx, req, usr); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+//DeleteUser soft-deletes user, version is checked with If-Match unless it is 0
+func (p *Client) DeleteUser(ctx context.Context, id, version int) error {
+	req, _ := newRequest(http.MethodDelete, userPath(id), nil)
+	ifMatch(req, version)
+	return p.do(ctx, req, nil)
+}
+
+//CreateUsers creates users with one POST /users:batch, result of every item is
+//returned even if some of them failed. The request is not retried after 5xx
+//because part of the batch may have been created
+func (p *Client) CreateUsers(ctx context.Context, inputs []api.UserInput) ([]api.BatchResult, error) {
+	req, err := newRequest(http.MethodPost, "/users:batch", inputs)
+	if err != nil {
+		return nil, err
+	}
+	var results []api.BatchResult
+	if err := p.do(ctx, req, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+//ExportUsers streams all users whose name contains name, fn is called for
+//every user while the response is being read
+func (p *Client) ExportUsers(ctx context.Context, name string, fn func(usr *api.User) error) error {
+	req, _ := newRequest(http.MethodGet, "/users/export?name="+url.QueryEscape(name), nil)
+	req.header.Set("Accept", "application/x-ndjson")
+	resp, err := p.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return newError(resp.StatusCode, body)
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		usr := &api.User{}
+		if err := decoder.Decode(usr); err != nil {
+			return err
+		}
+		if err := fn(usr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//UserIterator walks through all users page by page:
+//
+//	it := c.Users(ctx, 10)
+//	for it.Next() {
+//		usr := it.User()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type UserIterator struct {
+	client   *Client
+	ctx      context.Context
+	pageSize int
+	offset   int
+	page     []api.User
+	current  api.User
+	last     bool
+	err      error
+}
+
+//Users returns iterator over all users, pageSize is limited by MaxPageSize
+func (p *Client) Users(ctx context.Context, pageSize int) *UserIterator {
+	if pageSize <= 0 || pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	return &UserIterator{client: p, ctx: ctx, pageSize: pageSize}
+}
+
+func (p *UserIterator) Next() bool {
+	if p.err != nil {
+		return false
+	}
+	if len(p.page) == 0 {
+		if p.last {
+			return false
+		}
+		p.page, p.err = p.client.ListUsers(p.ctx, p.offset, p.pageSize)
+		if p.err != nil {
+			return false
+		}
+		p.offset += len(p.page)
+		//a short page is the last one
+		p.last = len(p.page) < p.pageSize
+		if len(p.page) == 0 {
+			return false
+		}
+	}
+	p.current, p.page = p.page[0], p.page[1:]
+	return true
+}
+
+func (p *UserIterator) User() api.User {
+	return p.current
+}
+
+func (p *UserIterator) Err() error {
+	return p.err
+}
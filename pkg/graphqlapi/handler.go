@@ -0,0 +1,66 @@
+package graphqlapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	graphql "github.com/graph-gophers/graphql-go"
+	"net/http"
+)
+
+type ctxKey int
+
+const (
+	loaderKey ctxKey = iota
+	adminKey
+)
+
+func loaderFrom(ctx context.Context) *userLoader {
+	return ctx.Value(loaderKey).(*userLoader)
+}
+
+func isAdmin(ctx context.Context) bool {
+	v, _ := ctx.Value(adminKey).(bool)
+	return v
+}
+
+type handler struct {
+	schema  *graphql.Schema
+	db      repository.IRepository
+	isAdmin func(r *http.Request) bool
+}
+
+//NewHandler serves POST requests {"query": ..., "operationName": ..., "variables": ...},
+//isAdmin tells if the request may see soft-deleted users
+func NewHandler(db repository.IRepository, isAdmin func(r *http.Request) bool) http.Handler {
+	return &handler{
+		schema:  graphql.MustParseSchema(Schema, &resolver{db: db}),
+		db:      db,
+		isAdmin: isAdmin,
+	}
+}
+
+func (p *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, adminKey, p.isAdmin(r))
+	ctx = context.WithValue(ctx, loaderKey, newUserLoader(ctx, p.db))
+	resp := p.schema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+	encode, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(encode)
+}
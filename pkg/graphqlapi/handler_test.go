@@ -0,0 +1,182 @@
+package graphqlapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//countingRepository counts lookups of users by id
+type countingRepository struct {
+	repository.IRepository
+	mu    sync.Mutex
+	byId  int
+	batch [][]int
+}
+
+func (p *countingRepository) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	p.mu.Lock()
+	p.byId++
+	p.mu.Unlock()
+	return p.IRepository.GetUserById(ctx, id)
+}
+
+func (p *countingRepository) GetUsersByIds(ctx context.Context, ids []int) ([]repository.User, error) {
+	p.mu.Lock()
+	p.batch = append(p.batch, ids)
+	p.mu.Unlock()
+	return p.IRepository.GetUsersByIds(ctx, ids)
+}
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func exec(t *testing.T, h http.Handler, admin bool, query string, variables map[string]interface{}) *graphqlResponse {
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8081/graphql", bytes.NewReader(body))
+	if admin {
+		req.Header.Set("Authorization", "admin")
+	}
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusOK)
+	}
+	var resp graphqlResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	return &resp
+}
+
+func newTestHandler() (http.Handler, *countingRepository) {
+	db, _ := repository.NewPostgresDBMock()
+	repo := &countingRepository{IRepository: db}
+	return NewHandler(repo, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "admin"
+	}), repo
+}
+
+func TestHandler_UserBatched(t *testing.T) {
+	h, repo := newTestHandler()
+	resp := exec(t, h, false, `{
+		a: user(id: 1) { id name }
+		b: user(id: 3) { name created_on version }
+		c: user(id: 1) { name }
+		d: user(id: 42) { name }
+	}`, nil)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v\n", resp.Errors)
+	}
+	expected := `{"a":{"id":"1","name":"Vasy"},"b":{"name":"Pety","created_on":"1970-01-01T00:00:10.00000001Z","version":1},"c":{"name":"Vasy"},"d":null}`
+	if string(resp.Data) != expected {
+		t.Errorf("expected %s, got %s\n", expected, resp.Data)
+	}
+	if repo.byId != 0 || len(repo.batch) != 1 || len(repo.batch[0]) != 3 {
+		t.Errorf("expected one batch of 3 ids, got %v and %d single lookups\n", repo.batch, repo.byId)
+	}
+}
+
+func TestHandler_UsersPagination(t *testing.T) {
+	h, _ := newTestHandler()
+	query := `query($after: String) {
+		users(first: 1, after: $after, filter: {name: "vasy"}) {
+			edges { node { id } }
+			page_info { has_next_page end_cursor }
+		}
+	}`
+	var ids []string
+	var after interface{}
+	for page := 0; page < 3; page++ {
+		resp := exec(t, h, false, query, map[string]interface{}{"after": after})
+		if len(resp.Errors) != 0 {
+			t.Fatalf("expected no errors, got %v\n", resp.Errors)
+		}
+		var data struct {
+			Users struct {
+				Edges []struct {
+					Node struct{ Id string }
+				}
+				PageInfo struct {
+					HasNextPage bool    `json:"has_next_page"`
+					EndCursor   *string `json:"end_cursor"`
+				} `json:"page_info"`
+			}
+		}
+		json.Unmarshal(resp.Data, &data)
+		for _, edge := range data.Users.Edges {
+			ids = append(ids, edge.Node.Id)
+		}
+		if !data.Users.PageInfo.HasNextPage {
+			break
+		}
+		after = *data.Users.PageInfo.EndCursor
+	}
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Errorf("expected users 1, 2, got %v\n", ids)
+	}
+}
+
+func TestHandler_Mutations(t *testing.T) {
+	h, _ := newTestHandler()
+	resp := exec(t, h, false, `mutation {
+		create_user(input: {name: " Kolya "}) { id name version }
+		update_user(id: 2, input: {name: "Pety"}, version: 1) { name version }
+		delete_user(id: 3)
+	}`, nil)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v\n", resp.Errors)
+	}
+	expected := `{"create_user":{"id":"6","name":"Kolya","version":1},"update_user":{"name":"Pety","version":2},"delete_user":true}`
+	if string(resp.Data) != expected {
+		t.Errorf("expected %s, got %s\n", expected, resp.Data)
+	}
+	resp = exec(t, h, false, `mutation { update_user(id: 2, input: {name: "Vasy"}, version: 1) { version } }`, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != repository.ErrVersionConflict.Error() {
+		t.Errorf("expected version conflict, got %v\n", resp.Errors)
+	}
+	//omitted email and status keep their values
+	resp = exec(t, h, false, `mutation {
+		update_user(id: 1, input: {name: "Kolya", email: "kolya@example.com", status: suspended}) { email status version }
+	}`, nil)
+	resp = exec(t, h, false, `mutation { update_user(id: 1, input: {name: "Pety"}) { name email status version } }`, nil)
+	expected = `{"update_user":{"name":"Pety","email":"kolya@example.com","status":"suspended","version":3}}`
+	if len(resp.Errors) != 0 || string(resp.Data) != expected {
+		t.Errorf("expected %s, got %s %v\n", expected, resp.Data, resp.Errors)
+	}
+	resp = exec(t, h, false, `mutation { create_user(input: {name: "Kolya", email: "KOLYA@example.com"}) { id } }`, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != repository.ErrEmailTaken.Error() {
+		t.Errorf("expected taken email, got %v\n", resp.Errors)
+	}
+	resp = exec(t, h, false, `{ users(filter: {email: "kolya@EXAMPLE.com", status: suspended}) { edges { node { id } } } }`, nil)
+	expected = `{"users":{"edges":[{"node":{"id":"1"}}]}}`
+	if len(resp.Errors) != 0 || string(resp.Data) != expected {
+		t.Errorf("expected %s, got %s %v\n", expected, resp.Data, resp.Errors)
+	}
+}
+
+func TestHandler_IncludeDeleted(t *testing.T) {
+	h, _ := newTestHandler()
+	exec(t, h, false, `mutation { delete_user(id: 1) }`, nil)
+	query := `{ users(filter: {include_deleted: true}) { edges { node { id deleted_on } } } }`
+	resp := exec(t, h, false, query, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Message != errForbidden.Error() {
+		t.Errorf("expected forbidden, got %v\n", resp.Errors)
+	}
+	resp = exec(t, h, true, query, nil)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v\n", resp.Errors)
+	}
+	if !bytes.Contains(resp.Data, []byte(`{"id":"1","deleted_on":"`)) {
+		t.Errorf("expected deleted user 1, got %s\n", resp.Data)
+	}
+}
@@ -0,0 +1,94 @@
+package graphqlapi
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	"sync"
+	"time"
+)
+
+const (
+	//loaderWait - how long the loader collects ids before one query
+	loaderWait = 2 * time.Millisecond
+	//loaderMaxBatch - batch is sent at once when it is full
+	loaderMaxBatch = 100
+)
+
+//userLoader batches GetUserById calls of one request into GetUsersByIds
+//and caches results, resolvers are executed concurrently so ids requested
+//during loaderWait end up in the same query
+type userLoader struct {
+	ctx   context.Context
+	db    repository.IRepository
+	mu    sync.Mutex
+	batch *userBatch
+	cache map[int]*userBatch
+}
+
+type userBatch struct {
+	ids   []int
+	once  sync.Once
+	done  chan struct{}
+	users map[int]*repository.User
+	err   error
+}
+
+func newUserLoader(ctx context.Context, db repository.IRepository) *userLoader {
+	return &userLoader{ctx: ctx, db: db, cache: map[int]*userBatch{}}
+}
+
+//Load returns gorm.ErrRecordNotFound if there is no such user
+func (p *userLoader) Load(id int) (*repository.User, error) {
+	p.mu.Lock()
+	b, ok := p.cache[id]
+	if !ok {
+		if p.batch == nil {
+			b := &userBatch{done: make(chan struct{})}
+			p.batch = b
+			time.AfterFunc(loaderWait, func() {
+				p.dispatch(b)
+			})
+		}
+		b = p.batch
+		b.ids = append(b.ids, id)
+		p.cache[id] = b
+		if len(b.ids) >= loaderMaxBatch {
+			p.batch = nil
+			go p.dispatch(b)
+		}
+	}
+	p.mu.Unlock()
+	select {
+	case <-b.done:
+	case <-p.ctx.Done():
+		return nil, p.ctx.Err()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	usr, ok := b.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return usr, nil
+}
+
+//dispatch sends the batch once, either by timer or because it is full
+func (p *userLoader) dispatch(b *userBatch) {
+	b.once.Do(func() {
+		p.mu.Lock()
+		if p.batch == b {
+			p.batch = nil
+		}
+		ids := b.ids
+		p.mu.Unlock()
+		users, err := p.db.GetUsersByIds(p.ctx, ids)
+		b.users = make(map[int]*repository.User, len(users))
+		for i := range users {
+			b.users[users[i].Id] = &users[i]
+		}
+		b.err = err
+		close(b.done)
+	})
+}
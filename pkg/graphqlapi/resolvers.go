@@ -0,0 +1,305 @@
+package graphqlapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/jinzhu/gorm"
+	"strconv"
+	"strings"
+)
+
+var (
+	errBadId     = errors.New("bad id")
+	errBadCursor = errors.New("bad cursor")
+	errForbidden = errors.New("forbidden")
+)
+
+type resolver struct {
+	db repository.IRepository
+}
+
+type userFilter struct {
+	Name           *string
+	Email          *string
+	Status         *string
+	UpdatedSince   *graphql.Time
+	IncludeDeleted *bool
+}
+
+type userInput struct {
+	Name   string
+	Email  *string
+	Status *string
+}
+
+func parseId(id graphql.ID) (int, error) {
+	v, err := strconv.Atoi(string(id))
+	if err != nil || v <= 0 {
+		return 0, errBadId
+	}
+	return v, nil
+}
+
+//apply sets fields of the input which are given, status is checked by the schema
+func (p *userInput) apply(usr *repository.PublicUser) error {
+	name, err := repository.ValidateName(p.Name)
+	if err != nil {
+		return err
+	}
+	usr.Name = name
+	if p.Email != nil {
+		email, err := repository.ValidateEmail(*p.Email)
+		if err != nil {
+			return err
+		}
+		usr.Email = email
+	}
+	if p.Status != nil {
+		usr.Status = *p.Status
+	}
+	return nil
+}
+
+//cursor is opaque for clients, it holds id of the last user of the page
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("user:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), "user:") {
+		return 0, errBadCursor
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(data), "user:"))
+	if err != nil {
+		return 0, errBadCursor
+	}
+	return id, nil
+}
+
+//User is loaded through the request loader, so many user(id) fields of one
+//query become one repository call
+func (r *resolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	id, err := parseId(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	usr, err := loaderFrom(ctx).Load(id)
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &userResolver{usr: usr}, nil
+}
+
+func (r *resolver) Users(ctx context.Context, args struct {
+	Filter *userFilter
+	First  int32
+	After  *string
+}) (*connectionResolver, error) {
+	first := int(args.First)
+	if first < 0 {
+		return nil, errors.New("bad first")
+	}
+	if first > repository.MaxPageSize {
+		first = repository.MaxPageSize
+	}
+	afterId := 0
+	if args.After != nil {
+		id, err := decodeCursor(*args.After)
+		if err != nil {
+			return nil, err
+		}
+		afterId = id
+	}
+	var filter repository.UserFilter
+	if args.Filter != nil {
+		if args.Filter.Name != nil {
+			filter.Name = *args.Filter.Name
+		}
+		if args.Filter.Email != nil {
+			filter.Email = strings.TrimSpace(*args.Filter.Email)
+		}
+		if args.Filter.Status != nil {
+			filter.Status = *args.Filter.Status
+		}
+		if args.Filter.UpdatedSince != nil {
+			filter.UpdatedSince = args.Filter.UpdatedSince.Time
+		}
+		if args.Filter.IncludeDeleted != nil && *args.Filter.IncludeDeleted {
+			if !isAdmin(ctx) {
+				return nil, errForbidden
+			}
+			ctx = repository.WithDeleted(ctx)
+		}
+	}
+	//one more user tells if there is the next page
+	users, err := r.db.FindUsers(ctx, filter, afterId, first+1)
+	if err != nil {
+		return nil, err
+	}
+	result := &connectionResolver{hasNext: len(users) > first}
+	if result.hasNext {
+		users = users[:first]
+	}
+	result.users = users
+	return result, nil
+}
+
+func (r *resolver) CreateUser(ctx context.Context, args struct{ Input userInput }) (*userResolver, error) {
+	usr := &repository.User{}
+	if err := args.Input.apply(&usr.PublicUser); err != nil {
+		return nil, err
+	}
+	if err := r.db.InsertUser(ctx, usr); err != nil {
+		return nil, err
+	}
+	return &userResolver{usr: usr}, nil
+}
+
+func (r *resolver) UpdateUser(ctx context.Context, args struct {
+	ID      graphql.ID
+	Input   userInput
+	Version *int32
+}) (*userResolver, error) {
+	id, err := parseId(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	//metadata is not in the schema, it keeps its value like omitted fields
+	var usr *repository.User
+	err = r.db.WithTx(ctx, func(repo repository.IRepository) error {
+		stored, err := repo.GetUserById(ctx, id)
+		if err != nil {
+			return err
+		}
+		//omitted version is the one read here, a change made meanwhile is not overwritten
+		usr = &repository.User{
+			PrivateUser: repository.PrivateUser{Id: stored.Id, Version: stored.Version},
+			PublicUser:  stored.PublicUser,
+		}
+		if args.Version != nil {
+			usr.Version = int(*args.Version)
+		}
+		if err := args.Input.apply(&usr.PublicUser); err != nil {
+			return err
+		}
+		return repo.UpdateUser(ctx, usr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &userResolver{usr: usr}, nil
+}
+
+func (r *resolver) DeleteUser(ctx context.Context, args struct {
+	ID      graphql.ID
+	Version *int32
+}) (bool, error) {
+	id, err := parseId(args.ID)
+	if err != nil {
+		return false, err
+	}
+	version := 0
+	if args.Version != nil {
+		version = int(*args.Version)
+	}
+	if err := r.db.DeleteUser(ctx, id, version); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type userResolver struct {
+	usr *repository.User
+}
+
+func (r *userResolver) ID() graphql.ID {
+	return graphql.ID(strconv.Itoa(r.usr.Id))
+}
+
+func (r *userResolver) Name() string {
+	return r.usr.Name
+}
+
+func (r *userResolver) Email() *string {
+	if r.usr.Email == "" {
+		return nil
+	}
+	return &r.usr.Email
+}
+
+func (r *userResolver) Status() string {
+	return r.usr.Status
+}
+
+func (r *userResolver) CreatedOn() graphql.Time {
+	return graphql.Time{Time: r.usr.CreateOn.UTC()}
+}
+
+func (r *userResolver) UpdatedOn() graphql.Time {
+	return graphql.Time{Time: r.usr.UpdatedOn.UTC()}
+}
+
+func (r *userResolver) Version() int32 {
+	return int32(r.usr.Version)
+}
+
+func (r *userResolver) DeletedOn() *graphql.Time {
+	if r.usr.DeletedOn == nil {
+		return nil
+	}
+	return &graphql.Time{Time: r.usr.DeletedOn.UTC()}
+}
+
+type connectionResolver struct {
+	users   []repository.User
+	hasNext bool
+}
+
+func (r *connectionResolver) Edges() []*edgeResolver {
+	result := make([]*edgeResolver, len(r.users))
+	for i := range r.users {
+		result[i] = &edgeResolver{usr: &r.users[i]}
+	}
+	return result
+}
+
+func (r *connectionResolver) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNext: r.hasNext}
+	if len(r.users) > 0 {
+		cursor := encodeCursor(r.users[len(r.users)-1].Id)
+		info.endCursor = &cursor
+	}
+	return info
+}
+
+type edgeResolver struct {
+	usr *repository.User
+}
+
+func (r *edgeResolver) Cursor() string {
+	return encodeCursor(r.usr.Id)
+}
+
+func (r *edgeResolver) Node() *userResolver {
+	return &userResolver{usr: r.usr}
+}
+
+type pageInfoResolver struct {
+	hasNext   bool
+	endCursor *string
+}
+
+func (r *pageInfoResolver) HasNextPage() bool {
+	return r.hasNext
+}
+
+func (r *pageInfoResolver) EndCursor() *string {
+	return r.endCursor
+}
@@ -0,0 +1,73 @@
+//Package graphqlapi serves users over GraphQL at /graphql
+package graphqlapi
+
+//Schema - fields are snake_case like in the JSON API
+const Schema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	user(id: ID!): User
+	users(filter: UserFilter, first: Int = 25, after: String): UserConnection!
+}
+
+type Mutation {
+	create_user(input: UserInput!): User!
+	# omitted version is the one the update reads, omitted email and status keep their values
+	update_user(id: ID!, input: UserInput!, version: Int): User!
+	delete_user(id: ID!, version: Int): Boolean!
+}
+
+type User {
+	id: ID!
+	name: String!
+	email: String
+	status: UserStatus!
+	created_on: Time!
+	updated_on: Time!
+	version: Int!
+	deleted_on: Time
+}
+
+input UserFilter {
+	# users whose name contains it, case-insensitive
+	name: String
+	# case-insensitive
+	email: String
+	status: UserStatus
+	updated_since: Time
+	# admin only
+	include_deleted: Boolean
+}
+
+input UserInput {
+	name: String!
+	# empty email removes it
+	email: String
+	status: UserStatus
+}
+
+enum UserStatus {
+	active
+	suspended
+}
+
+type UserConnection {
+	edges: [UserEdge!]!
+	page_info: PageInfo!
+}
+
+type UserEdge {
+	cursor: String!
+	node: User!
+}
+
+type PageInfo {
+	has_next_page: Boolean!
+	end_cursor: String
+}
+`
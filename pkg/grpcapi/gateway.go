@@ -0,0 +1,272 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	mx "github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+)
+
+var (
+	marshaler   = jsonpb.Marshaler{OrigName: true}
+	unmarshaler = jsonpb.Unmarshaler{}
+)
+
+//NewGateway maps HTTP/JSON requests to UserService calls in grpc-gateway style,
+//routes are listed in user.proto. Authorization header is sent as metadata
+func NewGateway(client UserServiceClient) http.Handler {
+	g := &gateway{client: client}
+	mux := mx.NewRouter()
+	mux.HandleFunc("/v1/ping", g.ping).Methods(http.MethodGet)
+	mux.HandleFunc("/v1/users", g.listUsers).Methods(http.MethodGet)
+	mux.HandleFunc("/v1/users", g.createUser).Methods(http.MethodPost)
+	mux.HandleFunc("/v1/users/{id:[0-9]+}", g.getUser).Methods(http.MethodGet)
+	mux.HandleFunc("/v1/users/{id:[0-9]+}", g.updateUser).Methods(http.MethodPut)
+	mux.HandleFunc("/v1/users/{id:[0-9]+}", g.deleteUser).Methods(http.MethodDelete)
+	mux.HandleFunc("/v1/users/{id:[0-9]+}:restore", g.restoreUser).Methods(http.MethodPost)
+	return mux
+}
+
+type gateway struct {
+	client UserServiceClient
+}
+
+func (p *gateway) context(r *http.Request) context.Context {
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	}
+	return ctx
+}
+
+func (p *gateway) ping(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.client.Ping(p.context(r), &PingRequest{})
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) listUsers(w http.ResponseWriter, r *http.Request) {
+	in := &ListUsersRequest{}
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"))
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, "bad offset"))
+		return
+	}
+	limit, err := queryInt(query.Get("limit"))
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, "bad limit"))
+		return
+	}
+	in.Offset, in.Limit = int32(offset), int32(limit)
+	in.IncludeDeleted, _ = strconv.ParseBool(query.Get("include_deleted"))
+	resp, err := p.client.ListUsers(p.context(r), in)
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) getUser(w http.ResponseWriter, r *http.Request) {
+	in := &GetUserRequest{Id: pathId(r)}
+	in.IncludeDeleted, _ = strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+	resp, err := p.client.GetUser(p.context(r), in)
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) createUser(w http.ResponseWriter, r *http.Request) {
+	in := &CreateUserRequest{}
+	if err := unmarshaler.Unmarshal(r.Body, in); err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	resp, err := p.client.CreateUser(p.context(r), in)
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) updateUser(w http.ResponseWriter, r *http.Request) {
+	in := &UpdateUserRequest{}
+	if err := unmarshaler.Unmarshal(r.Body, in); err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	version, err := queryInt(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, "bad version"))
+		return
+	}
+	in.Id, in.Version = pathId(r), int64(version)
+	resp, err := p.client.UpdateUser(p.context(r), in)
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) deleteUser(w http.ResponseWriter, r *http.Request) {
+	version, err := queryInt(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, "bad version"))
+		return
+	}
+	resp, err := p.client.DeleteUser(p.context(r), &DeleteUserRequest{Id: pathId(r), Version: int64(version)})
+	writeMessage(w, resp, err)
+}
+
+func (p *gateway) restoreUser(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.client.RestoreUser(p.context(r), &RestoreUserRequest{Id: pathId(r)})
+	writeMessage(w, resp, err)
+}
+
+//pathId is always a number, the route checks it
+func pathId(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(mx.Vars(r)["id"], 10, 64)
+	return id
+}
+
+func queryInt(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func writeMessage(w http.ResponseWriter, m proto.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := marshaler.Marshal(&buf, m); err != nil {
+		writeError(w, status.Error(codes.Internal, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+//writeError writes {"code": 5, "message": "..."} like grpc-gateway does
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	var buf bytes.Buffer
+	if err := marshaler.Marshal(&buf, st.Proto()); err != nil {
+		http.Error(w, st.Message(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	w.Write(buf.Bytes())
+}
+
+//httpStatus follows statuses of the HTTP API, e.g. 412 for a stale version
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+//localClient calls UserServer in process through its interceptor,
+//outgoing metadata becomes incoming as if it went through the network
+type localClient struct {
+	srv *UserServer
+}
+
+//NewLocalClient lets the gateway be served without a network hop to gRPC
+func NewLocalClient(srv *UserServer) UserServiceClient {
+	return &localClient{srv: srv}
+}
+
+func (p *localClient) call(ctx context.Context, method string, in interface{},
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	info := &grpc.UnaryServerInfo{Server: p.srv, FullMethod: "/" + UserService_ServiceDesc.ServiceName + "/" + method}
+	return p.srv.UnaryInterceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return fn(ctx)
+	})
+}
+
+func (p *localClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error) {
+	resp, err := p.call(ctx, "Ping", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.Ping(ctx, in)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*PingResponse), nil
+}
+
+func (p *localClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	resp, err := p.call(ctx, "ListUsers", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.ListUsers(ctx, in)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*ListUsersResponse), nil
+}
+
+func (p *localClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	return p.user(p.call(ctx, "GetUser", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.GetUser(ctx, in)
+	}))
+}
+
+func (p *localClient) CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*User, error) {
+	return p.user(p.call(ctx, "CreateUser", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.CreateUser(ctx, in)
+	}))
+}
+
+func (p *localClient) UpdateUser(ctx context.Context, in *UpdateUserRequest, opts ...grpc.CallOption) (*User, error) {
+	return p.user(p.call(ctx, "UpdateUser", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.UpdateUser(ctx, in)
+	}))
+}
+
+func (p *localClient) DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*DeleteUserResponse, error) {
+	resp, err := p.call(ctx, "DeleteUser", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.DeleteUser(ctx, in)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*DeleteUserResponse), nil
+}
+
+func (p *localClient) RestoreUser(ctx context.Context, in *RestoreUserRequest, opts ...grpc.CallOption) (*User, error) {
+	return p.user(p.call(ctx, "RestoreUser", in, func(ctx context.Context) (interface{}, error) {
+		return p.srv.RestoreUser(ctx, in)
+	}))
+}
+
+func (p *localClient) user(resp interface{}, err error) (*User, error) {
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*User), nil
+}
@@ -0,0 +1,266 @@
+package grpcapi
+
+//user.pb.go and user_grpc.pb.go are generated from user.proto,
+//plugins match go.mod: protoc-gen-go v1.25.0, protoc-gen-go-grpc v1.2.0
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative user.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"strings"
+)
+
+//UserServer implements UserService on top of the repository
+type UserServer struct {
+	UnimplementedUserServiceServer
+	db         repository.IRepository
+	adminToken string
+}
+
+//NewUserServer creates service, admin requests are disabled if adminToken is empty
+func NewUserServer(db repository.IRepository, adminToken string) *UserServer {
+	return &UserServer{db: db, adminToken: adminToken}
+}
+
+//NewServer creates gRPC server with UserService registered
+func NewServer(srv *UserServer, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.UnaryInterceptor(srv.UnaryInterceptor))
+	s := grpc.NewServer(opts...)
+	RegisterUserServiceServer(s, srv)
+	return s
+}
+
+//isAdmin checks "authorization: Bearer <token>" metadata
+func (p *UserServer) isAdmin(ctx context.Context) bool {
+	if p.adminToken == "" {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token := strings.TrimPrefix(v, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+//UnaryInterceptor puts request id and actor into context for the audit trail
+//like HTTP middlewares do, and logs calls
+func (p *UserServer) UnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	u1 := uuid.NewV4()
+	ctx = repository.WithRequestID(ctx, u1.String())
+	actor := "anonymous"
+	if p.isAdmin(ctx) {
+		actor = "admin"
+	}
+	ctx = repository.WithActor(ctx, actor)
+	resp, err := handler(ctx, req)
+	log.Printf("%s grpc %s %s\n", u1.String(), info.FullMethod, status.Code(err))
+	return resp, err
+}
+
+//deletedScope includes soft-deleted users if admin asked for it
+func (p *UserServer) deletedScope(ctx context.Context, include bool) (context.Context, error) {
+	if !include {
+		return ctx, nil
+	}
+	if !p.isAdmin(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return repository.WithDeleted(ctx), nil
+}
+
+func (p *UserServer) Ping(ctx context.Context, in *PingRequest) (*PingResponse, error) {
+	return &PingResponse{}, nil
+}
+
+func (p *UserServer) ListUsers(ctx context.Context, in *ListUsersRequest) (*ListUsersResponse, error) {
+	if in.Offset < 0 || in.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "bad query")
+	}
+	limit := in.Limit
+	if limit > repository.MaxPageSize {
+		limit = repository.MaxPageSize
+	}
+	ctx, err := p.deletedScope(ctx, in.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	users, err := p.db.Fetch(ctx, int(in.Offset), int(limit))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ListUsersResponse{Users: make([]*User, len(users))}
+	for i := range users {
+		resp.Users[i] = toProtoUser(&users[i])
+	}
+	return resp, nil
+}
+
+func (p *UserServer) GetUser(ctx context.Context, in *GetUserRequest) (*User, error) {
+	ctx, err := p.deletedScope(ctx, in.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	usr, err := p.db.GetUserById(ctx, int(in.Id))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProtoUser(usr), nil
+}
+
+func (p *UserServer) CreateUser(ctx context.Context, in *CreateUserRequest) (*User, error) {
+	name, err := repository.ValidateName(in.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	usr := &repository.User{PublicUser: repository.PublicUser{Name: name, Status: in.Status}}
+	if usr.Email, err = repository.ValidateEmail(in.Email); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := repository.ValidateStatus(in.Status); err != nil {
+		return nil, toStatus(err)
+	}
+	if in.Metadata != nil {
+		usr.Metadata = in.Metadata.AsMap()
+	}
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	if err := p.db.InsertUser(ctx, usr); err != nil {
+		return nil, toStatus(err)
+	}
+	return toProtoUser(usr), nil
+}
+
+func (p *UserServer) UpdateUser(ctx context.Context, in *UpdateUserRequest) (*User, error) {
+	name, err := repository.ValidateName(in.Name)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	var email string
+	if in.Email != nil {
+		if email, err = repository.ValidateEmail(*in.Email); err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	if in.Status != nil {
+		if err := repository.ValidateStatus(*in.Status); err != nil {
+			return nil, toStatus(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	//fields which are not set keep their values. Without the expected version
+	//the update expects the one it has read, so it never overwrites a change
+	//made meanwhile, the client gets FailedPrecondition instead
+	var usr *repository.User
+	err = p.db.WithTx(ctx, func(repo repository.IRepository) error {
+		stored, err := repo.GetUserById(ctx, int(in.Id))
+		if err != nil {
+			return err
+		}
+		usr = &repository.User{
+			PrivateUser: repository.PrivateUser{Id: stored.Id, Version: int(in.Version)},
+			PublicUser:  stored.PublicUser,
+		}
+		if usr.Version == 0 {
+			usr.Version = stored.Version
+		}
+		usr.Name = name
+		if in.Email != nil {
+			usr.Email = email
+		}
+		if in.Status != nil {
+			usr.Status = *in.Status
+		}
+		if in.Metadata != nil {
+			usr.Metadata = in.Metadata.AsMap()
+		}
+		return repo.UpdateUser(ctx, usr)
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProtoUser(usr), nil
+}
+
+func (p *UserServer) DeleteUser(ctx context.Context, in *DeleteUserRequest) (*DeleteUserResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	if err := p.db.DeleteUser(ctx, int(in.Id), int(in.Version)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &DeleteUserResponse{}, nil
+}
+
+func (p *UserServer) RestoreUser(ctx context.Context, in *RestoreUserRequest) (*User, error) {
+	if !p.isAdmin(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	ctx, cancel := context.WithTimeout(ctx, repository.RequestTimeout)
+	defer cancel()
+	usr, err := p.db.RestoreUser(ctx, int(in.Id))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProtoUser(usr), nil
+}
+
+func toProtoUser(usr *repository.User) *User {
+	result := &User{
+		Id:        int64(usr.Id),
+		Name:      usr.Name,
+		CreatedOn: timestamppb.New(usr.CreateOn),
+		Version:   int64(usr.Version),
+		Email:     usr.Email,
+		Status:    usr.Status,
+	}
+	if usr.DeletedOn != nil {
+		result.DeletedOn = timestamppb.New(*usr.DeletedOn)
+	}
+	if !usr.UpdatedOn.IsZero() {
+		result.UpdatedOn = timestamppb.New(usr.UpdatedOn)
+	}
+	if len(usr.Metadata) > 0 {
+		//metadata comes from JSON, structpb accepts every value of it
+		result.Metadata, _ = structpb.NewStruct(usr.Metadata)
+	}
+	return result
+}
+
+//toStatus maps repository errors to codes the way HTTP handlers map them to statuses
+func toStatus(err error) error {
+	switch err {
+	case gorm.ErrRecordNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case repository.ErrVersionConflict:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case repository.ErrEmailTaken:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case repository.ErrNameRequired, repository.ErrBadEmail, repository.ErrBadStatus:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case repository.ErrUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, "server is busy")
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
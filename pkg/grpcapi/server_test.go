@@ -0,0 +1,265 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (UserServiceClient, func()) {
+	db, _ := repository.NewPostgresDBMock()
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewServer(NewUserServer(db, "secret"))
+	go srv.Serve(lis)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	return NewUserServiceClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestUserServer_Users(t *testing.T) {
+	client, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+	if _, err := client.Ping(ctx, &PingRequest{}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	list, err := client.ListUsers(ctx, &ListUsersRequest{Offset: 0, Limit: 2})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(list.Users) != 2 || list.Users[0].Name != "Vasy" || list.Users[1].Id != 2 {
+		t.Errorf("expected users 1 and 2, got %v\n", list.Users)
+	}
+	usr, err := client.GetUser(ctx, &GetUserRequest{Id: 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if usr.Name != "Vasy" || usr.Version != 1 || !usr.CreatedOn.AsTime().Equal(time.Unix(10, 10)) {
+		t.Errorf("expected Vasy, got %v\n", usr)
+	}
+	created, err := client.CreateUser(ctx, &CreateUserRequest{Name: " Kolya "})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if created.Id != 6 || created.Name != "Kolya" {
+		t.Errorf("expected Kolya with id 6, got %v\n", created)
+	}
+	updated, err := client.UpdateUser(ctx, &UpdateUserRequest{Id: 2, Name: "Pety", Version: 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if updated.Name != "Pety" || updated.Version != 2 {
+		t.Errorf("expected Pety of version 2, got %v\n", updated)
+	}
+	if _, err := client.DeleteUser(ctx, &DeleteUserRequest{Id: 2}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if _, err := client.RestoreUser(ctx, &RestoreUserRequest{Id: 2}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected %v, got %v\n", codes.PermissionDenied, err)
+	}
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	restored, err := client.RestoreUser(admin, &RestoreUserRequest{Id: 2})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if restored.DeletedOn != nil {
+		t.Errorf("expected restored user, got %v\n", restored)
+	}
+}
+
+func TestUserServer_Errors(t *testing.T) {
+	client, stop := newTestClient(t)
+	defer stop()
+	ctx := context.Background()
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if _, err := client.DeleteUser(ctx, &DeleteUserRequest{Id: 1}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	testCases := []struct {
+		Name string
+		Call func() error
+		Code codes.Code
+	}{
+		{"deleted", func() error {
+			_, err := client.GetUser(ctx, &GetUserRequest{Id: 1})
+			return err
+		}, codes.NotFound},
+		{"include deleted", func() error {
+			_, err := client.GetUser(ctx, &GetUserRequest{Id: 1, IncludeDeleted: true})
+			return err
+		}, codes.PermissionDenied},
+		{"include deleted by admin", func() error {
+			_, err := client.GetUser(admin, &GetUserRequest{Id: 1, IncludeDeleted: true})
+			return err
+		}, codes.OK},
+		{"empty name", func() error {
+			_, err := client.CreateUser(ctx, &CreateUserRequest{Name: " "})
+			return err
+		}, codes.InvalidArgument},
+		{"stale version", func() error {
+			_, err := client.UpdateUser(ctx, &UpdateUserRequest{Id: 2, Name: "Pety", Version: 7})
+			return err
+		}, codes.FailedPrecondition},
+		{"negative offset", func() error {
+			_, err := client.ListUsers(ctx, &ListUsersRequest{Offset: -1})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, testCase := range testCases {
+		if code := status.Code(testCase.Call()); code != testCase.Code {
+			t.Errorf("%s: expected %v, got %v\n", testCase.Name, testCase.Code, code)
+		}
+	}
+}
+
+func TestGateway(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	ts := httptest.NewServer(NewGateway(NewLocalClient(NewUserServer(db, "secret"))))
+	defer ts.Close()
+	testCases := []struct {
+		Method string
+		Url    string
+		Body   string
+		Status int
+		Check  string
+	}{
+		{"GET", "/v1/users/1", "", http.StatusOK, `"created_on":"1970-01-01T00:00:10.000000010Z"`},
+		{"GET", "/v1/users?offset=0&limit=2", "", http.StatusOK, `"name":"VasyVasy"`},
+		{"POST", "/v1/users", `{"name":"Kolya"}`, http.StatusOK, `"id":"6"`},
+		{"PUT", "/v1/users/2?version=7", `{"name":"Pety"}`, http.StatusPreconditionFailed, `"code":9`},
+		{"POST", "/v1/users", `{"name":"Sany","email":"sany@example.com","metadata":{"team":"a"}}`, http.StatusOK,
+			`"metadata":{"team":"a"}`},
+		{"PUT", "/v1/users/2?version=1", `{"name":"Pety"}`, http.StatusOK, `"version":"2"`},
+		{"PUT", "/v1/users/2", `{"name":"Pety","status":"suspended"}`, http.StatusOK, `"status":"suspended"`},
+		{"DELETE", "/v1/users/2", "", http.StatusOK, `{}`},
+		{"GET", "/v1/users/2", "", http.StatusNotFound, `"code":5`},
+		{"GET", "/v1/users/2?include_deleted=true", "", http.StatusForbidden, `"code":7`},
+		{"POST", "/v1/users/2:restore", "", http.StatusForbidden, `"code":7`},
+		{"POST", "/v1/users", `{"name":`, http.StatusBadRequest, `"code":3`},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest(testCase.Method, ts.URL+testCase.Url, strings.NewReader(testCase.Body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		var body json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != testCase.Status {
+			t.Errorf("%s %s: wrong responce code, got %d expected %d\n",
+				testCase.Method, testCase.Url, resp.StatusCode, testCase.Status)
+		}
+		if !strings.Contains(string(body), testCase.Check) {
+			t.Errorf("%s %s: expected %s in %s\n", testCase.Method, testCase.Url, testCase.Check, body)
+		}
+	}
+}
+
+func TestUserServer_UpdateKeepsProfile(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewUserServer(db, "")
+	ctx := context.Background()
+	usr := &repository.User{PrivateUser: repository.PrivateUser{Id: 1}, PublicUser: repository.PublicUser{Name: "Kolya",
+		Email: "kolya@example.com", Status: repository.StatusSuspended, Metadata: repository.Metadata{"team": "a"}}}
+	if err := db.UpdateUser(ctx, usr); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	//email, status and metadata which are not set survive the update
+	updated, err := srv.UpdateUser(ctx, &UpdateUserRequest{Id: int64(usr.Id), Name: "Pety"})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if updated.Email != "kolya@example.com" || updated.Status != repository.StatusSuspended ||
+		updated.Metadata.AsMap()["team"] != "a" || updated.UpdatedOn == nil {
+		t.Errorf("expected profile in the reply, got %v\n", updated)
+	}
+	stored, _ := db.GetUsersByIds(ctx, []int{usr.Id})
+	if len(stored) != 1 || stored[0].Name != "Pety" || stored[0].Email != "kolya@example.com" ||
+		stored[0].Status != repository.StatusSuspended || stored[0].Metadata["team"] != "a" {
+		t.Errorf("expected Pety with kept profile, got %v\n", stored)
+	}
+	email, active := "", repository.StatusActive
+	metadata, _ := structpb.NewStruct(map[string]interface{}{"team": "b"})
+	updated, err = srv.UpdateUser(ctx, &UpdateUserRequest{Id: int64(usr.Id), Name: "Pety",
+		Email: &email, Status: &active, Metadata: metadata})
+	if err != nil || updated.Email != "" || updated.Status != active || updated.Metadata.AsMap()["team"] != "b" {
+		t.Errorf("expected changed profile, got %v, %v\n", updated, err)
+	}
+	taken := &repository.User{PublicUser: repository.PublicUser{Name: "Vasy", Email: "KOLYA@example.com"}}
+	if err := db.InsertUser(ctx, taken); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	created, err := srv.CreateUser(ctx, &CreateUserRequest{Name: "Sany", Email: "kolya@EXAMPLE.com"})
+	if code := status.Code(err); code != codes.AlreadyExists {
+		t.Errorf("expected %v, got %v %v\n", codes.AlreadyExists, created, err)
+	}
+	created, err = srv.CreateUser(ctx, &CreateUserRequest{Name: "Sany", Email: " sany@example.com ",
+		Status: repository.StatusSuspended, Metadata: metadata})
+	if err != nil || created.Email != "sany@example.com" || created.Status != repository.StatusSuspended ||
+		created.Metadata.AsMap()["team"] != "b" {
+		t.Errorf("expected Sany with profile, got %v, %v\n", created, err)
+	}
+	for _, in := range []*CreateUserRequest{{Name: "Sany", Email: "Sany <sany@example.com>"}, {Name: "Sany", Status: "banned"}} {
+		if _, err := srv.CreateUser(ctx, in); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: expected %v, got %v\n", in, codes.InvalidArgument, err)
+		}
+	}
+}
+
+//racingRepository changes the user right after UpdateUser has read it
+type racingRepository struct {
+	repository.IRepository
+}
+
+func (p *racingRepository) WithTx(ctx context.Context, fn func(repo repository.IRepository) error) error {
+	return p.IRepository.WithTx(ctx, func(repo repository.IRepository) error {
+		return fn(&racingTx{IRepository: repo})
+	})
+}
+
+type racingTx struct {
+	repository.IRepository
+}
+
+func (p *racingTx) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	usr, err := p.IRepository.GetUserById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	changed := *usr
+	changed.Email = "vasy@example.com"
+	return usr, p.IRepository.UpdateUser(ctx, &changed)
+}
+
+func TestUserServer_UpdateConcurrentChange(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewUserServer(&racingRepository{IRepository: db}, "")
+	//without the expected version the update expects the one it has read
+	_, err := srv.UpdateUser(context.Background(), &UpdateUserRequest{Id: 1, Name: "Pety"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected %v, got %v\n", codes.FailedPrecondition, err)
+	}
+}
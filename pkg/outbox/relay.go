@@ -0,0 +1,196 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/NektarinR/godocker/internal/repository"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRelayInterval = time.Second
+	defaultRelayBatch    = 100
+	//relayTimeout - limit of publishing one batch, the outbox is locked meanwhile
+	relayTimeout = time.Minute
+	//relayBuffer - changes of the bus waking relay before it resubscribes
+	relayBuffer = 64
+)
+
+//Relay publishes the outbox to sinks. Only one relay works at a time,
+//relays of other processes wait for the lock of the outbox
+type Relay struct {
+	db    repository.IRepository
+	sinks []Sink
+	//Interval - interval of polling the outbox, changes committed
+	//by this process wake relay at once
+	Interval time.Duration
+	//BatchSize - count of events published in one transaction
+	BatchSize int
+}
+
+func NewRelay(db repository.IRepository, sinks ...Sink) *Relay {
+	return &Relay{
+		db:        db,
+		sinks:     sinks,
+		Interval:  defaultRelayInterval,
+		BatchSize: defaultRelayBatch,
+	}
+}
+
+//Run publishes the outbox until stop is closed,
+//sinks which implement io.Closer are closed on return
+func (p *Relay) Run(stop <-chan struct{}) {
+	defer closeSinks(p.sinks)
+	sub, _, _ := p.db.Changes().Subscribe(-1, relayBuffer)
+	defer func() {
+		sub.Close()
+	}()
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultRelayInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.flushAll()
+		select {
+		case _, ok := <-sub.C():
+			if !ok {
+				sub, _, _ = p.db.Changes().Subscribe(-1, relayBuffer)
+				continue
+			}
+			drain(sub)
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+//drain skips changes which are already waiting, one flush publishes all of them
+func drain(sub *repository.Subscription) {
+	for {
+		select {
+		case _, ok := <-sub.C():
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+//flushAll publishes batches while the outbox has full ones. Users held back
+//by one batch are left out of the following ones, so they do not block the outbox
+func (p *Relay) flushAll() {
+	held := map[int]error{}
+	defer func() {
+		for _, user := range heldUsers(held) {
+			log.Printf("События пользователя %d задержаны до следующей публикации: %v\n", user, held[user])
+		}
+	}()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+		_, fetched, err := p.flush(ctx, held)
+		cancel()
+		if err != nil {
+			log.Printf("Ошибка при публикации событий %v\n", err)
+			return
+		}
+		if fetched < p.batchSize() {
+			return
+		}
+	}
+}
+
+//Flush publishes one batch of the outbox and returns count of published events.
+//A failed event holds back the following events of its user only, so changes
+//of every user are published in order they were made while other users go on.
+//The error tells which events are held back. Nothing is published
+//if the outbox is locked by another relay
+func (p *Relay) Flush(ctx context.Context) (int, error) {
+	held := map[int]error{}
+	published, _, err := p.flush(ctx, held)
+	if err != nil {
+		return 0, err
+	}
+	return published, heldError(held)
+}
+
+//flush publishes one batch without events of held users, users whose
+//events fail are added to held. It returns counts of published and read events
+func (p *Relay) flush(ctx context.Context, held map[int]error) (int, int, error) {
+	var published, fetched int
+	err := p.db.WithTx(ctx, func(tx repository.IRepository) error {
+		locked, err := tx.LockOutbox(ctx)
+		if err != nil || !locked {
+			return err
+		}
+		events, err := tx.OutboxEvents(ctx, p.batchSize(), heldUsers(held))
+		if err != nil {
+			return err
+		}
+		fetched = len(events)
+		ids := make([]int64, 0, len(events))
+		for i := range events {
+			if _, ok := held[events[i].UserId]; ok {
+				continue
+			}
+			if err := p.publish(ctx, newMessage(&events[i])); err != nil {
+				held[events[i].UserId] = err
+				continue
+			}
+			ids = append(ids, events[i].Id)
+		}
+		published = len(ids)
+		return tx.DeleteOutboxEvents(ctx, ids)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return published, fetched, nil
+}
+
+func heldUsers(held map[int]error) []int {
+	users := make([]int, 0, len(held))
+	for user := range held {
+		users = append(users, user)
+	}
+	sort.Ints(users)
+	return users
+}
+
+//heldError joins errors of held users, nil if nobody is held
+func heldError(held map[int]error) error {
+	if len(held) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(held))
+	for _, user := range heldUsers(held) {
+		messages = append(messages, fmt.Sprintf("user %d is held back: %v", user, held[user]))
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+//publish gives the message to all sinks, sinks which accepted it
+//before the failed one receive it again on retry
+func (p *Relay) publish(ctx context.Context, msg *Message) error {
+	for _, sink := range p.sinks {
+		if err := sink.Publish(ctx, msg); err != nil {
+			return fmt.Errorf("event %d to %T: %v", msg.Id, sink, err)
+		}
+	}
+	return nil
+}
+
+func (p *Relay) batchSize() int {
+	if p.BatchSize <= 0 {
+		return defaultRelayBatch
+	}
+	return p.BatchSize
+}
@@ -0,0 +1,173 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//recorder - sink remembering messages, it fails messages with ids in fail once
+type recorder struct {
+	mu       sync.Mutex
+	messages []Message
+	fail     map[int64]bool
+}
+
+func (p *recorder) Publish(ctx context.Context, msg *Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail[msg.Id] {
+		delete(p.fail, msg.Id)
+		return errors.New("broker is down")
+	}
+	p.messages = append(p.messages, *msg)
+	return nil
+}
+
+func (p *recorder) ids() []int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]int64, len(p.messages))
+	for i, v := range p.messages {
+		result[i] = v.Id
+	}
+	return result
+}
+
+func changeUsers(t *testing.T, db repository.IRepository) {
+	ctx := context.Background()
+	user := &repository.User{PublicUser: repository.PublicUser{Name: "Kolya"}}
+	if err := db.InsertUser(ctx, user); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	user.Name = "Kolyan"
+	if err := db.UpdateUser(ctx, user); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	if err := db.DeleteUser(ctx, 1, 0); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+}
+
+func equalIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelay_Flush(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	changeUsers(t, db)
+	sink := &recorder{}
+	relay := NewRelay(db, sink)
+	count, err := relay.Flush(context.Background())
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 events got %d, %v", count, err)
+	}
+	type TestCase struct {
+		Key  string
+		Type string
+		Name string
+	}
+	tests := []TestCase{
+		{Key: "6", Type: "user.created", Name: `"name":"Kolya"`},
+		{Key: "6", Type: "user.updated", Name: `"name":"Kolyan"`},
+		{Key: "1", Type: "user.deleted", Name: `"name":"Vasy"`},
+	}
+	for i, test := range tests {
+		msg := sink.messages[i]
+		if msg.Key != test.Key || msg.Type != test.Type || !strings.Contains(string(msg.Payload), test.Name) {
+			t.Errorf("message %d: expected %v got %v %s", i, test, msg, msg.Payload)
+		}
+	}
+	if count, err := relay.Flush(context.Background()); err != nil || count != 0 {
+		t.Errorf("expected empty outbox got %d, %v", count, err)
+	}
+}
+
+func TestRelay_Flush_FailureHoldsBack(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	changeUsers(t, db)
+	first := &recorder{}
+	second := &recorder{fail: map[int64]bool{2: true}}
+	relay := NewRelay(db, first, second)
+	//event 2 holds back events of user 6 only, event 3 of user 1 goes on
+	count, err := relay.Flush(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "event 2") || count != 2 {
+		t.Fatalf("expected 2 events and error of event 2 got %d, %v", count, err)
+	}
+	count, err = relay.Flush(context.Background())
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 event got %d, %v", count, err)
+	}
+	//the first sink receives the failed event again
+	if ids := first.ids(); !equalIds(ids, []int64{1, 2, 3, 2}) {
+		t.Errorf("expected 1 2 3 2 got %v", ids)
+	}
+	if ids := second.ids(); !equalIds(ids, []int64{1, 3, 2}) {
+		t.Errorf("expected 1 3 2 got %v", ids)
+	}
+}
+
+func TestRelay_FlushAll_RejectedUser(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	changeUsers(t, db)
+	if err := db.DeleteUser(context.Background(), 2, 0); err != nil {
+		t.Fatalf("expected nil got %v", err)
+	}
+	sink := &recorder{}
+	//events of user 6 are rejected for good, they fill a whole batch
+	reject := SinkFunc(func(ctx context.Context, msg *Message) error {
+		if msg.Key == "6" {
+			return errors.New("rejected")
+		}
+		return sink.Publish(ctx, msg)
+	})
+	relay := NewRelay(db, reject)
+	relay.BatchSize = 2
+	relay.flushAll()
+	if ids := sink.ids(); !equalIds(ids, []int64{3, 4}) {
+		t.Errorf("expected 3 4 got %v", ids)
+	}
+	//events of the rejected user stay in the outbox in order
+	events, _ := db.OutboxEvents(context.Background(), 10, nil)
+	if len(events) != 2 || events[0].Id != 1 || events[1].Id != 2 {
+		t.Errorf("expected events 1 2 got %v", events)
+	}
+}
+
+func TestRelay_Run(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	sink := &recorder{}
+	relay := NewRelay(db, sink)
+	relay.Interval = time.Hour
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		relay.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	//the relay is woken by the change, it does not wait for the interval
+	changeUsers(t, db)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sink.ids()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 events got %v", sink.ids())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+//Package outbox publishes changes of users written to the transactional outbox.
+//Relay reads the outbox in order and hands every event to all sinks,
+//an event is deleted from the outbox only after every sink accepted it
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/webhook"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Message - event of the outbox as it is given to sinks. Events are published
+//at least once, consumers must skip messages whose Id they have already seen
+type Message struct {
+	Id int64 `json:"id"`
+	//Key - id of the user, messages with the same key must be kept in order
+	Key string `json:"key"`
+	//Type - user.created, user.updated or user.deleted
+	Type      string    `json:"type"`
+	CreatedOn time.Time `json:"created_on"`
+	//Payload - the user after the change
+	Payload json.RawMessage `json:"payload"`
+}
+
+func newMessage(event *repository.OutboxEvent) *Message {
+	return &Message{
+		Id:        event.Id,
+		Key:       strconv.Itoa(event.UserId),
+		Type:      "user." + event.Type,
+		CreatedOn: event.CreateOn.UTC(),
+		Payload:   event.Payload,
+	}
+}
+
+//Sink receives messages of the outbox. Publish must return only after
+//the message is accepted, the message is published again after an error
+type Sink interface {
+	Publish(ctx context.Context, msg *Message) error
+}
+
+//SinkFunc lets an ordinary function be used as Sink
+type SinkFunc func(ctx context.Context, msg *Message) error
+
+func (p SinkFunc) Publish(ctx context.Context, msg *Message) error {
+	return p(ctx, msg)
+}
+
+//WriterSink writes messages as JSON lines
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+//NewStdoutSink writes messages to the standard output
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (p *WriterSink) Publish(ctx context.Context, msg *Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.w.Write(append(line, '\n'))
+	return err
+}
+
+//FileSink appends messages to a file as JSON lines,
+//the file is synced before Publish returns
+type FileSink struct {
+	WriterSink
+	file *os.File
+}
+
+func OpenFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{WriterSink: WriterSink{w: file}, file: file}, nil
+}
+
+func (p *FileSink) Publish(ctx context.Context, msg *Message) error {
+	if err := p.WriterSink.Publish(ctx, msg); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+func (p *FileSink) Close() error {
+	return p.file.Close()
+}
+
+//WebhookSink posts every message to Url, requests are signed
+//with the secret the same way as webhook deliveries
+type WebhookSink struct {
+	Url    string
+	Secret string
+	Client *http.Client
+}
+
+func NewWebhookSink(url, secret string) *WebhookSink {
+	return &WebhookSink{Url: url, Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *WebhookSink) Publish(ctx context.Context, msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "godocker-outbox/1")
+	req.Header.Set(webhook.EventHeader, msg.Type)
+	req.Header.Set(webhook.DeliveryHeader, strconv.FormatInt(msg.Id, 10))
+	req.Header.Set(webhook.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(p.Secret, timestamp, body))
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	//body is drained to reuse the connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//Broker - producer of a message broker such as Kafka or NATS.
+//Send must return after the broker acknowledged the message,
+//messages with the same key must go to the same partition to stay in order
+type Broker interface {
+	Send(ctx context.Context, topic, key string, value []byte) error
+}
+
+//BrokerSink sends messages as JSON to the topic keyed by id of the user
+type BrokerSink struct {
+	broker Broker
+	topic  string
+}
+
+func NewBrokerSink(broker Broker, topic string) *BrokerSink {
+	return &BrokerSink{broker: broker, topic: topic}
+}
+
+func (p *BrokerSink) Publish(ctx context.Context, msg *Message) error {
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.broker.Send(ctx, p.topic, msg.Key, value)
+}
+
+var errBadSink = errors.New("sink must be stdout, file:PATH or webhook:URL")
+
+//ParseSinks creates sinks from comma separated list of stdout, file:PATH
+//and webhook:URL, webhooks are signed with secret
+func ParseSinks(spec, secret string) ([]Sink, error) {
+	var result []Sink
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		kind, arg := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			kind, arg = item[:i], item[i+1:]
+		}
+		switch {
+		case item == "":
+		case kind == "stdout" && arg == "":
+			result = append(result, NewStdoutSink())
+		case kind == "file" && arg != "":
+			sink, err := OpenFileSink(arg)
+			if err != nil {
+				closeSinks(result)
+				return nil, err
+			}
+			result = append(result, sink)
+		case kind == "webhook":
+			u, err := url.Parse(arg)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				closeSinks(result)
+				return nil, fmt.Errorf("bad url of sink %q", item)
+			}
+			result = append(result, NewWebhookSink(arg, secret))
+		default:
+			closeSinks(result)
+			return nil, fmt.Errorf("%v, got %q", errBadSink, item)
+		}
+	}
+	return result, nil
+}
+
+//closeSinks closes sinks which hold resources, e.g. files
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/pkg/webhook"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessage(id int64) *Message {
+	return &Message{
+		Id:        id,
+		Key:       "6",
+		Type:      "user.created",
+		CreatedOn: time.Unix(10, 0).UTC(),
+		Payload:   json.RawMessage(`{"id":6,"name":"Kolya"}`),
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewWriterSink(buf)
+	sink.Publish(context.Background(), testMessage(1))
+	sink.Publish(context.Background(), testMessage(2))
+	expected := `{"id":1,"key":"6","type":"user.created","created_on":"1970-01-01T00:00:10Z","payload":{"id":6,"name":"Kolya"}}` + "\n" +
+		`{"id":2,"key":"6","type":"user.created","created_on":"1970-01-01T00:00:10Z","payload":{"id":6,"name":"Kolya"}}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %s got %s", expected, buf.String())
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+	for id := int64(1); id <= 2; id++ {
+		sink, err := OpenFileSink(path)
+		if err != nil {
+			t.Fatalf("expected nil got %v", err)
+		}
+		if err := sink.Publish(context.Background(), testMessage(id)); err != nil {
+			t.Errorf("expected nil got %v", err)
+		}
+		sink.Close()
+	}
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected 2 appended lines got %d", lines)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := http.StatusOK
+	var verifyErr error
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		verifyErr = webhook.Verify("shh", r.Header, body, time.Minute)
+		if r.Header.Get(webhook.EventHeader) != "user.created" || r.Header.Get(webhook.DeliveryHeader) != "1" {
+			t.Errorf("expected headers of message 1 got %v", r.Header)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	sink := NewWebhookSink(ts.URL, "shh")
+	if err := sink.Publish(context.Background(), testMessage(1)); err != nil || verifyErr != nil {
+		t.Errorf("expected nil got %v, %v", err, verifyErr)
+	}
+	status = http.StatusServiceUnavailable
+	if err := sink.Publish(context.Background(), testMessage(1)); err == nil {
+		t.Errorf("expected error on status %d", status)
+	}
+}
+
+type fakeBroker struct {
+	topic, key string
+	value      []byte
+}
+
+func (p *fakeBroker) Send(ctx context.Context, topic, key string, value []byte) error {
+	p.topic, p.key, p.value = topic, key, value
+	return nil
+}
+
+func TestBrokerSink(t *testing.T) {
+	broker := &fakeBroker{}
+	sink := NewBrokerSink(broker, "users")
+	if err := sink.Publish(context.Background(), testMessage(1)); err != nil {
+		t.Errorf("expected nil got %v", err)
+	}
+	if broker.topic != "users" || broker.key != "6" || !bytes.Contains(broker.value, []byte(`"id":1`)) {
+		t.Errorf("expected message 1 keyed by user got %s %s %s", broker.topic, broker.key, broker.value)
+	}
+}
+
+func TestParseSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	type TestCase struct {
+		Spec  string
+		Count int
+		Err   bool
+	}
+	tests := []TestCase{
+		{Spec: "stdout", Count: 1},
+		{Spec: "stdout, file:" + filepath.Join(dir, "events.ndjson") + ",webhook:http://localhost/hook", Count: 3},
+		{Spec: "webhook:localhost/hook", Err: true},
+		{Spec: "file:", Err: true},
+		{Spec: "kafka:users", Err: true},
+	}
+	for _, test := range tests {
+		sinks, err := ParseSinks(test.Spec, "shh")
+		if (err != nil) != test.Err || len(sinks) != test.Count {
+			t.Errorf("%s: expected %d sinks and error %v got %d, %v", test.Spec, test.Count, test.Err, len(sinks), err)
+		}
+		closeSinks(sinks)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxBatchSize = 1000
+	batchTimeout        = 30 * time.Second
+)
+
+var (
+	errBatchTooLarge = errors.New("batch is too large")
+	errEmailRepeated = errors.New("email is repeated in the batch")
+)
+
+func (p *Server) maxBatchSize() int {
+	if p.MaxBatchSize <= 0 {
+		return defaultMaxBatchSize
+	}
+	return p.MaxBatchSize
+}
+
+//POST method - /users:batch, body is JSON array or NDJSON stream of users
+func (p *Server) HandleInsertUsers(w http.ResponseWriter, r *http.Request) {
+	reqCodec, err := requestCodec(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	c, err := negotiateCodec(r, []api.BatchResult(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var items []json.RawMessage
+	switch reqCodec.(type) {
+	case ndjsonCodec:
+		items, err = readNDJSON(r.Body, p.maxBatchSize())
+	case jsonCodec:
+		items, err = readJSONArray(r.Body, p.maxBatchSize())
+	default:
+		http.Error(w, errUnsupportedMediaType.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err == errBatchTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results := make([]api.BatchResult, len(items))
+	users := make([]repository.User, 0, len(items))
+	indexes := make([]int, 0, len(items))
+	emails := make(map[string]bool, len(items))
+	for i, item := range items {
+		results[i].Index = i
+		input, err := decodeUserInput(item)
+		if err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = err.Error()
+			continue
+		}
+		//emails are unique regardless of case, only the first item keeps its email
+		email := strings.ToLower(input.Email)
+		if email != "" && emails[email] {
+			results[i].Status = http.StatusConflict
+			results[i].Error = errEmailRepeated.Error()
+			continue
+		}
+		emails[email] = true
+		users = append(users, repository.User{PublicUser: fromAPIUser(&input)})
+		indexes = append(indexes, i)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), batchTimeout)
+	defer cancel()
+	errs := make([]error, len(users))
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, exit chan<- error) {
+		if len(users) == 0 {
+			exit <- nil
+			return
+		}
+		err := p.db.InsertUsers(insideCtx, users)
+		if err == repository.ErrEmailTaken {
+			//some emails belong to stored users, nothing is inserted,
+			//so users are inserted one by one and only those items fail
+			for n := range users {
+				users[n].PrivateUser = repository.PrivateUser{}
+				errs[n] = p.db.InsertUser(insideCtx, &users[n])
+			}
+			err = nil
+		}
+		exit <- err
+	}(ctx, exitRequest)
+	select {
+	case err := <-exitRequest:
+		status := http.StatusCreated
+		for n, i := range indexes {
+			itemErr := err
+			if itemErr == nil {
+				itemErr = errs[n]
+			}
+			if itemErr != nil {
+				results[i].Status = writeErrorStatus(itemErr)
+				results[i].Error = itemErr.Error()
+				continue
+			}
+			results[i].Status = http.StatusCreated
+			results[i].User = toAPIUser(&users[n])
+		}
+		for _, v := range results {
+			if v.Status != http.StatusCreated {
+				status = http.StatusMultiStatus
+			}
+		}
+		encodeResponse(w, c, status, results)
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+func decodeUserInput(data []byte) (api.UserInput, error) {
+	var input api.UserInput
+	if err := (jsonCodec{}).Decode(bytes.NewReader(data), &input); err != nil {
+		return input, err
+	}
+	return input, validateUser(&input)
+}
+
+func readJSONArray(body io.Reader, max int) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(body)
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected JSON array")
+	}
+	var items []json.RawMessage
+	for decoder.More() {
+		if len(items) == max {
+			return nil, errBatchTooLarge
+		}
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func readNDJSON(body io.Reader, max int) ([]json.RawMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var items []json.RawMessage
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == max {
+			return nil, errBatchTooLarge
+		}
+		items = append(items, append(json.RawMessage(nil), line...))
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"expvar"
+	"github.com/NektarinR/godocker/internal/cache"
+	"net/http"
+)
+
+//useUserCache puts the cache of users in front of the repository,
+//counters of the cache are published as user_cache of expvar
+func (p *Server) useUserCache() {
+	if p.db == nil || p.UserCacheSize <= 0 {
+		return
+	}
+	cached := cache.NewRepository(p.db, cache.NewLRU(p.UserCacheSize))
+	if p.UserCacheTTL > 0 {
+		cached.TTL = p.UserCacheTTL
+	}
+	p.db = cached
+	expvar.Publish("user_cache", expvar.Func(func() interface{} {
+		return cached.Stats()
+	}))
+}
+
+//GET method - /debug/vars, counters of the process in expvar format, admin only
+func (p *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/internal/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_HandleMetrics(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	w := adminRequest(t, srv, "GET", "/debug/vars", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"memstats"`) {
+		t.Errorf("expected counters got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/debug/vars", nil)
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/vmihailenco/msgpack/v4"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	errNotAcceptable        = errors.New("not acceptable")
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errUnsupportedValue     = errors.New("value is not supported by codec")
+)
+
+//codec encodes responses and decodes requests of one format,
+//the first media type is sent in Content-Type
+type codec interface {
+	MediaTypes() []string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+//streamCodec is a codec which can write users one by one
+type streamCodec interface {
+	codec
+	NewUserStream(w *bufio.Writer) (userEncoder, error)
+}
+
+//codecs in order of preference, the first one is used if client accepts anything
+var codecs = []codec{
+	jsonCodec{},
+	xmlCodec{},
+	csvCodec{},
+	msgpackCodec{},
+	ndjsonCodec{},
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) MediaTypes() []string {
+	return []string{"application/json"}
+}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	encode, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encode)
+	return err
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+type ndjsonCodec struct{}
+
+func (ndjsonCodec) MediaTypes() []string {
+	return []string{"application/x-ndjson"}
+}
+
+func (ndjsonCodec) Encode(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return encoder.Encode(v)
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := encoder.Encode(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ndjsonCodec) Decode(r io.Reader, v interface{}) error {
+	return jsonCodec{}.Decode(r, v)
+}
+
+func (ndjsonCodec) NewUserStream(w *bufio.Writer) (userEncoder, error) {
+	return newNDJSONEncoder(w), nil
+}
+
+type xmlCodec struct{}
+
+func (xmlCodec) MediaTypes() []string {
+	return []string{"application/xml", "text/xml"}
+}
+
+//Encode writes lists as <users><user>...</user></users>
+func (xmlCodec) Encode(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return encoder.EncodeElement(v, xmlElement(rv.Type()))
+	}
+	item := xmlElement(rv.Type().Elem())
+	root := xml.StartElement{Name: xml.Name{Local: item.Name.Local + "s"}}
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := encoder.EncodeElement(rv.Index(i).Interface(), item); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+func (xmlCodec) Decode(r io.Reader, v interface{}) error {
+	return xml.NewDecoder(r).Decode(v)
+}
+
+//xmlElement names element after the type: api.UserAudit - userAudit
+func xmlElement(t reflect.Type) xml.StartElement {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := []rune(t.Name())
+	if len(name) > 0 {
+		name[0] = unicode.ToLower(name[0])
+	}
+	return xml.StartElement{Name: xml.Name{Local: string(name)}}
+}
+
+//csvCodec supports only lists of users
+type csvCodec struct{}
+
+func (csvCodec) MediaTypes() []string {
+	return []string{"text/csv"}
+}
+
+func (c csvCodec) Encode(w io.Writer, v interface{}) error {
+	users, ok := v.([]api.User)
+	if !ok {
+		return errUnsupportedValue
+	}
+	buf := bufio.NewWriter(w)
+	enc, err := c.NewUserStream(buf)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if err := enc.Encode(&users[i]); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+func (csvCodec) Decode(r io.Reader, v interface{}) error {
+	return errUnsupportedMediaType
+}
+
+func (csvCodec) NewUserStream(w *bufio.Writer) (userEncoder, error) {
+	return newCSVEncoder(w)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaTypes() []string {
+	return []string{"application/msgpack", "application/x-msgpack"}
+}
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).UseJSONTag(true).Encode(v)
+}
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	decoder := msgpack.NewDecoder(r).UseJSONTag(true)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func supportsValue(c codec, v interface{}) bool {
+	if _, ok := c.(csvCodec); ok {
+		_, ok := v.([]api.User)
+		return ok
+	}
+	return true
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []acceptRange {
+	var result []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if tmp, err := strconv.ParseFloat(v, 64); err == nil {
+				q = tmp
+			}
+		}
+		if q > 0 {
+			result = append(result, acceptRange{mediaType: mediaType, q: q})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].q > result[j].q
+	})
+	return result
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+//negotiateCodec chooses codec by Accept header which is able to encode v,
+//v may be a typed nil, only its type matters
+func negotiateCodec(r *http.Request, v interface{}) (codec, error) {
+	header := strings.TrimSpace(r.Header.Get("Accept"))
+	if header == "" {
+		header = "*/*"
+	}
+	for _, accept := range parseAccept(header) {
+		for _, c := range codecs {
+			if !supportsValue(c, v) {
+				continue
+			}
+			for _, mediaType := range c.MediaTypes() {
+				if matchMediaType(accept.mediaType, mediaType) {
+					return c, nil
+				}
+			}
+		}
+	}
+	return nil, errNotAcceptable
+}
+
+//streamCodecs in order of preference
+var streamCodecs = []streamCodec{
+	ndjsonCodec{},
+	csvCodec{},
+}
+
+//negotiateStream chooses codec for streaming users by Accept header
+func negotiateStream(r *http.Request) (streamCodec, error) {
+	header := strings.TrimSpace(r.Header.Get("Accept"))
+	if header == "" {
+		header = "*/*"
+	}
+	for _, accept := range parseAccept(header) {
+		for _, c := range streamCodecs {
+			for _, mediaType := range c.MediaTypes() {
+				if matchMediaType(accept.mediaType, mediaType) {
+					return c, nil
+				}
+			}
+		}
+	}
+	return nil, errNotAcceptable
+}
+
+//requestCodec chooses codec by Content-Type, JSON is used if it is missing
+func requestCodec(r *http.Request) (codec, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return jsonCodec{}, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil, errUnsupportedMediaType
+	}
+	for _, c := range codecs {
+		for _, v := range c.MediaTypes() {
+			if v == mediaType {
+				return c, nil
+			}
+		}
+	}
+	return nil, errUnsupportedMediaType
+}
+
+//decodeRequest decodes body with codec chosen by Content-Type
+func decodeRequest(r *http.Request, body io.Reader, v interface{}) error {
+	c, err := requestCodec(r)
+	if err != nil {
+		return err
+	}
+	return c.Decode(body, v)
+}
+
+func decodeErrorStatus(err error) int {
+	if err == errUnsupportedMediaType {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+func encodeBody(c codec, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.Encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//encodeResponse is the only way handlers write bodies
+func encodeResponse(w http.ResponseWriter, c codec, status int, v interface{}) {
+	encode, err := encodeBody(c, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", c.MediaTypes()[0])
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(encode)
+}
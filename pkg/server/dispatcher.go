@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/NektarinR/godocker/pkg/outbox"
+	"github.com/NektarinR/godocker/pkg/webhook"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookAttempts  = 8
+	defaultWebhookRetryWait = 10 * time.Second
+	maxWebhookRetryWait     = time.Hour
+	//deliveryTimeout - time given to a receiver to answer
+	deliveryTimeout = 10 * time.Second
+	//deliveryLease - claimed deliveries are hidden from other dispatchers meanwhile,
+	//it must be longer than deliveryTimeout
+	deliveryLease = time.Minute
+	//deliveryPoll - interval of looking for deliveries which are due to retry
+	deliveryPoll   = time.Second
+	deliveryBatch  = 100
+	deliveryWorker = 4
+)
+
+//dispatcher is a sink of the outbox, it turns published changes into webhook
+//deliveries and sends them. Deliveries are stored before they are sent,
+//so retries survive restarts
+type dispatcher struct {
+	db          repository.IRepository
+	client      *http.Client
+	maxAttempts int
+	retryWait   time.Duration
+	poll        time.Duration
+	//due wakes run when deliveries are stored
+	due chan struct{}
+}
+
+func (p *Server) newDispatcher() *dispatcher {
+	result := &dispatcher{
+		db:          p.db,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		maxAttempts: p.WebhookAttempts,
+		retryWait:   p.WebhookRetryWait,
+		poll:        deliveryPoll,
+		due:         make(chan struct{}, 1),
+	}
+	if result.maxAttempts <= 0 {
+		result.maxAttempts = defaultWebhookAttempts
+	}
+	if result.retryWait <= 0 {
+		result.retryWait = defaultWebhookRetryWait
+	}
+	return result
+}
+
+//run delivers webhooks until stop is closed
+func (p *dispatcher) run(stop <-chan struct{}) {
+	if p.db == nil {
+		return
+	}
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.due:
+			p.deliverDue()
+		case <-ticker.C:
+			p.deliverDue()
+		case <-stop:
+			return
+		}
+	}
+}
+
+//Publish stores deliveries of the outbox message for all webhooks subscribed to it,
+//the relay publishes the message again if any of them is not stored
+func (p *dispatcher) Publish(ctx context.Context, msg *outbox.Message) error {
+	hooks, err := p.db.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	changeType := strings.TrimPrefix(msg.Type, "user.")
+	var payload []byte
+	for _, hook := range hooks {
+		if !hook.Accepts(changeType) {
+			continue
+		}
+		if payload == nil {
+			var user repository.User
+			if err := json.Unmarshal(msg.Payload, &user); err != nil {
+				return err
+			}
+			payload, err = json.Marshal(api.WebhookEvent{
+				Id:        msg.Id,
+				Event:     msg.Type,
+				CreatedOn: msg.CreatedOn,
+				User:      *toAPIUser(&user),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		delivery := &repository.WebhookDelivery{
+			WebhookId:     hook.Id,
+			EventId:       msg.Id,
+			Event:         msg.Type,
+			Payload:       payload,
+			Status:        repository.DeliveryPending,
+			NextAttemptOn: time.Now(),
+		}
+		if err := p.db.InsertDelivery(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	if payload != nil {
+		select {
+		case p.due <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//deliverDue sends claimed deliveries with a few workers,
+//deliveries of one webhook are sent by the same worker in order
+func (p *dispatcher) deliverDue() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		deliveries, err := p.db.ClaimDeliveries(ctx, time.Now(), deliveryLease, deliveryBatch)
+		cancel()
+		if err != nil {
+			log.Printf("Ошибка при чтении вебхуков %v\n", err)
+			return
+		}
+		jobs := make([][]*repository.WebhookDelivery, deliveryWorker)
+		for i := range deliveries {
+			worker := deliveries[i].WebhookId % deliveryWorker
+			jobs[worker] = append(jobs[worker], &deliveries[i])
+		}
+		var wg sync.WaitGroup
+		for _, job := range jobs {
+			wg.Add(1)
+			go func(job []*repository.WebhookDelivery) {
+				defer wg.Done()
+				for _, delivery := range job {
+					p.deliver(delivery)
+				}
+			}(job)
+		}
+		wg.Wait()
+		if len(deliveries) < deliveryBatch {
+			return
+		}
+	}
+}
+
+//deliver makes one attempt and stores its outcome
+func (p *dispatcher) deliver(delivery *repository.WebhookDelivery) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	hook, err := p.db.GetWebhook(ctx, delivery.WebhookId)
+	if err != nil {
+		//webhook is deleted together with its deliveries
+		return
+	}
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+	if !hook.Active {
+		delivery.Error = "webhook is not active"
+	} else {
+		delivery.ResponseCode, err = p.send(ctx, hook, delivery)
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+	}
+	now := time.Now()
+	switch {
+	case delivery.Error == "":
+		delivery.Status = repository.DeliverySucceeded
+		delivery.DeliveredOn = &now
+	case delivery.Attempts >= p.maxAttempts || !hook.Active:
+		delivery.Status = repository.DeliveryDead
+	default:
+		delivery.NextAttemptOn = now.Add(p.backoff(delivery.Attempts - 1))
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.db.UpdateDelivery(ctx, delivery); err != nil {
+		log.Printf("Ошибка при сохранении вебхука %v\n", err)
+	}
+}
+
+//send posts the payload, any status but 2xx is an error
+func (p *dispatcher) send(ctx context.Context, hook *repository.Webhook, delivery *repository.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "godocker-webhook/1")
+	req.Header.Set(webhook.EventHeader, delivery.Event)
+	req.Header.Set(webhook.DeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(webhook.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(hook.Secret, timestamp, delivery.Payload))
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	//body is drained to reuse the connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+//backoff - retryWait*2^attempt with jitter
+func (p *dispatcher) backoff(attempt int) time.Duration {
+	wait := p.retryWait << uint(attempt)
+	if wait <= 0 || wait > maxWebhookRetryWait {
+		wait = maxWebhookRetryWait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
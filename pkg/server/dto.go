@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+)
+
+func toAPIUser(usr *repository.User) *api.User {
+	result := &api.User{
+		Id:        usr.Id,
+		Name:      usr.Name,
+		Email:     usr.Email,
+		Status:    usr.Status,
+		CreatedOn: usr.CreateOn.UTC(),
+		UpdatedOn: usr.UpdatedOn.UTC(),
+		Version:   usr.Version,
+		Metadata:  usr.Metadata,
+	}
+	if usr.DeletedOn != nil {
+		deletedOn := usr.DeletedOn.UTC()
+		result.DeletedOn = &deletedOn
+	}
+	return result
+}
+
+func toAPIUsers(users []repository.User) []api.User {
+	result := make([]api.User, len(users))
+	for i := range users {
+		result[i] = *toAPIUser(&users[i])
+	}
+	return result
+}
+
+func toAPIAudits(audits []repository.UserAudit) []api.UserAudit {
+	result := make([]api.UserAudit, len(audits))
+	for i, v := range audits {
+		result[i] = api.UserAudit{
+			Id:        v.Id,
+			UserId:    v.UserId,
+			Action:    v.Action,
+			Actor:     v.Actor,
+			RequestId: v.RequestId,
+			Before:    v.Before,
+			After:     v.After,
+			Diff:      v.Diff,
+			CreatedOn: v.CreateOn.UTC(),
+		}
+	}
+	return result
+}
+
+func fromAPIUser(input *api.UserInput) repository.PublicUser {
+	return repository.PublicUser{
+		Name:     input.Name,
+		Email:    input.Email,
+		Status:   input.Status,
+		Metadata: input.Metadata,
+	}
+}
+
+//toAPIWebhook omits the secret, it is shown only on creation
+func toAPIWebhook(hook *repository.Webhook) *api.Webhook {
+	return &api.Webhook{
+		Id:        hook.Id,
+		Url:       hook.Url,
+		Events:    append([]string{}, hook.Events...),
+		Active:    hook.Active,
+		CreatedOn: hook.CreateOn.UTC(),
+	}
+}
+
+func toAPIDelivery(delivery *repository.WebhookDelivery) *api.WebhookDelivery {
+	result := &api.WebhookDelivery{
+		Id:           delivery.Id,
+		WebhookId:    delivery.WebhookId,
+		EventId:      delivery.EventId,
+		Event:        delivery.Event,
+		Status:       delivery.Status,
+		Attempts:     delivery.Attempts,
+		ResponseCode: delivery.ResponseCode,
+		Error:        delivery.Error,
+		CreatedOn:    delivery.CreateOn.UTC(),
+	}
+	if delivery.Status == repository.DeliveryPending {
+		nextAttemptOn := delivery.NextAttemptOn.UTC()
+		result.NextAttemptOn = &nextAttemptOn
+	}
+	if delivery.DeliveredOn != nil {
+		deliveredOn := delivery.DeliveredOn.UTC()
+		result.DeliveredOn = &deliveredOn
+	}
+	return result
+}
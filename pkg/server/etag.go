@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/NektarinR/godocker/internal/repository"
+	"strconv"
+	"strings"
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+func userETag(usr *repository.User) string {
+	return `"` + strconv.Itoa(usr.Version) + `"`
+}
+
+//etagVersion parses the version of a user from its strong ETag
+func etagVersion(etag string) (int, bool) {
+	if len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	value := etag[1 : len(etag)-1]
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 || strconv.Itoa(version) != value {
+		return 0, false
+	}
+	return version, true
+}
+
+//usersETag - ETag of a page of users made of their ids and versions, so the page
+//changes when a user is changed, deleted or moved in or out of the page.
+//Time of the last change would miss deletes
+func usersETag(users []repository.User) string {
+	h := sha256.New()
+	for i := range users {
+		fmt.Fprintf(h, "%d:%d,", users[i].Id, users[i].Version)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+//etagMatches reports whether If-Match header value matches etag by strong
+//comparison: weak validators are never equal to the strong etag
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//etagMatchesWeak reports whether If-None-Match header value matches etag by weak
+//comparison (RFC 7232 section 3.2): W/"3" matches "3"
+func etagMatchesWeak(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
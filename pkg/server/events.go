@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/NektarinR/godocker/internal/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	//eventsHeartbeat - interval of comments which keep idle streams open behind proxies
+	eventsHeartbeat = 15 * time.Second
+	//eventsBuffer - changes waiting for a slow client before its stream is closed,
+	//the client reconnects with Last-Event-ID and gets them from the bus history
+	eventsBuffer = 64
+	//eventsRetry - reconnection delay suggested to EventSource
+	eventsRetry = 3 * time.Second
+)
+
+//GET method - /users/events, Server-Sent Events with created, updated
+//and deleted users. Last-Event-ID header or last_event_id parameter resumes
+//the stream, event reset is sent if some changes are lost since then
+func (p *Server) HandleUserEvents(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	lastId := int64(-1)
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value != "" {
+		var err error
+		lastId, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || lastId < 0 {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	sub, missed, complete := p.db.Changes().Subscribe(lastId, eventsBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	stream := newStreamWriter(w, r)
+	buf := bufio.NewWriter(stream)
+	flush := func() error {
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		stream.Flush()
+		return nil
+	}
+	fmt.Fprintf(buf, "retry: %d\n\n", eventsRetry/time.Millisecond)
+	if !complete {
+		fmt.Fprint(buf, "event: reset\ndata: {}\n\n")
+	}
+	for i := range missed {
+		if err := writeUserEvent(buf, &missed[i]); err != nil {
+			return
+		}
+	}
+	if err := flush(); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-sub.C():
+			if !ok {
+				//client is too slow, it resumes from the last received event
+				return
+			}
+			if err := writeUserEvent(buf, &change); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(buf, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-p.stopping():
+			return
+		}
+		if err := flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeUserEvent(w *bufio.Writer, change *repository.Change) error {
+	data, err := json.Marshal(toAPIUser(&change.User))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Id, change.Type, data)
+	return err
+}
+
+//stopping is closed when the server shuts down, long-lived streams end on it
+func (p *Server) stopping() <-chan struct{} {
+	p.stopOnce.Do(func() {
+		p.stop = make(chan struct{})
+	})
+	return p.stop
+}
+
+func (p *Server) stopStreams() {
+	p.stopping()
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	Id   string
+	Type string
+	Data string
+}
+
+//readEvent reads the next event from stream, comments and retry are skipped
+func readEvent(t *testing.T, r *bufio.Reader) *sseEvent {
+	event := &sseEvent{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected event, got %v\n", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.Data != "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.Id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openEvents(t *testing.T, url, lastId string) *http.Response {
+	req, _ := http.NewRequest("GET", url+"/users/events", nil)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %v\n", ct)
+	}
+	return resp
+}
+
+func TestServer_HandleUserEvents(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp := openEvents(t, ts.URL, "")
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	post, err := http.Post(ts.URL+"/users/", "application/json", strings.NewReader(`{"name":"Kolya"}`))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	post.Body.Close()
+	req, _ := http.NewRequest("DELETE", ts.URL+"/users/1", nil)
+	del, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	del.Body.Close()
+
+	expected := []sseEvent{{Id: "1", Type: "created"}, {Id: "2", Type: "deleted"}}
+	for _, want := range expected {
+		event := readEvent(t, events)
+		if event.Id != want.Id || event.Type != want.Type {
+			t.Errorf("expected event %s %s, got %s %s\n", want.Id, want.Type, event.Id, event.Type)
+		}
+		var usr api.User
+		if err := json.Unmarshal([]byte(event.Data), &usr); err != nil {
+			t.Errorf("expected nil, got %v\n", err)
+		}
+	}
+
+	//resume after the first event replays the second one
+	resumed := openEvents(t, ts.URL, "1")
+	defer resumed.Body.Close()
+	event := readEvent(t, bufio.NewReader(resumed.Body))
+	if event.Id != "2" || event.Type != "deleted" || !strings.Contains(event.Data, `"deleted_on"`) {
+		t.Errorf("expected deleted event 2, got %v\n", event)
+	}
+}
+
+func TestServer_HandleUserEvents_Reset(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	ts := httptest.NewServer(NewServer(db))
+	defer ts.Close()
+	resp := openEvents(t, ts.URL, "42")
+	defer resp.Body.Close()
+	if event := readEvent(t, bufio.NewReader(resp.Body)); event.Type != "reset" {
+		t.Errorf("expected reset event, got %v\n", event)
+	}
+}
+
+func TestServer_HandleUserEvents_BadLastEventID(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServer_HandleUserEvents_Shutdown(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	resp := openEvents(t, ts.URL, "")
+	defer resp.Body.Close()
+	srv.stopStreams()
+	srv.stopStreams()
+	events := bufio.NewReader(resp.Body)
+	for {
+		if _, err := events.ReadString('\n'); err != nil {
+			break
+		}
+	}
+}
+
+func TestServer_HandleUserEvents_WriteTimeout(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	ts := httptest.NewUnstartedServer(srv)
+	ts.Config = newHTTPServer("", srv)
+	ts.Config.WriteTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+	resp := openEvents(t, ts.URL, "")
+	defer resp.Body.Close()
+	//the stream outlives WriteTimeout of the server
+	time.Sleep(300 * time.Millisecond)
+	post, err := http.Post(ts.URL+"/users/", "application/json", strings.NewReader(`{"name":"Kolya"}`))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	post.Body.Close()
+	if event := readEvent(t, bufio.NewReader(resp.Body)); event.Type != "created" {
+		t.Errorf("expected created event, got %v\n", event)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//exportFlushRows - rows written between flushes to the client
+const exportFlushRows = 100
+
+type userEncoder interface {
+	Encode(usr *api.User) error
+	Flush() error
+}
+
+type ndjsonEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w *bufio.Writer) *ndjsonEncoder {
+	return &ndjsonEncoder{buf: w, enc: json.NewEncoder(w)}
+}
+
+func (p *ndjsonEncoder) Encode(usr *api.User) error {
+	return p.enc.Encode(usr)
+}
+
+func (p *ndjsonEncoder) Flush() error {
+	return p.buf.Flush()
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w *bufio.Writer) (*csvEncoder, error) {
+	enc := &csvEncoder{w: csv.NewWriter(w)}
+	err := enc.w.Write([]string{"id", "name", "email", "status", "created_on", "updated_on", "version", "deleted_on"})
+	return enc, err
+}
+
+func (p *csvEncoder) Encode(usr *api.User) error {
+	deletedOn := ""
+	if usr.DeletedOn != nil {
+		deletedOn = usr.DeletedOn.Format(time.RFC3339Nano)
+	}
+	return p.w.Write([]string{
+		strconv.Itoa(usr.Id),
+		usr.Name,
+		usr.Email,
+		usr.Status,
+		usr.CreatedOn.Format(time.RFC3339Nano),
+		usr.UpdatedOn.Format(time.RFC3339Nano),
+		strconv.Itoa(usr.Version),
+		deletedOn,
+	})
+}
+
+func (p *csvEncoder) Flush() error {
+	p.w.Flush()
+	return p.w.Error()
+}
+
+//parseUserFilter reads name, email, status, updated_since (RFC 3339)
+//and metadata (JSON object the metadata must contain) of the query
+func parseUserFilter(query url.Values) (repository.UserFilter, error) {
+	filter := repository.UserFilter{
+		Name:   query.Get("name"),
+		Email:  strings.TrimSpace(query.Get("email")),
+		Status: query.Get("status"),
+	}
+	if err := repository.ValidateStatus(filter.Status); err != nil {
+		return filter, err
+	}
+	if since := query.Get("updated_since"); since != "" {
+		tmp, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return filter, errors.New("bad updated_since")
+		}
+		filter.UpdatedSince = tmp
+	}
+	if metadata := query.Get("metadata"); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &filter.Metadata); err != nil || filter.Metadata == nil {
+			return filter, errors.New("metadata must be a JSON object")
+		}
+	}
+	return filter, nil
+}
+
+//GET method - /users/export?name=vasy&status=active, format is chosen by Accept:
+//text/csv or application/x-ndjson (default)
+func (p *Server) HandleExportUsers(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.deletedScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), deletedScopeStatus(err))
+		return
+	}
+	c, err := negotiateStream(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	filter, err := parseUserFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stream := newStreamWriter(w, r)
+	buf := bufio.NewWriter(stream)
+	w.Header().Set("Content-Type", c.MediaTypes()[0])
+	w.Header().Set("Vary", "Accept")
+	enc, err := c.NewUserStream(buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flush := func() error {
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		stream.Flush()
+		return nil
+	}
+	rows := 0
+	//r.Context() is canceled when client goes away, that stops the cursor
+	err = p.db.ExportUsers(scope, filter, func(usr *repository.User) error {
+		if err := enc.Encode(toAPIUser(usr)); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		//headers are already sent, the only thing left is to break the stream
+		log.Printf("export stopped after %d rows: %v\n", rows, err)
+		return
+	}
+	if err := flush(); err != nil {
+		log.Printf("export stopped after %d rows: %v\n", rows, err)
+	}
+}
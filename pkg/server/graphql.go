@@ -0,0 +1,15 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/pkg/graphqlapi"
+	"net/http"
+)
+
+//POST method - /graphql, the handler is created on the first request
+//because db may be set after InitRouters
+func (p *Server) HandleGraphQL(w http.ResponseWriter, r *http.Request) {
+	p.graphqlOnce.Do(func() {
+		p.graphql = graphqlapi.NewHandler(p.db, p.isAdmin)
+	})
+	p.graphql.ServeHTTP(w, r)
+}
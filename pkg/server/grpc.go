@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/pkg/grpcapi"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"net/http"
+	"strings"
+)
+
+//sharesPort tells if gRPC is served on the HTTP port
+func (p *Server) sharesPort(port int) bool {
+	return p.GRPCPort == 0 || p.GRPCPort == port
+}
+
+//handler returns root handler of the HTTP port: the API, the gateway if it
+//is enabled and gRPC if grpcSrv is not nil. gRPC is told apart by HTTP/2
+//with application/grpc content type, cleartext HTTP/2 is accepted for it
+func (p *Server) handler(grpcSrv *grpc.Server, users *grpcapi.UserServer) http.Handler {
+	var handler http.Handler = p.mux
+	if p.GRPCGateway {
+		root := http.NewServeMux()
+		root.Handle("/v1/", grpcapi.NewGateway(grpcapi.NewLocalClient(users)))
+		root.Handle("/", p.mux)
+		handler = root
+	}
+	if grpcSrv == nil {
+		return handler
+	}
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcSrv.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
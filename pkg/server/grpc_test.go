@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_GRPCSharesPort(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.GRPCGateway = true
+	users := grpcapi.NewUserServer(db, "")
+	grpcSrv := grpcapi.NewServer(users)
+	defer grpcSrv.Stop()
+	ts := httptest.NewServer(srv.handler(grpcSrv, users))
+	defer ts.Close()
+
+	conn, err := grpc.Dial(strings.TrimPrefix(ts.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	defer conn.Close()
+	usr, err := grpcapi.NewUserServiceClient(conn).GetUser(context.Background(), &grpcapi.GetUserRequest{Id: 1})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if usr.Name != "Vasy" {
+		t.Errorf("expected Vasy, got %v\n", usr)
+	}
+
+	for _, url := range []string{"/ping", "/users/1", "/v1/ping"} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: wrong responce code, got %d expected %d\n", url, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestServer_SharesPort(t *testing.T) {
+	testCases := []struct {
+		GRPCPort int
+		Shares   bool
+	}{
+		{0, true},
+		{8081, true},
+		{9090, false},
+	}
+	for _, testCase := range testCases {
+		srv := Server{GRPCPort: testCase.GRPCPort}
+		if srv.sharesPort(8081) != testCase.Shares {
+			t.Errorf("GRPCPort %d: expected %v\n", testCase.GRPCPort, testCase.Shares)
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
 	mx "github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
+)
+
+var (
+	errBadIncludeDeleted = errors.New("bad include_deleted")
+	errForbidden         = errors.New("forbidden")
 )
 
 func (p *Server) HandlePing(w http.ResponseWriter, r *http.Request) {
@@ -24,13 +31,24 @@ func (p *Server) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ctx, _ := context.WithTimeout(r.Context(), 2*time.Second)
+	scope, err := p.deletedScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), deletedScopeStatus(err))
+		return
+	}
+	c, err := negotiateCodec(r, []api.User(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(scope, repository.RequestTimeout)
+	defer cancel()
 	usrRes := make(chan []repository.User, 1)
 	exitRequest := make(chan struct{}, 1)
 	go func(insideCtx context.Context, res chan<- []repository.User, exit chan<- struct{}) {
 		usrs, err := p.db.Fetch(insideCtx, offset, limit)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), dbErrorStatus(err))
 			exit <- struct{}{}
 			return
 		}
@@ -40,13 +58,13 @@ func (p *Server) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
 	case <-exitRequest:
 		return
 	case users := <-usrRes:
-		result, err := json.Marshal(users)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		etag := usersETag(users)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && etagMatchesWeak(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(result)
+		encodeResponse(w, c, http.StatusOK, toAPIUsers(users))
 	case <-ctx.Done():
 		http.Error(w, "server is busy", http.StatusInternalServerError)
 		return
@@ -55,30 +73,70 @@ func (p *Server) HandleGetUsers(w http.ResponseWriter, r *http.Request) {
 
 //POST method - /users/
 func (p *Server) HandleInsertUser(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	var pubUsr repository.PublicUser
-	err := decoder.Decode(&pubUsr)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var input api.UserInput
+	err = decodeRequest(r, bytes.NewReader(body), &input)
+	if err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	if err := validateUser(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.User)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	key := strings.TrimSpace(r.Header.Get(idempotencyHeader))
+	if key != "" {
+		stored, err := p.reserveIdempotencyKey(ctx, key, requestFingerprint(r, c.MediaTypes()[0], body))
+		if err != nil {
+			http.Error(w, err.Error(), idempotencyErrorStatus(err))
+			return
+		}
+		if stored != nil {
+			replayIdempotencyKey(w, stored)
+			return
+		}
+	}
 	usr := &repository.User{
-		PublicUser: pubUsr,
+		PublicUser: fromAPIUser(&input),
 	}
-	tmpUsr := make(chan struct{}, 1)
-	ctx, _ := context.WithTimeout(r.Context(), 2*time.Second)
-	go func(insideCtx context.Context, res chan<- struct{}) {
+	tmpUsr := make(chan []byte, 1)
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, res chan<- []byte, exit chan<- error) {
 		err := p.db.InsertUser(insideCtx, usr)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			p.releaseIdempotencyKey(key)
+			exit <- err
+			return
+		}
+		encode, err := encodeBody(c, toAPIUser(usr))
+		if err != nil {
+			p.releaseIdempotencyKey(key)
+			exit <- err
 			return
 		}
-		res <- struct{}{}
-	}(ctx, tmpUsr)
+		p.completeIdempotencyKey(key, http.StatusCreated, createdHeader(c, usr), encode)
+		res <- encode
+	}(ctx, tmpUsr, exitRequest)
 	select {
-	case <-tmpUsr:
-		w.WriteHeader(http.StatusOK)
+	case err := <-exitRequest:
+		http.Error(w, err.Error(), writeErrorStatus(err))
+	case encode := <-tmpUsr:
+		for k, v := range createdHeader(c, usr) {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(encode)
 	case <-ctx.Done():
 		http.Error(w, "server is busy", http.StatusInternalServerError)
 		return
@@ -93,13 +151,24 @@ func (p *Server) HandleGetUserById(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad id", http.StatusBadRequest)
 		return
 	}
-	ctx, _ := context.WithTimeout(r.Context(), 2*time.Second)
+	scope, err := p.deletedScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), deletedScopeStatus(err))
+		return
+	}
+	c, err := negotiateCodec(r, (*api.User)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(scope, repository.RequestTimeout)
+	defer cancel()
 	userChan := make(chan *repository.User, 1)
 	exitRequest := make(chan struct{}, 1)
 	go func(insideCtx context.Context, res chan<- *repository.User, exit chan<- struct{}) {
 		usr, err := p.db.GetUserById(ctx, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), writeErrorStatus(err))
 			exit <- struct{}{}
 			return
 		}
@@ -109,19 +178,316 @@ func (p *Server) HandleGetUserById(w http.ResponseWriter, r *http.Request) {
 	case <-exitRequest:
 		return
 	case usr := <-userChan:
-		encode, err := json.Marshal(usr)
+		etag := userETag(usr)
+		w.Header().Set("ETag", etag)
+		modified := userLastModified(usr)
+		setLastModified(w, modified)
+		//If-Modified-Since is ignored if If-None-Match is sent
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			if etagMatchesWeak(match, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if notModifiedSince(r, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		encodeResponse(w, c, http.StatusOK, toAPIUser(usr))
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+//PUT method - /users/{id}
+func (p *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	var input api.UserInput
+	if err := decodeRequest(r, r.Body, &input); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	reqCodec, _ := requestCodec(r)
+	_, keepMetadata := reqCodec.(xmlCodec)
+	if err := validateUser(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.User)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	match := r.Header.Get("If-Match")
+	userChan := make(chan *repository.User, 1)
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, res chan<- *repository.User, exit chan<- error) {
+		version, err := p.matchVersion(insideCtx, id, match)
 		if err != nil {
-			http.Error(w, "can't json", http.StatusInternalServerError)
+			exit <- err
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(encode)
+		usr := &repository.User{
+			PrivateUser: repository.PrivateUser{Id: id, Version: version},
+			PublicUser:  fromAPIUser(&input),
+		}
+		if keepMetadata {
+			//xml can't carry metadata, the stored one is kept, the version
+			//guards it against a concurrent change
+			stored, err := p.db.GetUserById(repository.WithPrimary(insideCtx), id)
+			if err != nil {
+				exit <- err
+				return
+			}
+			usr.Metadata = stored.Metadata
+			if usr.Version == 0 {
+				usr.Version = stored.Version
+			}
+		}
+		if err := p.db.UpdateUser(insideCtx, usr); err != nil {
+			exit <- matchError(err, match)
+			return
+		}
+		res <- usr
+	}(ctx, userChan, exitRequest)
+	select {
+	case err := <-exitRequest:
+		http.Error(w, err.Error(), writeErrorStatus(err))
+	case usr := <-userChan:
+		w.Header().Set("ETag", userETag(usr))
+		encodeResponse(w, c, http.StatusOK, toAPIUser(usr))
 	case <-ctx.Done():
 		http.Error(w, "server is busy", http.StatusInternalServerError)
 		return
 	}
 }
 
+//DELETE method - /users/{id}
+func (p *Server) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	match := r.Header.Get("If-Match")
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, exit chan<- error) {
+		version, err := p.matchVersion(insideCtx, id, match)
+		if err != nil {
+			exit <- err
+			return
+		}
+		exit <- matchError(p.db.DeleteUser(insideCtx, id, version), match)
+	}(ctx, exitRequest)
+	select {
+	case err := <-exitRequest:
+		if err != nil {
+			http.Error(w, err.Error(), writeErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+//POST method - /users/{id}:restore
+func (p *Server) HandleRestoreUser(w http.ResponseWriter, r *http.Request) {
+	//only administrator sees deleted users, so only administrator restores them
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.User)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	userChan := make(chan *repository.User, 1)
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, res chan<- *repository.User, exit chan<- error) {
+		usr, err := p.db.RestoreUser(insideCtx, id)
+		if err != nil {
+			exit <- err
+			return
+		}
+		res <- usr
+	}(ctx, userChan, exitRequest)
+	select {
+	case err := <-exitRequest:
+		http.Error(w, err.Error(), writeErrorStatus(err))
+	case usr := <-userChan:
+		w.Header().Set("ETag", userETag(usr))
+		encodeResponse(w, c, http.StatusOK, toAPIUser(usr))
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+//GET method - /users/{id}/history?offset=0&limit=10
+func (p *Server) HandleGetUserHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	offset, limit, err := parseURL(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, []api.UserAudit(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	historyChan := make(chan []repository.UserAudit, 1)
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, res chan<- []repository.UserAudit, exit chan<- error) {
+		history, err := p.db.History(insideCtx, id, offset, limit)
+		if err != nil {
+			exit <- err
+			return
+		}
+		if len(history) == 0 {
+			//purged users have history, so only users which never existed are not found
+			users, err := p.db.GetUsersByIds(repository.WithDeleted(insideCtx), []int{id})
+			if err == nil && len(users) == 0 {
+				err = gorm.ErrRecordNotFound
+			}
+			if err != nil {
+				exit <- err
+				return
+			}
+		}
+		res <- history
+	}(ctx, historyChan, exitRequest)
+	select {
+	case err := <-exitRequest:
+		http.Error(w, err.Error(), writeErrorStatus(err))
+	case history := <-historyChan:
+		encodeResponse(w, c, http.StatusOK, toAPIAudits(history))
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+//deletedScope returns request context which includes soft-deleted users
+//if admin asked for it with ?include_deleted
+func (p *Server) deletedScope(r *http.Request) (context.Context, error) {
+	values, ok := r.URL.Query()["include_deleted"]
+	if !ok {
+		return r.Context(), nil
+	}
+	include := true
+	if v := strings.TrimSpace(values[0]); v != "" {
+		tmp, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errBadIncludeDeleted
+		}
+		include = tmp
+	}
+	if !include {
+		return r.Context(), nil
+	}
+	if !p.isAdmin(r) {
+		return nil, errForbidden
+	}
+	return repository.WithDeleted(r.Context()), nil
+}
+
+func deletedScopeStatus(err error) int {
+	if err == errForbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+//matchVersion returns the version of If-Match header the write must be applied to,
+//0 if there is no precondition. A single ETag is checked by the write itself
+//under the lock of the user, the cache or a lagging replica would fail it
+//spuriously. A list of ETags is checked against the user read from the primary
+func (p *Server) matchVersion(ctx context.Context, id int, match string) (int, error) {
+	match = strings.TrimSpace(match)
+	if match == "" || match == "*" {
+		return 0, nil
+	}
+	if version, ok := etagVersion(match); ok {
+		return version, nil
+	}
+	usr, err := p.db.GetUserById(repository.WithPrimary(ctx), id)
+	if err != nil {
+		return 0, err
+	}
+	if !etagMatches(match, userETag(usr)) {
+		return 0, errPreconditionFailed
+	}
+	return usr.Version, nil
+}
+
+//matchError reports the version conflict of a write with If-Match as the failed precondition
+func matchError(err error, match string) error {
+	if err == repository.ErrVersionConflict && strings.TrimSpace(match) != "" {
+		return errPreconditionFailed
+	}
+	return err
+}
+
+func writeErrorStatus(err error) int {
+	switch err {
+	case gorm.ErrRecordNotFound:
+		return http.StatusNotFound
+	case repository.ErrVersionConflict, errPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case repository.ErrEmailTaken:
+		return http.StatusConflict
+	}
+	return dbErrorStatus(err)
+}
+
+//validateUser checks input of POST, PUT and items of batches
+func validateUser(usr *api.UserInput) (err error) {
+	if usr.Name, err = repository.ValidateName(usr.Name); err != nil {
+		return err
+	}
+	if usr.Email, err = repository.ValidateEmail(usr.Email); err != nil {
+		return err
+	}
+	return repository.ValidateStatus(usr.Status)
+}
+
+func createdHeader(c codec, usr *repository.User) http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", c.MediaTypes()[0])
+	header.Set("Vary", "Accept")
+	header.Set("Location", "/users/"+strconv.Itoa(usr.Id))
+	header.Set("ETag", userETag(usr))
+	return header
+}
+
 func parseURL(vars map[string]string) (int, int, error) {
 	offsetSTR, ok := vars["offset"]
 	if !ok {
@@ -147,8 +513,8 @@ func parseURL(vars map[string]string) (int, int, error) {
 		if err != nil {
 			return 0, 0, errors.New("bad limit")
 		}
-		if tmp > 25 {
-			tmp = 25
+		if tmp > repository.MaxPageSize {
+			tmp = repository.MaxPageSize
 		}
 		limit = tmp
 	}
@@ -2,8 +2,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/jinzhu/gorm"
+	"github.com/vmihailenco/msgpack/v4"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -59,11 +64,8 @@ func TestServer_HandleGetUserById_Success(t *testing.T) {
 	srv := Server{}
 	srv.InitRouters()
 	srv.db, _ = repository.NewPostgresDBMock()
-	tms := time.Unix(10, 10)
-	userTest, _ := json.Marshal(repository.User{
-		PrivateUser: repository.PrivateUser{Id: 1, CreateOn: tms},
-		PublicUser:  repository.PublicUser{Name: "Vasy"},
-	})
+	tms := time.Unix(10, 10).UTC()
+	userTest, _ := json.Marshal(api.User{Id: 1, Name: "Vasy", Status: repository.StatusActive, CreatedOn: tms, UpdatedOn: tms, Version: 1})
 	testCase := &TestCase{
 		Method:         "GET",
 		Url:            "http://localhost:8081/users/1",
@@ -194,17 +196,11 @@ func TestServer_HandleGetUsers_Success(t *testing.T) {
 	srv := Server{}
 	srv.InitRouters()
 	srv.db, _ = repository.NewPostgresDBMock()
-	userTest, _ := json.Marshal([]repository.User{
-		{repository.PrivateUser{
-			Id:       1,
-			CreateOn: time.Unix(10, 10)},
-			repository.PublicUser{Name: "Vasy"},
-		},
-		{repository.PrivateUser{
-			Id:       2,
-			CreateOn: time.Unix(10, 10)},
-			repository.PublicUser{Name: "VasyVasy"},
-		}})
+	tms := time.Unix(10, 10).UTC()
+	userTest, _ := json.Marshal([]api.User{
+		{Id: 1, Name: "Vasy", Status: repository.StatusActive, CreatedOn: tms, UpdatedOn: tms, Version: 1},
+		{Id: 2, Name: "VasyVasy", Status: repository.StatusActive, CreatedOn: tms, UpdatedOn: tms, Version: 1},
+	})
 	testCase := &TestCase{
 		Method:         "GET",
 		Url:            "http://localhost:8081/users?limit=2&offset=0",
@@ -235,8 +231,7 @@ func TestServer_HandleInsertUser(t *testing.T) {
 	testCase := &TestCase{
 		Method:         "POST",
 		Url:            "http://localhost:8081/users/",
-		ResponseStatus: http.StatusOK,
-		ResponseBody:   "",
+		ResponseStatus: http.StatusCreated,
 	}
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest(testCase.Method, testCase.Url, bytes.NewBuffer(userTest))
@@ -246,12 +241,15 @@ func TestServer_HandleInsertUser(t *testing.T) {
 		t.Errorf("wrong responce code, got %d expected %d\n",
 			w.Code, testCase.ResponseStatus)
 	}
-	body, err := ioutil.ReadAll(w.Body)
-	if err != nil {
+	if location := w.Header().Get("Location"); location != "/users/6" {
+		t.Errorf("expected Location /users/6, got %v\n", location)
+	}
+	var usr api.User
+	if err := json.NewDecoder(w.Body).Decode(&usr); err != nil {
 		t.Errorf("expected nil, got %v\n", err)
 	}
-	if string(body) != testCase.ResponseBody {
-		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, string(body))
+	if usr.Id != 6 || usr.Name != "Vasy" || usr.CreatedOn.IsZero() {
+		t.Errorf("expected created user with id 6, got %v\n", usr)
 	}
 }
 
@@ -284,3 +282,722 @@ func TestServer_HandleInsertUser_Error(t *testing.T) {
 		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, string(body))
 	}
 }
+
+func TestServer_HandleInsertUser_IdempotencyReplay(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	userTest, _ := json.Marshal(repository.PublicUser{Name: "Vasy"})
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8081/users/",
+			bytes.NewBuffer(userTest))
+		req.Header.Set("Idempotency-Key", "key-1")
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Errorf("wrong responce code, got %d expected %d\n",
+				w.Code, http.StatusCreated)
+		}
+		if location := w.Header().Get("Location"); location != "/users/6" {
+			t.Errorf("expected Location /users/6, got %v\n", location)
+		}
+		bodies = append(bodies, w.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("expected %v, got %v\n", bodies[0], bodies[1])
+	}
+	if n := srv.db.(*repository.PostgreMock).Len(); n != 6 {
+		t.Errorf("expected 6 users after replay, got %d\n", n)
+	}
+}
+
+//expiringKeysRepository lets the stored key expire right after it was found taken
+type expiringKeysRepository struct {
+	repository.IRepository
+	expired bool
+}
+
+func (p *expiringKeysRepository) GetIdempotencyKey(ctx context.Context, key string) (*repository.IdempotencyKey, error) {
+	if !p.expired {
+		p.expired = true
+		p.IRepository.DeleteIdempotencyKey(ctx, key)
+		return nil, gorm.ErrRecordNotFound
+	}
+	return p.IRepository.GetIdempotencyKey(ctx, key)
+}
+
+func TestServer_HandleInsertUser_IdempotencyKeyExpired(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(&expiringKeysRepository{IRepository: db})
+	now := time.Now()
+	db.CreateIdempotencyKey(context.Background(), &repository.IdempotencyKey{
+		Key: "key-1", Fingerprint: "old", CreateOn: now, ExpireOn: now.Add(time.Hour)})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8081/users/", bytes.NewBufferString(`{"name":"Kolya"}`))
+	req.Header.Set("Idempotency-Key", "key-1")
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusCreated)
+	}
+}
+
+func TestServer_HandleInsertUser_IdempotencyConflict(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	first, _ := json.Marshal(repository.PublicUser{Name: "Vasy"})
+	second, _ := json.Marshal(repository.PublicUser{Name: "Pety"})
+	testCase := &TestCase{
+		Method:         "POST",
+		Url:            "http://localhost:8081/users/",
+		ResponseStatus: http.StatusConflict,
+		ResponseBody:   "idempotency key reused with different request\n",
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url, bytes.NewBuffer(first))
+	req.Header.Set("Idempotency-Key", "key-1")
+	srv.mux.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(testCase.Method, testCase.Url, bytes.NewBuffer(second))
+	req.Header.Set("Idempotency-Key", "key-1")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	if string(body) != testCase.ResponseBody {
+		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, string(body))
+	}
+}
+
+func TestServer_HandleInsertUser_IdempotencyOtherMediaType(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	for i, accept := range []string{"application/json", "application/xml"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8081/users/", bytes.NewBufferString(`{"name":"Vasy"}`))
+		req.Header.Set("Idempotency-Key", "key-1")
+		req.Header.Set("Accept", accept)
+		srv.mux.ServeHTTP(w, req)
+		//the stored JSON response must not be replayed to the client asking for XML
+		if expected := []int{http.StatusCreated, http.StatusConflict}[i]; w.Code != expected {
+			t.Errorf("%s: wrong responce code, got %d expected %d\n", accept, w.Code, expected)
+		}
+	}
+}
+
+func TestServer_HandleGetUserById_NotModified(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	testCase := &TestCase{
+		Method:         "GET",
+		Url:            "http://localhost:8081/users/1",
+		ResponseStatus: http.StatusNotModified,
+		ResponseBody:   "",
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url, nil)
+	req.Header.Set("If-None-Match", `"1"`)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("expected ETag %v, got %v\n", `"1"`, etag)
+	}
+	if w.Body.String() != testCase.ResponseBody {
+		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, w.Body.String())
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	type TestCase struct {
+		Header string
+		Strong bool
+		Weak   bool
+	}
+	tests := []TestCase{
+		{Header: `"1"`, Strong: true, Weak: true},
+		{Header: `W/"1"`, Strong: false, Weak: true},
+		{Header: `"2", W/"1"`, Strong: false, Weak: true},
+		{Header: `*`, Strong: true, Weak: true},
+		{Header: `"2"`, Strong: false, Weak: false},
+	}
+	for _, test := range tests {
+		if res := etagMatches(test.Header, `"1"`); res != test.Strong {
+			t.Errorf("%s: expected strong match %v got %v", test.Header, test.Strong, res)
+		}
+		if res := etagMatchesWeak(test.Header, `"1"`); res != test.Weak {
+			t.Errorf("%s: expected weak match %v got %v", test.Header, test.Weak, res)
+		}
+	}
+}
+
+func TestEtagVersion(t *testing.T) {
+	tests := map[string]int{`"3"`: 3, `W/"3"`: 0, `"03"`: 0, `"0"`: 0, `"a"`: 0, `"`: 0}
+	for etag, expected := range tests {
+		if version, ok := etagVersion(etag); version != expected || ok != (expected != 0) {
+			t.Errorf("%s: expected %d got %d %v", etag, expected, version, ok)
+		}
+	}
+}
+
+//staleRepository reads users as a lagging replica does, before their last change
+type staleRepository struct {
+	repository.IRepository
+}
+
+func (p *staleRepository) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	usr, err := p.IRepository.GetUserById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	usr.Version--
+	return usr, nil
+}
+
+func TestServer_HandleUpdateUser_IfMatchStaleRead(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(&staleRepository{IRepository: db})
+	srv.AdminToken = testAdminToken
+	tests := []struct {
+		Method  string
+		Body    string
+		IfMatch string
+		Status  int
+	}{
+		{"PUT", `{"name":"Vasya"}`, `"1"`, http.StatusOK},
+		//the write checks the version of the primary, not of the stale read
+		{"PUT", `{"name":"Vasyan"}`, `"2"`, http.StatusOK},
+		{"PUT", `{"name":"Vasy"}`, `"2"`, http.StatusPreconditionFailed},
+		{"DELETE", "", `"3"`, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.Method, "http://localhost:8081/users/1", bytes.NewBufferString(test.Body))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		req.Header.Set("If-Match", test.IfMatch)
+		srv.ServeHTTP(w, req)
+		if w.Code != test.Status {
+			t.Errorf("%s %s: wrong responce code, got %d expected %d\n", test.Method, test.Body,
+				w.Code, test.Status)
+		}
+	}
+}
+
+//emptyRepository finds no users by id without scanning the mock
+type emptyRepository struct {
+	repository.IRepository
+}
+
+func (p *emptyRepository) GetUserById(ctx context.Context, id int) (*repository.User, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func TestServer_HandleGetUserById_NotFound(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	db, _ := repository.NewPostgresDBMock()
+	srv.db = &emptyRepository{IRepository: db}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/42", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServer_HandleUpdateUser_Success(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	userTest, _ := json.Marshal(repository.PublicUser{Name: "Pety"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "http://localhost:8081/users/1",
+		bytes.NewBuffer(userTest))
+	req.Header.Set("If-Match", `"1"`)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("expected ETag %v, got %v\n", `"2"`, etag)
+	}
+}
+
+func TestServer_HandleUpdateUser_PreconditionFailed(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	userTest, _ := json.Marshal(repository.PublicUser{Name: "Pety"})
+	testCase := &TestCase{
+		Method:         "PUT",
+		Url:            "http://localhost:8081/users/1",
+		ResponseStatus: http.StatusPreconditionFailed,
+		ResponseBody:   "precondition failed\n",
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url, bytes.NewBuffer(userTest))
+	req.Header.Set("If-Match", `"7"`)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	if w.Body.String() != testCase.ResponseBody {
+		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, w.Body.String())
+	}
+}
+
+func TestServer_HandleDeleteUser(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	testCase := &TestCase{
+		Method:         "DELETE",
+		Url:            "http://localhost:8081/users/2",
+		ResponseStatus: http.StatusNoContent,
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url, nil)
+	req.Header.Set("If-Match", `"1"`)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	if n := srv.db.(*repository.PostgreMock).Len(); n != 4 {
+		t.Errorf("expected 4 users after delete, got %d\n", n)
+	}
+}
+
+func TestServer_HandleRestoreUser(t *testing.T) {
+	srv := Server{AdminToken: testAdminToken}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "http://localhost:8081/users/1", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusNoContent)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "http://localhost:8081/users/1:restore", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusForbidden)
+	}
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("expected ETag %v, got %v\n", `"3"`, etag)
+	}
+	if n := srv.db.(*repository.PostgreMock).Len(); n != 5 {
+		t.Errorf("expected 5 users after restore, got %d\n", n)
+	}
+}
+
+func TestServer_HandleGetUsers_IncludeDeletedForbidden(t *testing.T) {
+	srv := Server{AdminToken: "secret"}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	testCase := &TestCase{
+		Method:         "GET",
+		Url:            "http://localhost:8081/users?limit=2&offset=0&include_deleted",
+		ResponseStatus: http.StatusForbidden,
+		ResponseBody:   "forbidden\n",
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	if w.Body.String() != testCase.ResponseBody {
+		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, w.Body.String())
+	}
+}
+
+func TestServer_HandleGetUserHistory(t *testing.T) {
+	srv := Server{AdminToken: "secret"}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	userTest, _ := json.Marshal(repository.PublicUser{Name: "Pety"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "http://localhost:8081/users/1",
+		bytes.NewBuffer(userTest))
+	req.Header.Set("Authorization", "Bearer secret")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://localhost:8081/users/1/history?offset=0&limit=10", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	var history []api.UserAudit
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected 1 audit record, got %v\n", history)
+	}
+	if history[0].Action != repository.AuditUpdate || history[0].Actor != "admin" ||
+		history[0].RequestId == "" {
+		t.Errorf("unexpected audit record %+v\n", history[0])
+	}
+	type TestCase struct {
+		Url    string
+		Status int
+		Body   string
+	}
+	tests := []TestCase{
+		//user without changes has empty history
+		{Url: "/users/2/history?offset=0&limit=10", Status: http.StatusOK, Body: "[]"},
+		{Url: "/users/42/history?offset=0&limit=10", Status: http.StatusNotFound, Body: "record not found\n"},
+	}
+	for _, test := range tests {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "http://localhost:8081"+test.Url, nil)
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != test.Status || w.Body.String() != test.Body {
+			t.Errorf("%s: expected %d %q got %d %q", test.Url, test.Status, test.Body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServer_HandleInsertUsers_PartialFailure(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	body := "{\"name\":\"Vasy\"}\n{\"id\":1}\n\n{\"name\":\"Pety\"}\n"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8081/users:batch",
+		bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusMultiStatus)
+	}
+	var results []api.BatchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %v\n", results)
+	}
+	if results[0].Status != http.StatusCreated || results[0].User.Id != 6 {
+		t.Errorf("expected created user 6, got %+v\n", results[0])
+	}
+	if results[1].Status != http.StatusBadRequest || results[1].Error == "" {
+		t.Errorf("expected bad request, got %+v\n", results[1])
+	}
+	if results[2].Status != http.StatusCreated || results[2].User.Id != 7 {
+		t.Errorf("expected created user 7, got %+v\n", results[2])
+	}
+}
+
+func TestServer_HandleInsertUsers_EmailConflicts(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	w := adminRequest(t, srv, "POST", "/users/", `{"name":"Kolya","email":"kolya@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusCreated)
+	}
+	w = adminRequest(t, srv, "POST", "/users:batch", `[{"name":"Vasy","email":"vasy@example.com"},`+
+		`{"name":"Kolyan","email":"KOLYA@example.com"},{"name":"Vasya","email":"Vasy@Example.com"},{"name":"Pety"}]`)
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusMultiStatus)
+	}
+	var results []api.BatchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %v\n", results)
+	}
+	//only items with taken or repeated emails fail
+	if results[0].Status != http.StatusCreated || results[0].User.Name != "Vasy" {
+		t.Errorf("expected created Vasy, got %+v\n", results[0])
+	}
+	if results[1].Status != http.StatusConflict || results[1].Error != repository.ErrEmailTaken.Error() {
+		t.Errorf("expected taken email, got %+v\n", results[1])
+	}
+	if results[2].Status != http.StatusConflict || results[2].Error != "email is repeated in the batch" {
+		t.Errorf("expected repeated email, got %+v\n", results[2])
+	}
+	if results[3].Status != http.StatusCreated || results[3].User.Name != "Pety" {
+		t.Errorf("expected created Pety, got %+v\n", results[3])
+	}
+}
+
+func TestServer_HandleInsertUsers_TooLarge(t *testing.T) {
+	srv := Server{MaxBatchSize: 1}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	testCase := &TestCase{
+		Method:         "POST",
+		Url:            "http://localhost:8081/users:batch",
+		RequestBody:    `[{"name":"Vasy"},{"name":"Pety"}]`,
+		ResponseStatus: http.StatusRequestEntityTooLarge,
+		ResponseBody:   "batch is too large\n",
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(testCase.Method, testCase.Url,
+		bytes.NewBufferString(testCase.RequestBody))
+	req.Header.Set("Content-Type", "application/json")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != testCase.ResponseStatus {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, testCase.ResponseStatus)
+	}
+	if w.Body.String() != testCase.ResponseBody {
+		t.Errorf("expected %v, got %v\n", testCase.ResponseBody, w.Body.String())
+	}
+}
+
+func TestServer_HandleExportUsers_CSV(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/export?name=pety", nil)
+	req.Header.Set("Accept", "text/csv")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	created := time.Unix(10, 10).UTC().Format(time.RFC3339Nano)
+	expected := "id,name,email,status,created_on,updated_on,version,deleted_on\n" +
+		"3,Pety,,active," + created + "," + created + ",1,\n" +
+		"4,PetyPety,,active," + created + "," + created + ",1,\n"
+	if w.Body.String() != expected {
+		t.Errorf("expected %v, got %v\n", expected, w.Body.String())
+	}
+}
+
+func TestServer_HandleExportUsers_NDJSON(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/export", nil)
+	srv.mux.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected application/x-ndjson, got %v\n", ct)
+	}
+	decoder := json.NewDecoder(w.Body)
+	count := 0
+	for decoder.More() {
+		var usr api.User
+		if err := decoder.Decode(&usr); err != nil {
+			t.Fatalf("expected nil, got %v\n", err)
+		}
+		count++
+	}
+	if count != 5 {
+		t.Errorf("expected 5 users, got %d\n", count)
+	}
+}
+
+func TestServer_HandleGetUserById_XML(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/1", nil)
+	req.Header.Set("Accept", "text/html;q=0.9, application/xml")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("expected application/xml, got %v\n", ct)
+	}
+	created := time.Unix(10, 10).UTC().Format(time.RFC3339Nano)
+	expected := xml.Header + "<user><id>1</id><name>Vasy</name><status>active</status><created_on>" + created +
+		"</created_on><updated_on>" + created + "</updated_on><version>1</version></user>"
+	if w.Body.String() != expected {
+		t.Errorf("expected %v, got %v\n", expected, w.Body.String())
+	}
+}
+
+func TestServer_HandleUpdateUser_XMLKeepsMetadata(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	w := adminRequest(t, srv, "PUT", "/users/1", `{"name":"Vasy","metadata":{"team":"a"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "http://localhost:8081/users/1",
+		bytes.NewBufferString("<user><name>Vasya</name></user>"))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Content-Type", "application/xml")
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusOK)
+	}
+	stored, _ := db.GetUserById(context.Background(), 1)
+	if stored.Name != "Vasya" || stored.Metadata["team"] != "a" {
+		t.Errorf("expected renamed user with kept metadata, got %v\n", stored)
+	}
+}
+
+func TestServer_HandleInsertUser_MessagePack(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).UseJSONTag(true).
+		Encode(repository.PublicUser{Name: "Vasy"}); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8081/users/", &buf)
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("Accept", "application/x-msgpack")
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("wrong responce code, got %d expected %d\n",
+			w.Code, http.StatusCreated)
+	}
+	var usr api.User
+	if err := msgpack.NewDecoder(w.Body).UseJSONTag(true).Decode(&usr); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if usr.Id != 6 || usr.Name != "Vasy" {
+		t.Errorf("expected created user with id 6, got %v\n", usr)
+	}
+}
+
+func TestServer_Codec_Errors(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	cases := []struct {
+		TestCase
+		ContentType string
+		Accept      string
+	}{
+		{TestCase{Method: "GET", Url: "http://localhost:8081/users/1",
+			ResponseStatus: http.StatusNotAcceptable, ResponseBody: "not acceptable\n"},
+			"", "text/csv"},
+		{TestCase{Method: "POST", Url: "http://localhost:8081/users/", RequestBody: "name=Vasy",
+			ResponseStatus: http.StatusUnsupportedMediaType, ResponseBody: "unsupported media type\n"},
+			"application/x-www-form-urlencoded", ""},
+	}
+	for _, testCase := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(testCase.Method, testCase.Url,
+			bytes.NewBufferString(testCase.RequestBody))
+		req.Header.Set("Content-Type", testCase.ContentType)
+		req.Header.Set("Accept", testCase.Accept)
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != testCase.ResponseStatus {
+			t.Errorf("wrong responce code, got %d expected %d\n",
+				w.Code, testCase.ResponseStatus)
+		}
+		if w.Body.String() != testCase.ResponseBody {
+			t.Errorf("expected %v, got %v\n", testCase.ResponseBody, w.Body.String())
+		}
+	}
+}
+
+func TestServer_UserProfile(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	tests := []TestCase{
+		//name has minLength 1 in /schemas/user.json
+		{Method: "POST", Url: "/users/", RequestBody: `{"name":""}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "name is required\n"},
+		{Method: "PUT", Url: "/users/2", RequestBody: `{"name":"  "}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "name is required\n"},
+		{Method: "POST", Url: "/users/", RequestBody: `{"name":"Kolya","email":"Vasy <vasy@example.com>"}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "bad email\n"},
+		{Method: "POST", Url: "/users/", RequestBody: `{"name":"Kolya","status":"banned"}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "status must be active or suspended\n"},
+		{Method: "POST", Url: "/users/", RequestBody: `{"name":"Kolya","email":" Kolya@Example.com ","status":"suspended","metadata":{"team":"a","age":3}}`,
+			ResponseStatus: http.StatusCreated},
+		//emails are unique regardless of case
+		{Method: "POST", Url: "/users/", RequestBody: `{"name":"Kolya","email":"kolya@example.com"}`,
+			ResponseStatus: http.StatusConflict, ResponseBody: repository.ErrEmailTaken.Error() + "\n"},
+		{Method: "PUT", Url: "/users/2", RequestBody: `{"name":"VasyVasy","email":"KOLYA@example.com"}`,
+			ResponseStatus: http.StatusConflict, ResponseBody: repository.ErrEmailTaken.Error() + "\n"},
+		{Method: "GET", Url: "/users/export?status=banned", ResponseStatus: http.StatusBadRequest,
+			ResponseBody: "status must be active or suspended\n"},
+		{Method: "GET", Url: "/users/export?updated_since=yesterday", ResponseStatus: http.StatusBadRequest,
+			ResponseBody: "bad updated_since\n"},
+		{Method: "GET", Url: "/users/export?metadata=%5B%5D", ResponseStatus: http.StatusBadRequest,
+			ResponseBody: "metadata must be a JSON object\n"},
+	}
+	for _, test := range tests {
+		w := adminRequest(t, srv, test.Method, test.Url, test.RequestBody)
+		if w.Code != test.ResponseStatus || (test.ResponseBody != "" && w.Body.String() != test.ResponseBody) {
+			t.Errorf("%s %s: expected %d %q, got %d %q\n", test.Method, test.Url,
+				test.ResponseStatus, test.ResponseBody, w.Code, w.Body.String())
+		}
+	}
+	w := adminRequest(t, srv, "GET", "/users?offset=5&limit=1", "")
+	var users []api.User
+	json.NewDecoder(w.Body).Decode(&users)
+	usr := api.User{}
+	if len(users) == 1 {
+		usr = users[0]
+	}
+	if usr.Email != "Kolya@Example.com" || usr.Status != repository.StatusSuspended ||
+		usr.Metadata["team"] != "a" || usr.UpdatedOn.IsZero() {
+		t.Errorf("expected Kolya with profile, got %d %+v\n", w.Code, usr)
+	}
+	filters := map[string][]int{
+		"/users/export?email=KOLYA%40example.com":                               {6},
+		"/users/export?status=active&name=vasy":                                 {1, 2},
+		"/users/export?metadata=%7B%22team%22%3A%22a%22%7D":                     {6},
+		"/users/export?metadata=%7B%22team%22%3A%22b%22%7D":                     nil,
+		"/users/export?updated_since=" + usr.UpdatedOn.Format(time.RFC3339Nano): {6},
+	}
+	for url, ids := range filters {
+		w := adminRequest(t, srv, "GET", url, "")
+		var found []int
+		decoder := json.NewDecoder(w.Body)
+		for decoder.More() {
+			var usr api.User
+			if err := decoder.Decode(&usr); err != nil {
+				t.Fatalf("%s: expected nil, got %v\n", url, err)
+			}
+			found = append(found, usr.Id)
+		}
+		if w.Code != http.StatusOK || len(found) != len(ids) || (len(ids) > 0 && found[0] != ids[0]) {
+			t.Errorf("%s: expected %v, got %d %v\n", url, ids, w.Code, found)
+		}
+	}
+}
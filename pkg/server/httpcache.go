@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	mx "github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//noStore - Cache-Control of routes without policy and of failed responses
+const noStore = "no-store"
+
+var errNoRoute = errors.New("no route")
+
+//cachePolicy - caching headers of successful responses of a GET route
+type cachePolicy struct {
+	cacheControl string
+	vary         string
+}
+
+//cachePolicies by path template of the route, responses of other routes are not stored.
+//Users differ by Accept and by Authorization of administrator who sees deleted ones
+var cachePolicies = map[string]cachePolicy{
+	"/openapi.json":      {cacheControl: "public, max-age=300"},
+	"/schemas/user.json": {cacheControl: "public, max-age=300"},
+	"/users":             {cacheControl: "private, max-age=5", vary: "Accept, Authorization"},
+	"/users/search":      {cacheControl: "private, max-age=5", vary: "Accept, Authorization"},
+	//clients revalidate the user with ETag or Last-Modified
+	"/users/{id:[0-9]+}":         {cacheControl: "private, no-cache", vary: "Accept, Authorization"},
+	"/users/{id:[0-9]+}/history": {cacheControl: "private, max-age=5", vary: "Accept, Authorization"},
+}
+
+func routePolicy(r *http.Request) (cachePolicy, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return cachePolicy{}, false
+	}
+	template, err := routeTemplate(r)
+	if err != nil {
+		return cachePolicy{}, false
+	}
+	policy, ok := cachePolicies[template]
+	return policy, ok
+}
+
+//routeTemplate returns path template of the matched route
+func routeTemplate(r *http.Request) (string, error) {
+	route := mx.CurrentRoute(r)
+	if route == nil {
+		return "", errNoRoute
+	}
+	return route.GetPathTemplate()
+}
+
+//cachePolicyMiddleware sets Cache-Control and Vary, handlers may set
+//their own Cache-Control, e.g. the stream of events
+func (p *Server) cachePolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := routePolicy(r)
+		if !ok {
+			w.Header().Set("Cache-Control", noStore)
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&policyWriter{ResponseWriter: w, policy: policy}, r)
+	})
+}
+
+//policyWriter applies the policy when status of the response is known
+type policyWriter struct {
+	http.ResponseWriter
+	policy      cachePolicy
+	wroteHeader bool
+}
+
+func (p *policyWriter) WriteHeader(statusCode int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		header := p.Header()
+		if header.Get("Cache-Control") == "" {
+			if statusCode >= 200 && statusCode <= 299 || statusCode == http.StatusNotModified {
+				header.Set("Cache-Control", p.policy.cacheControl)
+			} else {
+				header.Set("Cache-Control", noStore)
+			}
+		}
+		addVary(header, p.policy.vary)
+	}
+	p.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (p *policyWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+//addVary adds to Vary comma separated names which it does not have yet
+func addVary(header http.Header, names string) {
+	present := map[string]bool{}
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			present[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !present[strings.ToLower(name)] {
+			header.Add("Vary", name)
+			present[strings.ToLower(name)] = true
+		}
+	}
+}
+
+//userLastModified returns time of the last change of user, it is zero if unknown:
+//users stored before updated_on was added know only time of creation
+func userLastModified(usr *repository.User) time.Time {
+	if !usr.UpdatedOn.IsZero() {
+		return usr.UpdatedOn
+	}
+	if usr.Version > 1 {
+		return time.Time{}
+	}
+	return usr.CreateOn
+}
+
+func setLastModified(w http.ResponseWriter, modified time.Time) {
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+//notModifiedSince reports whether resource modified at the given time
+//is not newer than If-Modified-Since of the request
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/internal/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_CachePolicy(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	type TestCase struct {
+		Url          string
+		Status       int
+		CacheControl string
+		Vary         string
+		LastModified string
+	}
+	tests := []TestCase{
+		{Url: "/users/1", Status: http.StatusOK, CacheControl: "private, no-cache",
+			Vary: "Accept, Authorization", LastModified: "Thu, 01 Jan 1970 00:00:10 GMT"},
+		{Url: "/users?offset=0&limit=2", Status: http.StatusOK, CacheControl: "private, max-age=5",
+			Vary: "Accept, Authorization"},
+		{Url: "/users/1?include_deleted=true", Status: http.StatusForbidden, CacheControl: noStore,
+			Vary: "Accept, Authorization"},
+		{Url: "/openapi.json", Status: http.StatusOK, CacheControl: "public, max-age=300"},
+		{Url: "/ping", Status: http.StatusOK, CacheControl: noStore},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost:8081"+test.Url, nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != test.Status || w.Header().Get("Cache-Control") != test.CacheControl ||
+			strings.Join(w.Header()["Vary"], ", ") != test.Vary || w.Header().Get("Last-Modified") != test.LastModified {
+			t.Errorf("%s: expected %d %q %q %q got %d %v", test.Url, test.Status, test.CacheControl,
+				test.Vary, test.LastModified, w.Code, w.Header())
+		}
+	}
+}
+
+func TestServer_IfModifiedSince(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	type TestCase struct {
+		Header string
+		Value  string
+		Status int
+	}
+	tests := []TestCase{
+		{Header: "If-Modified-Since", Value: "Thu, 01 Jan 1970 00:00:10 GMT", Status: http.StatusNotModified},
+		{Header: "If-Modified-Since", Value: "Thu, 01 Jan 1970 00:00:09 GMT", Status: http.StatusOK},
+		{Header: "If-Modified-Since", Value: "yesterday", Status: http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost:8081/users/1", nil)
+		req.Header.Set(test.Header, test.Value)
+		srv.ServeHTTP(w, req)
+		if w.Code != test.Status {
+			t.Errorf("%s: expected %d got %d", test.Value, test.Status, w.Code)
+		}
+	}
+	//changed user is modified on time of the change
+	adminRequest(t, srv, "PUT", "/users/1", `{"name":"Kolya"}`)
+	w := adminRequest(t, srv, "GET", "/users/1", "")
+	modified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if w.Code != http.StatusOK || err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("expected Last-Modified of the change got %d %v", w.Code, w.Header())
+	}
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/1", nil)
+	req.Header.Set("If-Modified-Since", "Thu, 01 Jan 1970 00:00:10 GMT")
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestServer_UsersETag(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	get := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost:8081/users?offset=0&limit=2", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	etag := get("").Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected ETag of the page")
+	}
+	if w := get("W/" + etag); w.Code != http.StatusNotModified {
+		t.Errorf("expected %d got %d", http.StatusNotModified, w.Code)
+	}
+	//the deleted user leaves the page, no user of the page is newer than before
+	if w := adminRequest(t, srv, "DELETE", "/users/2", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected deleted user got %d", w.Code)
+	}
+	w := get(etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("expected changed page got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestServer_ResponseCache(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	srv.ResponseCacheSize = 10
+	srv.useResponseCache()
+	type TestCase struct {
+		Method string
+		Url    string
+		Body   string
+		Status int
+		Cache  string
+		Name   string
+	}
+	tests := []TestCase{
+		{Method: "GET", Url: "/users/1", Status: http.StatusOK, Cache: "MISS", Name: "Vasy"},
+		{Method: "GET", Url: "/users/1", Status: http.StatusOK, Cache: "HIT", Name: "Vasy"},
+		{Method: "GET", Url: "/users?offset=0&limit=1", Status: http.StatusOK, Cache: "MISS", Name: "Vasy"},
+		{Method: "PUT", Url: "/users/1", Body: `{"name":"Kolya"}`, Status: http.StatusOK, Name: "Kolya"},
+		{Method: "GET", Url: "/users/1", Status: http.StatusOK, Cache: "MISS", Name: "Kolya"},
+		{Method: "GET", Url: "/users?offset=0&limit=1", Status: http.StatusOK, Cache: "MISS", Name: "Kolya"},
+		{Method: "GET", Url: "/users?offset=0&limit=1", Status: http.StatusOK, Cache: "HIT", Name: "Kolya"},
+	}
+	for i, test := range tests {
+		w := adminRequest(t, srv, test.Method, test.Url, test.Body)
+		if w.Code != test.Status || w.Header().Get(cacheHeader) != test.Cache ||
+			!strings.Contains(w.Body.String(), `"name":"`+test.Name+`"`) {
+			t.Errorf("%d: expected %d %q %s got %d %q %s", i, test.Status, test.Cache, test.Name,
+				w.Code, w.Header().Get(cacheHeader), w.Body.String())
+		}
+	}
+	//the cached response answers conditional requests too
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("If-None-Match", `"2"`)
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Header().Get(cacheHeader) != "HIT" ||
+		w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("expected cached 304 got %d %v", w.Code, w.Header())
+	}
+}
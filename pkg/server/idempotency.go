@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/jinzhu/gorm"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader     = "Idempotency-Key"
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+var (
+	errIdempotencyKeyReused     = errors.New("idempotency key reused with different request")
+	errIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+func (p *Server) idempotencyTTL() time.Duration {
+	if p.IdempotencyTTL <= 0 {
+		return defaultIdempotencyTTL
+	}
+	return p.IdempotencyTTL
+}
+
+//requestFingerprint covers the negotiated media type too, the stored response
+//is replayed as is and must be in the format the client asked for
+func requestFingerprint(r *http.Request, mediaType string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write([]byte(mediaType + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//reserveIdempotencyKey returns nil, nil if the key is reserved for this request
+//or the stored record if the request was already completed
+func (p *Server) reserveIdempotencyKey(ctx context.Context, key, fingerprint string) (*repository.IdempotencyKey, error) {
+	stored, err := p.tryReserveIdempotencyKey(ctx, key, fingerprint)
+	if err == gorm.ErrRecordNotFound {
+		//the key has expired after it was found taken, now it is free
+		return p.tryReserveIdempotencyKey(ctx, key, fingerprint)
+	}
+	return stored, err
+}
+
+func (p *Server) tryReserveIdempotencyKey(ctx context.Context, key, fingerprint string) (*repository.IdempotencyKey, error) {
+	now := time.Now()
+	err := p.db.CreateIdempotencyKey(ctx, &repository.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreateOn:    now,
+		ExpireOn:    now.Add(p.idempotencyTTL()),
+	})
+	if err != repository.ErrDuplicateKey {
+		return nil, err
+	}
+	stored, err := p.db.GetIdempotencyKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Fingerprint != fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	if stored.StatusCode == 0 {
+		return nil, errIdempotencyKeyInProgress
+	}
+	return stored, nil
+}
+
+//completeIdempotencyKey is called after the request has finished, even if the
+//client has already gone, so it does not use the request context
+func (p *Server) completeIdempotencyKey(key string, statusCode int, header http.Header, body []byte) {
+	if key == "" {
+		return
+	}
+	encodeHeader, err := json.Marshal(header)
+	if err != nil {
+		log.Printf("can't save idempotency key %s: %v\n", key, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), repository.RequestTimeout)
+	defer cancel()
+	err = p.db.UpdateIdempotencyKey(ctx, &repository.IdempotencyKey{
+		Key:        key,
+		StatusCode: statusCode,
+		Header:     encodeHeader,
+		Body:       body,
+	})
+	if err != nil {
+		log.Printf("can't save idempotency key %s: %v\n", key, err)
+	}
+}
+
+func replayIdempotencyKey(w http.ResponseWriter, stored *repository.IdempotencyKey) {
+	var header http.Header
+	if err := json.Unmarshal(stored.Header, &header); err == nil {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+//releaseIdempotencyKey lets the client retry a request that has failed
+func (p *Server) releaseIdempotencyKey(key string) {
+	if key == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), repository.RequestTimeout)
+	defer cancel()
+	if err := p.db.DeleteIdempotencyKey(ctx, key); err != nil {
+		log.Printf("can't release idempotency key %s: %v\n", key, err)
+	}
+}
+
+func idempotencyErrorStatus(err error) int {
+	if err == errIdempotencyKeyReused || err == errIdempotencyKeyInProgress {
+		return http.StatusConflict
+	}
+	return dbErrorStatus(err)
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
 	uuid "github.com/satori/go.uuid"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -21,6 +25,24 @@ func (p *CustResponce) WriteHeader(statusCode int) {
 	p.statusCode = statusCode
 }
 
+func (p *CustResponce) Flush() {
+	if flusher, ok := p.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Hijack lets WebSocket take over the connection
+func (p *CustResponce) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := p.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	if p.statusCode == 0 {
+		p.statusCode = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
 func (p *CustResponce) Header() http.Header {
 	return p.w.Header()
 }
@@ -30,9 +52,24 @@ func (p *Server) loggingMiddleware(next http.Handler) http.Handler {
 		u1 := uuid.NewV4()
 		ctx := context.WithValue(r.Context(),
 			"LogID", u1)
+		ctx = repository.WithRequestID(ctx, u1.String())
 		resp := &CustResponce{w: w}
 		next.ServeHTTP(resp, r.WithContext(ctx))
 		log.Printf("%s %s %s %s %d\n", u1.String(), r.RemoteAddr,
 			r.Method, r.RequestURI, resp.statusCode)
 	})
 }
+
+//auditMiddleware puts actor of the request into context for the audit trail
+func (p *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := "anonymous"
+		if p.isAdmin(r) {
+			actor = "admin"
+		}
+		ctx := repository.WithActor(r.Context(), actor)
+		//reads after a write of the request must see it
+		ctx = repository.WithReadYourWrites(ctx)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/NektarinR/godocker/pkg/api"
+	mx "github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type openAPIDoc struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+//routeVar turns mux variables like {id:[0-9]+} into OpenAPI {id}
+var routeVar = regexp.MustCompile(`\{([^:}]+):[^}]+\}`)
+
+func loadOpenAPI(t *testing.T, srv *Server) *openAPIDoc {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/openapi.json", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %v\n", ct)
+	}
+	var doc openAPIDoc
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("expected OpenAPI 3, got %v\n", doc.OpenAPI)
+	}
+	return &doc
+}
+
+//registeredRoutes returns "METHOD /path" of every route of InitRouters
+func registeredRoutes(t *testing.T, srv *Server) map[string]bool {
+	routes := map[string]bool{}
+	err := srv.mux.Walk(func(route *mx.Route, router *mx.Router, ancestors []*mx.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			routes[method+" "+routeVar.ReplaceAllString(path, "{$1}")] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	return routes
+}
+
+func TestServer_OpenAPI_DescribesAllRoutes(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	doc := loadOpenAPI(t, &srv)
+	routes := registeredRoutes(t, &srv)
+	if len(routes) == 0 {
+		t.Fatalf("expected registered routes\n")
+	}
+	for route := range routes {
+		parts := strings.SplitN(route, " ", 2)
+		if _, ok := doc.Paths[parts[1]][strings.ToLower(parts[0])]; !ok {
+			t.Errorf("route %s is missing in /openapi.json\n", route)
+		}
+	}
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			route := strings.ToUpper(method) + " " + path
+			if !routes[route] {
+				t.Errorf("%s is described in /openapi.json but not registered\n", route)
+			}
+		}
+	}
+}
+
+func TestServer_OpenAPI_UserMatchesSchema(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	doc := loadOpenAPI(t, &srv)
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(api.UserSchema), &schema); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	keys := func(m map[string]json.RawMessage) []string {
+		var result []string
+		for k := range m {
+			result = append(result, k)
+		}
+		sort.Strings(result)
+		return result
+	}
+	expected := keys(schema.Properties)
+	got := keys(doc.Components.Schemas["User"].Properties)
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected User properties %v, got %v\n", expected, got)
+	}
+}
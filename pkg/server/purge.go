@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	defaultUserRetention = 30 * 24 * time.Hour
+	purgeInterval        = time.Hour
+)
+
+func (p *Server) userRetention() time.Duration {
+	if p.UserRetention <= 0 {
+		return defaultUserRetention
+	}
+	return p.UserRetention
+}
+
+//runPurge hard-deletes soft-deleted users older than retention until stop is closed
+func (p *Server) runPurge(stop <-chan struct{}) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		p.purgeUsers()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Server) purgeUsers() {
+	if p.db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	count, err := p.db.PurgeUsers(ctx, time.Now().Add(-p.userRetention()))
+	if err != nil {
+		log.Printf("Ошибка при удалении пользователей %v\n", err)
+		return
+	}
+	if count > 0 {
+		p.invalidateResponses()
+		log.Printf("Удалено пользователей: %d\n", count)
+	}
+}
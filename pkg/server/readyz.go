@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/internal/resilience"
+	"github.com/NektarinR/godocker/pkg/api"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const readyTimeout = time.Second
+
+//useResilience puts retries and the circuit breaker in front of the repository,
+//the cache of users is put in front of them and serves hits while the database is down
+func (p *Server) useResilience() {
+	if p.db == nil {
+		return
+	}
+	resilient := resilience.NewRepository(p.db)
+	if p.DbRetryAttempts > 0 {
+		resilient.Retry.Attempts = p.DbRetryAttempts
+	}
+	if p.BreakerThreshold > 0 {
+		resilient.Breaker.Threshold = p.BreakerThreshold
+	}
+	if p.BreakerCooldown > 0 {
+		resilient.Breaker.Cooldown = p.BreakerCooldown
+	}
+	p.db = resilient
+	p.breaker = resilient.Breaker
+}
+
+//dbErrorStatus - 503 if the database is down, 500 otherwise
+func dbErrorStatus(err error) int {
+	if err == repository.ErrUnavailable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+//GET method - /readyz
+func (p *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	result := api.Readiness{Status: "ready", Database: "up"}
+	if err := p.db.Ping(ctx); err != nil {
+		result.Status, result.Database = "unavailable", "down"
+	}
+	if p.breaker != nil {
+		state := p.breaker.State()
+		result.Breaker, result.Failures, result.OpenedOn = state.State, state.Failures, state.OpenedOn
+		if state.State == resilience.StateOpen {
+			result.Status = "unavailable"
+		}
+	}
+	status := http.StatusOK
+	if result.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+//retryAfterMiddleware tells clients of 503 responses when the breaker lets calls through again
+func (p *Server) retryAfterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.breaker == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&retryAfterWriter{ResponseWriter: w, breaker: p.breaker}, r)
+	})
+}
+
+type retryAfterWriter struct {
+	http.ResponseWriter
+	breaker     *resilience.Breaker
+	wroteHeader bool
+}
+
+func (p *retryAfterWriter) WriteHeader(statusCode int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		header := p.Header()
+		if statusCode == http.StatusServiceUnavailable && header.Get("Retry-After") == "" {
+			if wait := p.breaker.State().RetryAfter; wait > 0 {
+				header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
+		}
+	}
+	p.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (p *retryAfterWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *retryAfterWriter) Flush() {
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (p *retryAfterWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := p.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	return hijacker.Hijack()
+}
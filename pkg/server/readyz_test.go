@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//downRepository - repository which database refuses connections
+type downRepository struct {
+	repository.IRepository
+	down bool
+}
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func (p *downRepository) Ping(ctx context.Context) error {
+	if p.down {
+		return errRefused
+	}
+	return p.IRepository.Ping(ctx)
+}
+
+func (p *downRepository) Fetch(ctx context.Context, offset, limit int) ([]repository.User, error) {
+	if p.down {
+		return nil, errRefused
+	}
+	return p.IRepository.Fetch(ctx, offset, limit)
+}
+
+func getReadiness(t *testing.T, srv http.Handler) (int, api.Readiness) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/readyz", nil)
+	srv.ServeHTTP(w, req)
+	result := api.Readiness{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("can't decode %s: %v", w.Body.String(), err)
+	}
+	return w.Code, result
+}
+
+func TestServer_HandleReady(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	down := &downRepository{IRepository: db}
+	srv := &Server{db: down, DbRetryAttempts: 1, BreakerThreshold: 2, BreakerCooldown: time.Minute}
+	srv.useResilience()
+	srv.InitRouters()
+
+	code, res := getReadiness(t, srv)
+	if code != http.StatusOK || res.Status != "ready" || res.Database != "up" || res.Breaker != "closed" {
+		t.Errorf("expected ready got %d %+v", code, res)
+	}
+
+	down.down = true
+	code, res = getReadiness(t, srv)
+	if code != http.StatusServiceUnavailable || res.Database != "down" || res.Breaker != "closed" || res.Failures != 1 {
+		t.Errorf("expected database down got %d %+v", code, res)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users?offset=0&limit=2", nil)
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusInternalServerError)
+	}
+
+	//the breaker is open now and fast-fails requests
+	code, res = getReadiness(t, srv)
+	if code != http.StatusServiceUnavailable || res.Breaker != "open" || res.OpenedOn == nil {
+		t.Errorf("expected open breaker got %d %+v", code, res)
+	}
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusServiceUnavailable)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("expected Retry-After 60 got %q", retry)
+	}
+}
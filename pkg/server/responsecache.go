@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/cache"
+	"github.com/NektarinR/godocker/internal/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultResponseCacheTTL = 10 * time.Second
+	//maxCachedResponse - bigger responses are not stored
+	maxCachedResponse = 1 << 20
+	//cacheHeader - HIT if the response is taken from the cache, MISS otherwise
+	cacheHeader = "X-Cache"
+)
+
+//cachedRoutes - GET routes kept by the response cache
+var cachedRoutes = map[string]bool{
+	"/users":             true,
+	"/users/{id:[0-9]+}": true,
+}
+
+//responseCache keeps successful responses in memory. Any write clears it:
+//keys carry the generation which is increased by writes, old entries are evicted
+type responseCache struct {
+	store      cache.Cache
+	ttl        time.Duration
+	generation uint64
+}
+
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+//useResponseCache enables the response cache if ResponseCacheSize is set
+func (p *Server) useResponseCache() {
+	if p.ResponseCacheSize <= 0 {
+		return
+	}
+	p.responses = &responseCache{store: cache.NewLRU(p.ResponseCacheSize), ttl: p.ResponseCacheTTL}
+	if p.responses.ttl <= 0 {
+		p.responses.ttl = defaultResponseCacheTTL
+	}
+}
+
+//invalidateResponses drops cached responses, it is safe to call if the cache is disabled
+func (p *Server) invalidateResponses() {
+	if p.responses != nil {
+		atomic.AddUint64(&p.responses.generation, 1)
+	}
+}
+
+//watchResponses clears the cache on changes made past HTTP handlers, e.g. by gRPC
+func (p *Server) watchResponses(bus *repository.ChangeBus, stop <-chan struct{}) {
+	if p.responses == nil {
+		return
+	}
+	sub, _, _ := bus.Subscribe(-1, 64)
+	defer func() {
+		sub.Close()
+	}()
+	for {
+		select {
+		case _, ok := <-sub.C():
+			if !ok {
+				sub, _, _ = bus.Subscribe(-1, 64)
+			}
+			p.invalidateResponses()
+		case <-stop:
+			return
+		}
+	}
+}
+
+//responseCacheMiddleware serves GET /users and /users/{id} from the cache,
+//writes of users clear it before and after they are made
+func (p *Server) responseCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.responses == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := routeTemplate(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			//other writes, e.g. mutations of GraphQL, clear the cache from the bus
+			if strings.HasPrefix(template, "/users") {
+				p.invalidateResponses()
+				defer p.invalidateResponses()
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet || !cachedRoutes[template] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := p.responses.key(r, p.isAdmin(r))
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			if resp, ok := p.responses.get(r.Context(), key); ok {
+				w.Header().Set(cacheHeader, "HIT")
+				resp.write(w, r)
+				return
+			}
+		}
+		w.Header().Set(cacheHeader, "MISS")
+		rec := &responseRecorder{ResponseWriter: w}
+		//the response is kept for the TTL, it must not come from a lagging replica
+		next.ServeHTTP(rec, r.WithContext(repository.WithPrimary(r.Context())))
+		if rec.status == http.StatusOK && !rec.overflow {
+			p.responses.set(r.Context(), key, &cachedResponse{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()})
+		}
+	})
+}
+
+//key of the response, it depends on everything the handlers look at
+func (p *responseCache) key(r *http.Request, admin bool) string {
+	generation := atomic.LoadUint64(&p.generation)
+	return strconv.FormatUint(generation, 10) + " " + strconv.FormatBool(admin) + " " +
+		r.Header.Get("Accept") + " " + r.URL.RequestURI()
+}
+
+func (p *responseCache) get(ctx context.Context, key string) (*cachedResponse, bool) {
+	value, ok, err := p.store.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	result := &cachedResponse{}
+	if err := json.Unmarshal(value, result); err != nil {
+		return nil, false
+	}
+	return result, true
+}
+
+func (p *responseCache) set(ctx context.Context, key string, resp *cachedResponse) {
+	value, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	p.store.Set(ctx, key, value, p.ttl)
+}
+
+//write replays the response, conditional requests are answered with 304
+func (p *cachedResponse) write(w http.ResponseWriter, r *http.Request) {
+	for k, v := range p.Header {
+		w.Header()[k] = v
+	}
+	etag := p.Header.Get("ETag")
+	match := r.Header.Get("If-None-Match")
+	if etag != "" && match != "" && etagMatchesWeak(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if match == "" {
+		if modified, err := http.ParseTime(p.Header.Get("Last-Modified")); err == nil && notModifiedSince(r, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(p.Status)
+	w.Write(p.Body)
+}
+
+//responseRecorder copies the response while it is written
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (p *responseRecorder) WriteHeader(statusCode int) {
+	if p.status == 0 {
+		p.status = statusCode
+		p.header = make(http.Header, len(p.Header()))
+		for k, v := range p.Header() {
+			if k != cacheHeader {
+				p.header[k] = append([]string(nil), v...)
+			}
+		}
+	}
+	p.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (p *responseRecorder) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.body.Len()+len(b) > maxCachedResponse {
+		p.overflow = true
+	} else if !p.overflow {
+		p.body.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
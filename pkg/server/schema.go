@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/NektarinR/godocker/pkg/api"
+	"io"
+	"net/http"
+)
+
+//GET method - /schemas/user.json
+func (p *Server) HandleUserSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, api.UserSchema)
+}
+
+//GET method - /openapi.json
+func (p *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, api.OpenAPI)
+}
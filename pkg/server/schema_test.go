@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/xeipuuv/gojsonschema"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//loadUserSchema loads the schema the way clients do - from /schemas/user.json
+func loadUserSchema(t *testing.T, srv *Server) *gojsonschema.Schema {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/schemas/user.json", nil)
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/schema+json" {
+		t.Errorf("expected application/schema+json, got %v\n", ct)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	return schema
+}
+
+func validateUserJSON(t *testing.T, schema *gojsonschema.Schema, data []byte) {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	for _, v := range result.Errors() {
+		t.Errorf("%s does not match schema: %v\n", data, v)
+	}
+}
+
+func TestServer_UserSchema(t *testing.T) {
+	srv := Server{AdminToken: "secret"}
+	srv.InitRouters()
+	db, _ := repository.NewPostgresDBMock()
+	srv.db = db
+	schema := loadUserSchema(t, &srv)
+	if err := db.DeleteUser(context.Background(), 1, 0); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	testCases := []struct {
+		Method string
+		Url    string
+		Body   string
+		Status int
+	}{
+		{"GET", "http://localhost:8081/users/2", "", http.StatusOK},
+		{"GET", "http://localhost:8081/users/1?include_deleted", "", http.StatusOK},
+		{"POST", "http://localhost:8081/users/", `{"name":"Vasy"}`, http.StatusCreated},
+		{"PUT", "http://localhost:8081/users/2", `{"name":"Pety"}`, http.StatusOK},
+		{"POST", "http://localhost:8081/users/1:restore", "", http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(testCase.Method, testCase.Url, bytes.NewBufferString(testCase.Body))
+		req.Header.Set("Authorization", "Bearer secret")
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != testCase.Status {
+			t.Errorf("%s %s: wrong responce code, got %d expected %d\n",
+				testCase.Method, testCase.Url, w.Code, testCase.Status)
+			continue
+		}
+		validateUserJSON(t, schema, w.Body.Bytes())
+	}
+}
+
+func TestServer_UserSchema_List(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	srv.db, _ = repository.NewPostgresDBMock()
+	schema := loadUserSchema(t, &srv)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/users?limit=3&offset=0", nil)
+	srv.mux.ServeHTTP(w, req)
+	var users []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if len(users) != 3 {
+		t.Errorf("expected 3 users, got %d\n", len(users))
+	}
+	for _, v := range users {
+		validateUserJSON(t, schema, v)
+	}
+}
+
+func TestServer_UserSchema_RejectsStorageModel(t *testing.T) {
+	srv := Server{}
+	srv.InitRouters()
+	schema := loadUserSchema(t, &srv)
+	result, err := schema.Validate(gojsonschema.NewStringLoader(
+		`{"id":1,"name":"Vasy","create_on":"1970-01-01T00:00:10Z","version":1}`))
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if result.Valid() {
+		t.Errorf("expected create_on to be rejected\n")
+	}
+}
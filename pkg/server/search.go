@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	mx "github.com/gorilla/mux"
+	"html"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+var errEmptySearch = errors.New("q must have letters or digits")
+
+//GET method - /users/search?q=vasy&offset=0&limit=10
+func (p *Server) HandleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	vars := mx.Vars(r)
+	offset, limit, err := parseURL(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := vars["q"]
+	words := repository.SearchWords(query)
+	if len(words) == 0 {
+		http.Error(w, errEmptySearch.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := p.deletedScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), deletedScopeStatus(err))
+		return
+	}
+	c, err := negotiateCodec(r, []api.SearchResult(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(scope, repository.RequestTimeout)
+	defer cancel()
+	found := make(chan []repository.SearchResult, 1)
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, res chan<- []repository.SearchResult, exit chan<- error) {
+		users, err := p.db.SearchUsers(insideCtx, query, offset, limit)
+		if err != nil {
+			exit <- err
+			return
+		}
+		res <- users
+	}(ctx, found, exitRequest)
+	select {
+	case err := <-exitRequest:
+		http.Error(w, err.Error(), dbErrorStatus(err))
+	case users := <-found:
+		encodeResponse(w, c, http.StatusOK, toAPISearchResults(users, words))
+	case <-ctx.Done():
+		http.Error(w, "server is busy", http.StatusInternalServerError)
+		return
+	}
+}
+
+func toAPISearchResults(users []repository.SearchResult, words []string) []api.SearchResult {
+	result := make([]api.SearchResult, len(users))
+	for i := range users {
+		result[i] = api.SearchResult{
+			User:      *toAPIUser(&users[i].User),
+			Rank:      users[i].Rank,
+			Highlight: highlight(users[i].Name, words),
+		}
+	}
+	return result
+}
+
+//highlight escapes name as HTML and wraps in <mark> beginnings of its words
+//which match words of the query, the longest match is taken
+func highlight(name string, words []string) string {
+	var result strings.Builder
+	runes := []rune(name)
+	for start := 0; start < len(runes); {
+		end := start
+		isWord := isWordRune(runes[start])
+		for end < len(runes) && isWordRune(runes[end]) == isWord {
+			end++
+		}
+		token := runes[start:end]
+		matched := 0
+		if isWord {
+			matched = matchedPrefix(token, words)
+		}
+		if matched > 0 {
+			result.WriteString("<mark>")
+			result.WriteString(html.EscapeString(string(token[:matched])))
+			result.WriteString("</mark>")
+		}
+		result.WriteString(html.EscapeString(string(token[matched:])))
+		start = end
+	}
+	return result.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+//matchedPrefix returns count of runes of word matched by the longest query word
+func matchedPrefix(word []rune, query []string) int {
+	result := 0
+	for _, q := range query {
+		prefix := []rune(q)
+		if len(prefix) <= result || len(prefix) > len(word) {
+			continue
+		}
+		if strings.ToLower(string(word[:len(prefix)])) == q {
+			result = len(prefix)
+		}
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServer_HandleSearchUsers(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	type TestCase struct {
+		Url        string
+		Status     int
+		Ids        []int
+		Highlights []string
+	}
+	tests := []TestCase{
+		{Url: "/users/search?q=vasy&offset=0&limit=10", Status: http.StatusOK,
+			Ids: []int{1, 2}, Highlights: []string{"<mark>Vasy</mark>", "<mark>Vasy</mark>Vasy"}},
+		{Url: "/users/search?q=%20pe&offset=1&limit=10", Status: http.StatusOK,
+			Ids: []int{4}, Highlights: []string{"<mark>Pe</mark>tyPety"}},
+		{Url: "/users/search?q=Sanny&offset=0&limit=10", Status: http.StatusOK,
+			Ids: []int{5}, Highlights: []string{"Sany"}},
+		{Url: "/users/search?q=%2A%21&offset=0&limit=10", Status: http.StatusBadRequest},
+		{Url: "/users/search?q=vasy", Status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost:8081"+test.Url, nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != test.Status {
+			t.Errorf("%s: wrong responce code, got %d expected %d\n", test.Url, w.Code, test.Status)
+			continue
+		}
+		if test.Status != http.StatusOK {
+			continue
+		}
+		var res []api.SearchResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: can't decode %s: %v", test.Url, w.Body.String(), err)
+		}
+		ids, highlights := make([]int, len(res)), make([]string, len(res))
+		for i := range res {
+			ids[i], highlights[i] = res[i].User.Id, res[i].Highlight
+		}
+		if !reflect.DeepEqual(ids, test.Ids) || !reflect.DeepEqual(highlights, test.Highlights) {
+			t.Errorf("%s: expected %v %v got %v %v", test.Url, test.Ids, test.Highlights, ids, highlights)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	type TestCase struct {
+		Name   string
+		Query  string
+		Result string
+	}
+	tests := []TestCase{
+		{Name: "Vasy Pupkin", Query: "pup vas", Result: "<mark>Vas</mark>y <mark>Pup</mark>kin"},
+		{Name: "Vasy Vasilev", Query: "v vasi", Result: "<mark>V</mark>asy <mark>Vasi</mark>lev"},
+		{Name: "<b>Vasy</b>", Query: "b vasy", Result: "&lt;<mark>b</mark>&gt;<mark>Vasy</mark>&lt;/<mark>b</mark>&gt;"},
+		{Name: "Вася Пупкин", Query: "ВАС", Result: "<mark>Вас</mark>я Пупкин"},
+		{Name: "Vasy", Query: "vasya", Result: "Vasy"},
+	}
+	for _, test := range tests {
+		if res := highlight(test.Name, repository.SearchWords(test.Query)); res != test.Result {
+			t.Errorf("%q %q: expected %s got %s", test.Name, test.Query, test.Result, res)
+		}
+	}
+}
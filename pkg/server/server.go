@@ -2,13 +2,21 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/internal/resilience"
+	"github.com/NektarinR/godocker/pkg/grpcapi"
+	"github.com/NektarinR/godocker/pkg/outbox"
 	mx "github.com/gorilla/mux"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -16,6 +24,67 @@ import (
 type Server struct {
 	mux *mx.Router
 	db  repository.IRepository
+	//IdempotencyTTL - how long responses of POST /users/ are kept for replay
+	IdempotencyTTL time.Duration
+	//UserRetention - how long soft-deleted users are kept before purge
+	UserRetention time.Duration
+	//MaxBatchSize - max count of users in one POST /users:batch
+	MaxBatchSize int
+	//AdminToken - bearer token of administrator, admin requests are disabled if empty
+	AdminToken string
+	//GRPCPort - port of gRPC UserService, it shares the HTTP port if 0
+	GRPCPort int
+	//GRPCGateway - serve HTTP/JSON mapping of UserService under /v1/
+	GRPCGateway bool
+	//WebhookAttempts - attempts of a webhook delivery before it is dead
+	WebhookAttempts int
+	//WebhookRetryWait - wait before the second attempt, it doubles with every attempt
+	WebhookRetryWait time.Duration
+	//UserCacheSize - count of users cached in memory, the cache is disabled if 0
+	UserCacheSize int
+	//UserCacheTTL - how long cached users are kept, a minute if 0
+	UserCacheTTL time.Duration
+	//ResponseCacheSize - count of responses of GET /users and /users/{id}
+	//kept in memory, the cache is disabled if 0
+	ResponseCacheSize int
+	//ResponseCacheTTL - how long responses are kept, 10 seconds if 0
+	ResponseCacheTTL time.Duration
+	//OutboxSinks - sinks of the outbox besides webhooks
+	OutboxSinks []outbox.Sink
+	//DbReplicas - host:port of read replicas, they share credentials with the primary
+	DbReplicas []string
+	//DbRetryAttempts - max count of calls of the database on transient failures, 3 if 0
+	DbRetryAttempts int
+	//BreakerThreshold - outages of the database in a row which open the circuit breaker, 5 if 0
+	BreakerThreshold int
+	//BreakerCooldown - how long the open breaker fast-fails calls, 10 seconds if 0
+	BreakerCooldown time.Duration
+
+	responses *responseCache
+	breaker   *resilience.Breaker
+	//dbCloser closes the database opened by InitDb, wrappers of db hide it
+	dbCloser io.Closer
+
+	graphqlOnce sync.Once
+	graphql     http.Handler
+
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	stop      chan struct{}
+	//streams - active WebSocket connections
+	streams sync.WaitGroup
+}
+
+//NewServer creates server working with db, routes are initialized
+func NewServer(db repository.IRepository) *Server {
+	srv := &Server{db: db}
+	srv.InitRouters()
+	return srv
+}
+
+//ServeHTTP lets server be used as http.Handler, e.g. in httptest
+func (p *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
 }
 
 func Logging(text string) {
@@ -27,18 +96,83 @@ func (p *Server) InitRouters() {
 	p.mux = mx.NewRouter()
 	p.mux.HandleFunc("/ping", p.HandlePing).
 		Methods(http.MethodGet)
+	p.mux.HandleFunc("/readyz", p.HandleReady).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/openapi.json", p.HandleOpenAPI).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/debug/vars", p.HandleMetrics).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/schemas/user.json", p.HandleUserSchema).
+		Methods(http.MethodGet)
 	p.mux.HandleFunc("/users", p.HandleGetUsers).
 		Queries("offset", "{offset:[0-9]+}").
 		Queries("limit", "{limit:[0-9]+}").
 		Methods(http.MethodGet)
+	p.mux.HandleFunc("/users/search", p.HandleSearchUsers).
+		Queries("q", "{q}").
+		Queries("offset", "{offset:[0-9]+}").
+		Queries("limit", "{limit:[0-9]+}").
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/users/export", p.HandleExportUsers).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/users/events", p.HandleUserEvents).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/users/subscribe", p.HandleSubscribeUsers).
+		Methods(http.MethodGet)
 	p.mux.HandleFunc("/users/{id:[0-9]+}", p.HandleGetUserById).
 		Methods(http.MethodGet)
+	p.mux.HandleFunc("/users/{id:[0-9]+}", p.HandleUpdateUser).
+		Methods(http.MethodPut)
+	p.mux.HandleFunc("/users/{id:[0-9]+}", p.HandleDeleteUser).
+		Methods(http.MethodDelete)
+	p.mux.HandleFunc("/users/{id:[0-9]+}:restore", p.HandleRestoreUser).
+		Methods(http.MethodPost)
+	p.mux.HandleFunc("/users/{id:[0-9]+}/history", p.HandleGetUserHistory).
+		Queries("offset", "{offset:[0-9]+}").
+		Queries("limit", "{limit:[0-9]+}").
+		Methods(http.MethodGet)
 	p.mux.HandleFunc("/users/", p.HandleInsertUser).
 		Methods(http.MethodPost)
+	p.mux.HandleFunc("/users:batch", p.HandleInsertUsers).
+		Methods(http.MethodPost)
+	p.mux.HandleFunc("/graphql", p.HandleGraphQL).
+		Methods(http.MethodPost)
+	p.mux.HandleFunc("/webhooks", p.HandleCreateWebhook).
+		Methods(http.MethodPost)
+	p.mux.HandleFunc("/webhooks", p.HandleGetWebhooks).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/webhooks/dead-letters", p.HandleGetDeadLetters).
+		Queries("offset", "{offset:[0-9]+}").
+		Queries("limit", "{limit:[0-9]+}").
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/webhooks/{id:[0-9]+}", p.HandleGetWebhook).
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/webhooks/{id:[0-9]+}", p.HandleUpdateWebhook).
+		Methods(http.MethodPut)
+	p.mux.HandleFunc("/webhooks/{id:[0-9]+}", p.HandleDeleteWebhook).
+		Methods(http.MethodDelete)
+	p.mux.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", p.HandleGetDeliveries).
+		Queries("offset", "{offset:[0-9]+}").
+		Queries("limit", "{limit:[0-9]+}").
+		Methods(http.MethodGet)
+	p.mux.HandleFunc("/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}:retry", p.HandleRetryDelivery).
+		Methods(http.MethodPost)
 	p.mux.Use(p.loggingMiddleware)
+	p.mux.Use(p.auditMiddleware)
+	p.mux.Use(p.retryAfterMiddleware)
+	p.mux.Use(p.cachePolicyMiddleware)
+	p.mux.Use(p.responseCacheMiddleware)
 	log.Println("Конец инициализации routes")
 }
 
+func (p *Server) isAdmin(r *http.Request) bool {
+	if p.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) == 1
+}
+
 func (p *Server) InitDb() (err error) {
 	log.Println("Старт инициализация соединения с db")
 	conf := &repository.DbConfig{
@@ -48,44 +182,111 @@ func (p *Server) InitDb() (err error) {
 		Password: "12345",
 		DbName:   "test",
 	}
+	for _, addr := range p.DbReplicas {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Printf("Ошибка в адресе реплики %s %v\n", addr, err)
+			continue
+		}
+		replica := *conf
+		if replica.Port, err = strconv.Atoi(port); err != nil {
+			log.Printf("Ошибка в адресе реплики %s %v\n", addr, err)
+			continue
+		}
+		replica.Host = host
+		conf.Replicas = append(conf.Replicas, replica)
+	}
 	p.db, err = repository.NewPostgreDB(conf, Logging)
 	if err != nil {
 		log.Printf("Ошибка при соединение с БД %v\n", err)
 	}
+	p.dbCloser, _ = p.db.(io.Closer)
 	log.Println("Конец инициализация соединения с db")
 	return nil
 }
 
+//newHTTPServer - export and events renew WriteTimeout while they stream
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  60 * time.Second,
+		ConnContext:  withConn,
+	}
+}
+
 func (p *Server) Run(port int) {
 	log.Printf("Запуск http сервера на порту %d\n", port)
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, syscall.SIGINT)
 
 	p.InitDb()
+	p.useResilience()
+	p.useUserCache()
+	p.useResponseCache()
 	p.InitRouters()
 
-	srv := &http.Server{
-		Addr:         ":" + strconv.Itoa(port),
-		Handler:      p.mux,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	users := grpcapi.NewUserServer(p.db, p.AdminToken)
+	grpcSrv := grpcapi.NewServer(users)
+	var handler http.Handler
+	if p.sharesPort(port) {
+		handler = p.handler(grpcSrv, users)
+	} else {
+		handler = p.handler(nil, users)
+		lis, err := net.Listen("tcp", ":"+strconv.Itoa(p.GRPCPort))
+		if err != nil {
+			log.Fatalf("Ошибка при запуске gRPC сервера %v\n", err)
+		}
+		log.Printf("Запуск gRPC сервера на порту %d\n", p.GRPCPort)
+		go grpcSrv.Serve(lis)
 	}
 
+	srv := newHTTPServer(":"+strconv.Itoa(port), handler)
+	//Shutdown does not interrupt active connections, event streams are ended here
+	srv.RegisterOnShutdown(p.stopStreams)
+
+	stopJobs := make(chan struct{})
+	go p.runPurge(stopJobs)
+	if p.db != nil {
+		go p.watchResponses(p.db.Changes(), stopJobs)
+	}
+	hooks := p.newDispatcher()
+	go hooks.run(stopJobs)
+	if p.db != nil {
+		relay := outbox.NewRelay(p.db, append([]outbox.Sink{hooks}, p.OutboxSinks...)...)
+		go relay.Run(stopJobs)
+	}
+
+	stopped := make(chan struct{})
 	go func(serv *http.Server, exitHttp <-chan os.Signal) {
+		defer close(stopped)
 		<-exitHttp
 		log.Println("Сервер останавливается...")
+		close(stopJobs)
 		ctx, cancel := context.WithTimeout(context.Background(),
 			10*time.Second)
 		defer cancel()
 		if err := serv.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
 
 		}
+		if err := p.waitStreams(ctx); err != nil {
+			log.Printf("WebSocket соединения не закрыты %v\n", err)
+		}
+		grpcSrv.GracefulStop()
 	}(srv, exit)
 
 	log.Println("Сервер запущен")
-	if err := srv.ListenAndServe(); err != nil {
-
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Ошибка http сервера %v\n", err)
+		return
+	}
+	<-stopped
+	if p.dbCloser != nil {
+		if err := p.dbCloser.Close(); err != nil {
+			log.Printf("Ошибка при закрытии соединения с БД %v\n", err)
+		}
 	}
 	log.Println("Сервер остановлен")
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+//writeTimeout limits writing of a response, streams renew it on every write
+const writeTimeout = 15 * time.Second
+
+type connCtxKey int
+
+const connKey connCtxKey = 0
+
+//withConn is http.Server.ConnContext, streams find their connection by it
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey, conn)
+}
+
+//streamWriter lifts the server WriteTimeout for export and events: instead
+//of one deadline for the whole response every write gets writeTimeout of its own,
+//so a long stream goes on while a stuck client is still dropped
+type streamWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	//HTTP/2 streams have no connection of their own and no WriteTimeout
+	conn, _ := r.Context().Value(connKey).(net.Conn)
+	return &streamWriter{ResponseWriter: w, conn: conn}
+}
+
+func (p *streamWriter) extend() {
+	if p.conn != nil {
+		p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+}
+
+func (p *streamWriter) Write(data []byte) (int, error) {
+	p.extend()
+	return p.ResponseWriter.Write(data)
+}
+
+func (p *streamWriter) Flush() {
+	p.extend()
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	mx "github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errServerBusy        = errors.New("server is busy")
+	errBadDeliveryStatus = errors.New("bad status")
+	//defaultWebhookEvents - events of webhook created without them
+	defaultWebhookEvents = []string{repository.ChangeCreated, repository.ChangeDeleted}
+)
+
+//withTimeout runs fn with the timeout of handlers, errServerBusy is returned
+//if fn does not finish in time
+func withTimeout(r *http.Request, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(r.Context(), repository.RequestTimeout)
+	defer cancel()
+	exitRequest := make(chan error, 1)
+	go func(insideCtx context.Context, exit chan<- error) {
+		exit <- fn(insideCtx)
+	}(ctx, exitRequest)
+	select {
+	case err := <-exitRequest:
+		return err
+	case <-ctx.Done():
+		return errServerBusy
+	}
+}
+
+//requireAdmin answers 403 to everybody but administrator
+func (p *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !p.isAdmin(r) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+//POST method - /webhooks, admin only
+func (p *Server) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	var input api.WebhookInput
+	if err := decodeRequest(r, r.Body, &input); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	hook, err := fromAPIWebhook(&input, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.Webhook)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	err = withTimeout(r, func(ctx context.Context) error {
+		return p.db.CreateWebhook(ctx, hook)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), dbErrorStatus(err))
+		return
+	}
+	w.Header().Set("Location", "/webhooks/"+strconv.Itoa(hook.Id))
+	result := toAPIWebhook(hook)
+	result.Secret = hook.Secret
+	encodeResponse(w, c, http.StatusCreated, result)
+}
+
+//GET method - /webhooks, admin only
+func (p *Server) HandleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	c, err := negotiateCodec(r, []api.Webhook(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var hooks []repository.Webhook
+	err = withTimeout(r, func(ctx context.Context) (err error) {
+		hooks, err = p.db.ListWebhooks(ctx)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), dbErrorStatus(err))
+		return
+	}
+	result := make([]api.Webhook, len(hooks))
+	for i := range hooks {
+		result[i] = *toAPIWebhook(&hooks[i])
+	}
+	encodeResponse(w, c, http.StatusOK, result)
+}
+
+//GET method - /webhooks/{id}, admin only
+func (p *Server) HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mx.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.Webhook)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var hook *repository.Webhook
+	err = withTimeout(r, func(ctx context.Context) (err error) {
+		hook, err = p.db.GetWebhook(ctx, id)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	encodeResponse(w, c, http.StatusOK, toAPIWebhook(hook))
+}
+
+//PUT method - /webhooks/{id}, admin only
+func (p *Server) HandleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mx.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	var input api.WebhookInput
+	if err := decodeRequest(r, r.Body, &input); err != nil {
+		http.Error(w, err.Error(), decodeErrorStatus(err))
+		return
+	}
+	c, err := negotiateCodec(r, (*api.Webhook)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var hook *repository.Webhook
+	err = withTimeout(r, func(ctx context.Context) error {
+		stored, err := p.db.GetWebhook(ctx, id)
+		if err != nil {
+			return err
+		}
+		if hook, err = fromAPIWebhook(&input, stored); err != nil {
+			return err
+		}
+		return p.db.UpdateWebhook(ctx, hook)
+	})
+	if _, ok := err.(webhookInputError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	encodeResponse(w, c, http.StatusOK, toAPIWebhook(hook))
+}
+
+//DELETE method - /webhooks/{id}, admin only
+func (p *Server) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(mx.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	err = withTimeout(r, func(ctx context.Context) error {
+		return p.db.DeleteWebhook(ctx, id)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//GET method - /webhooks/{id}/deliveries?offset=0&limit=25&status=dead, admin only
+func (p *Server) HandleGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	p.writeDeliveries(w, r, id, r.URL.Query().Get("status"))
+}
+
+//GET method - /webhooks/dead-letters?offset=0&limit=25, deliveries of all
+//webhooks which ran out of attempts, admin only
+func (p *Server) HandleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	p.writeDeliveries(w, r, 0, repository.DeliveryDead)
+}
+
+func (p *Server) writeDeliveries(w http.ResponseWriter, r *http.Request, id int, status string) {
+	offset, limit, err := parseURL(mx.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch status {
+	case "", repository.DeliveryPending, repository.DeliverySucceeded, repository.DeliveryDead:
+	default:
+		http.Error(w, errBadDeliveryStatus.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, []api.WebhookDelivery(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var deliveries []repository.WebhookDelivery
+	err = withTimeout(r, func(ctx context.Context) (err error) {
+		deliveries, err = p.db.Deliveries(ctx, id, status, offset, limit)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), dbErrorStatus(err))
+		return
+	}
+	result := make([]api.WebhookDelivery, len(deliveries))
+	for i := range deliveries {
+		result[i] = *toAPIDelivery(&deliveries[i])
+	}
+	encodeResponse(w, c, http.StatusOK, result)
+}
+
+//POST method - /webhooks/{id}/deliveries/{delivery_id}:retry, sends the delivery
+//again with a fresh count of attempts, admin only
+func (p *Server) HandleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	if !p.requireAdmin(w, r) {
+		return
+	}
+	vars := mx.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "bad id", http.StatusBadRequest)
+		return
+	}
+	deliveryId, err := strconv.ParseInt(vars["delivery_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "bad delivery id", http.StatusBadRequest)
+		return
+	}
+	c, err := negotiateCodec(r, (*api.WebhookDelivery)(nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	var delivery *repository.WebhookDelivery
+	err = withTimeout(r, func(ctx context.Context) (err error) {
+		delivery, err = p.db.GetDelivery(ctx, deliveryId)
+		if err != nil {
+			return err
+		}
+		if delivery.WebhookId != id {
+			return gorm.ErrRecordNotFound
+		}
+		delivery.Status = repository.DeliveryPending
+		delivery.Attempts = 0
+		delivery.NextAttemptOn = time.Now()
+		return p.db.UpdateDelivery(ctx, delivery)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), writeErrorStatus(err))
+		return
+	}
+	encodeResponse(w, c, http.StatusAccepted, toAPIDelivery(delivery))
+}
+
+type webhookInputError string
+
+func (p webhookInputError) Error() string {
+	return string(p)
+}
+
+//fromAPIWebhook validates input and applies it to stored webhook,
+//stored is nil on creation
+func fromAPIWebhook(input *api.WebhookInput, stored *repository.Webhook) (*repository.Webhook, error) {
+	result := &repository.Webhook{Active: true}
+	if stored != nil {
+		*result = *stored
+	}
+	u, err := url.Parse(strings.TrimSpace(input.Url))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, webhookInputError("url must be absolute http or https URL")
+	}
+	result.Url = u.String()
+	events := input.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	result.Events = nil
+	for _, event := range events {
+		switch event {
+		case repository.ChangeCreated, repository.ChangeUpdated, repository.ChangeDeleted:
+		default:
+			return nil, webhookInputError("unknown event " + event)
+		}
+		duplicate := false
+		for _, v := range result.Events {
+			duplicate = duplicate || v == event
+		}
+		if !duplicate {
+			result.Events = append(result.Events, event)
+		}
+	}
+	if input.Active != nil {
+		result.Active = *input.Active
+	}
+	if input.Secret != "" {
+		result.Secret = input.Secret
+	}
+	if result.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		result.Secret = hex.EncodeToString(secret)
+	}
+	return result, nil
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/NektarinR/godocker/pkg/outbox"
+	"github.com/NektarinR/godocker/pkg/webhook"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret-token"
+
+func adminRequest(t *testing.T, srv http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "http://localhost:8081"+url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	srv.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer_HandleWebhooks(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+
+	tests := []TestCase{
+		{Method: "POST", Url: "/webhooks", RequestBody: `{"url":"ftp://example.com"}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "url must be absolute http or https URL\n"},
+		{Method: "POST", Url: "/webhooks", RequestBody: `{"url":"http://example.com","events":["renamed"]}`,
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "unknown event renamed\n"},
+		{Method: "GET", Url: "/webhooks/1", ResponseStatus: http.StatusNotFound, ResponseBody: "record not found\n"},
+		{Method: "GET", Url: "/webhooks/dead-letters?offset=0&limit=10", ResponseStatus: http.StatusOK, ResponseBody: "[]"},
+		{Method: "GET", Url: "/webhooks/1/deliveries?offset=0&limit=10&status=lost",
+			ResponseStatus: http.StatusBadRequest, ResponseBody: "bad status\n"},
+	}
+	for _, test := range tests {
+		w := adminRequest(t, srv, test.Method, test.Url, test.RequestBody)
+		if w.Code != test.ResponseStatus || w.Body.String() != test.ResponseBody {
+			t.Errorf("%s %s: expected %d %q, got %d %q\n", test.Method, test.Url,
+				test.ResponseStatus, test.ResponseBody, w.Code, w.Body.String())
+		}
+	}
+
+	w := adminRequest(t, srv, "POST", "/webhooks", `{"url":"http://example.com/hook","events":["created","created","updated"]}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/webhooks/1" {
+		t.Fatalf("expected 201 with Location /webhooks/1, got %d %v\n", w.Code, w.Header())
+	}
+	var hook api.Webhook
+	json.NewDecoder(w.Body).Decode(&hook)
+	if len(hook.Secret) != 64 || !hook.Active || strings.Join(hook.Events, ",") != "created,updated" {
+		t.Errorf("expected active webhook with generated secret, got %v\n", hook)
+	}
+
+	w = adminRequest(t, srv, "PUT", "/webhooks/1", `{"url":"https://example.com/hook","active":false}`)
+	hook = api.Webhook{}
+	json.NewDecoder(w.Body).Decode(&hook)
+	if w.Code != http.StatusOK || hook.Active || hook.Secret != "" ||
+		hook.Url != "https://example.com/hook" || strings.Join(hook.Events, ",") != "created,deleted" {
+		t.Errorf("expected updated inactive webhook without secret, got %d %v\n", w.Code, hook)
+	}
+	stored, _ := db.GetWebhook(context.Background(), 1)
+	if len(stored.Secret) != 64 {
+		t.Errorf("expected secret to be kept, got %q\n", stored.Secret)
+	}
+
+	w = adminRequest(t, srv, "GET", "/webhooks", "")
+	var hooks []api.Webhook
+	json.NewDecoder(w.Body).Decode(&hooks)
+	if w.Code != http.StatusOK || len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Errorf("expected one webhook without secret, got %d %v\n", w.Code, hooks)
+	}
+
+	if w = adminRequest(t, srv, "DELETE", "/webhooks/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusNoContent)
+	}
+	if w = adminRequest(t, srv, "DELETE", "/webhooks/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServer_HandleWebhooks_Forbidden(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8081/webhooks", nil)
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusForbidden)
+	}
+}
+
+//receiver - local webhook endpoint which checks signatures,
+//it answers with status until it is changed
+type receiver struct {
+	mu     sync.Mutex
+	secret string
+	status int
+	events []api.WebhookEvent
+	ids    []string
+	errors []error
+}
+
+func (p *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := webhook.Verify(p.secret, r.Header, body, time.Minute); err != nil {
+		p.errors = append(p.errors, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if p.status != http.StatusOK {
+		w.WriteHeader(p.status)
+		return
+	}
+	var event api.WebhookEvent
+	json.Unmarshal(body, &event)
+	p.events = append(p.events, event)
+	p.ids = append(p.ids, r.Header.Get(webhook.DeliveryHeader))
+	w.WriteHeader(p.status)
+}
+
+func (p *receiver) setStatus(status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = status
+}
+
+func (p *receiver) received() []api.WebhookEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]api.WebhookEvent(nil), p.events...)
+}
+
+//waitDeliveries polls the delivery log until there are count deliveries with status
+func waitDeliveries(t *testing.T, srv http.Handler, url, status string, count int) []api.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var deliveries []api.WebhookDelivery
+		w := adminRequest(t, srv, "GET", url, "")
+		json.NewDecoder(w.Body).Decode(&deliveries)
+		matched := 0
+		for _, v := range deliveries {
+			if v.Status == status {
+				matched++
+			}
+		}
+		if matched == count {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d %s deliveries, got %v\n", count, status, deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startDispatcher(t *testing.T, srv *Server) func() {
+	d := srv.newDispatcher()
+	d.poll = 10 * time.Millisecond
+	relay := outbox.NewRelay(srv.db, d)
+	relay.Interval = 10 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan struct{}, 2)
+	go func() {
+		d.run(stop)
+		done <- struct{}{}
+	}()
+	go func() {
+		relay.Run(stop)
+		done <- struct{}{}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		<-done
+	}
+}
+
+func TestServer_WebhookDelivery(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	hookReceiver := &receiver{secret: "shh", status: http.StatusOK}
+	ts := httptest.NewServer(hookReceiver)
+	defer ts.Close()
+	stop := startDispatcher(t, srv)
+	defer stop()
+
+	w := adminRequest(t, srv, "POST", "/webhooks", `{"url":"`+ts.URL+`","secret":"shh"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusCreated)
+	}
+	adminRequest(t, srv, "POST", "/users/", `{"name":"Kolya"}`)
+	adminRequest(t, srv, "PUT", "/users/6", `{"name":"Kolyan"}`)
+	adminRequest(t, srv, "DELETE", "/users/6", "")
+
+	deliveries := waitDeliveries(t, srv, "/webhooks/1/deliveries?offset=0&limit=10", repository.DeliverySucceeded, 2)
+	events := hookReceiver.received()
+	if len(events) != 2 || events[0].Event != "user.created" || events[1].Event != "user.deleted" ||
+		events[0].User.Name != "Kolya" || events[1].User.DeletedOn == nil {
+		t.Errorf("expected created and deleted events, got %v\n", events)
+	}
+	if len(hookReceiver.errors) != 0 {
+		t.Errorf("expected valid signatures, got %v\n", hookReceiver.errors)
+	}
+	if deliveries[0].Event != "user.deleted" || deliveries[0].Attempts != 1 ||
+		deliveries[0].ResponseCode != http.StatusOK || deliveries[0].DeliveredOn == nil {
+		t.Errorf("expected newest delivered user.deleted first, got %v\n", deliveries[0])
+	}
+}
+
+func TestServer_WebhookDelivery_DeadLetter(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	srv.WebhookAttempts = 3
+	srv.WebhookRetryWait = time.Millisecond
+	hookReceiver := &receiver{secret: "shh", status: http.StatusServiceUnavailable}
+	ts := httptest.NewServer(hookReceiver)
+	defer ts.Close()
+	stop := startDispatcher(t, srv)
+	defer stop()
+
+	adminRequest(t, srv, "POST", "/webhooks", `{"url":"`+ts.URL+`","secret":"shh"}`)
+	adminRequest(t, srv, "DELETE", "/users/1", "")
+
+	dead := waitDeliveries(t, srv, "/webhooks/dead-letters?offset=0&limit=10", repository.DeliveryDead, 1)
+	if dead[0].Attempts != 3 || dead[0].ResponseCode != http.StatusServiceUnavailable ||
+		dead[0].Error != "unexpected status 503" {
+		t.Errorf("expected dead delivery after 3 attempts, got %v\n", dead[0])
+	}
+
+	hookReceiver.setStatus(http.StatusOK)
+	w := adminRequest(t, srv, "POST", "/webhooks/1/deliveries/1:retry", "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("wrong responce code, got %d expected %d\n", w.Code, http.StatusAccepted)
+	}
+	waitDeliveries(t, srv, "/webhooks/1/deliveries?offset=0&limit=10", repository.DeliverySucceeded, 1)
+	if events := hookReceiver.received(); len(events) != 1 || events[0].User.Id != 1 {
+		t.Errorf("expected deleted user 1, got %v\n", events)
+	}
+	if w := adminRequest(t, srv, "POST", "/webhooks/2/deliveries/1:retry", ""); w.Code != http.StatusNotFound {
+		t.Errorf("wrong responce code, got %d expected %d\n", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServer_WebhookDelivery_Republished(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	srv.AdminToken = testAdminToken
+	hookReceiver := &receiver{secret: "shh", status: http.StatusOK}
+	ts := httptest.NewServer(hookReceiver)
+	defer ts.Close()
+	adminRequest(t, srv, "POST", "/webhooks", `{"url":"`+ts.URL+`","secret":"shh"}`)
+
+	d := srv.newDispatcher()
+	msg := &outbox.Message{Id: 42, Type: "user.created", Payload: []byte(`{"id":7,"name":"Kolya"}`)}
+	for i := 0; i < 2; i++ {
+		if err := d.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("expected nil got %v\n", err)
+		}
+	}
+	d.deliverDue()
+
+	deliveries := waitDeliveries(t, srv, "/webhooks/1/deliveries?offset=0&limit=10", repository.DeliverySucceeded, 1)
+	if len(deliveries) != 1 {
+		t.Errorf("expected one delivery of republished event, got %v\n", deliveries)
+	}
+	if events := hookReceiver.received(); len(events) != 1 || events[0].Id != 42 || events[0].User.Id != 7 {
+		t.Errorf("expected event 42 once, got %v\n", events)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//wsWriteWait - time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	//wsPongWait - connection is closed if nothing is read during it
+	wsPongWait = 60 * time.Second
+	//wsPingPeriod - interval of pings, must be less than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	//wsMaxMessageSize - max size of a message from the client
+	wsMaxMessageSize = 4096
+	//wsMaxSubscriptions - max count of user ids subscribed by one connection
+	wsMaxSubscriptions = 1000
+	//wsSendBuffer - replies and changes waiting for a slow client,
+	//the connection is closed with 1013 when they overflow
+	wsSendBuffer = 64
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+//wsConn - state of one subscription connection, ids are changed by the reader
+//and read by the writer
+type wsConn struct {
+	conn    *websocket.Conn
+	mu      sync.Mutex
+	ids     map[int]bool
+	replies chan api.SubscriptionMessage
+	//done is closed when the reader stops
+	done chan struct{}
+}
+
+//GET method - /users/subscribe, WebSocket with JSON messages:
+//{"type":"subscribe","ids":[1,2]}, {"type":"unsubscribe","ids":[1]}, {"type":"ping"}.
+//Changes of subscribed users are pushed as {"type":"change",...}
+func (p *Server) HandleSubscribeUsers(w http.ResponseWriter, r *http.Request) {
+	//Upgrade replies with error itself
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	p.streams.Add(1)
+	defer p.streams.Done()
+	defer conn.Close()
+	sub, _, _ := p.db.Changes().Subscribe(-1, wsSendBuffer)
+	defer sub.Close()
+
+	c := &wsConn{
+		conn:    conn,
+		ids:     make(map[int]bool),
+		replies: make(chan api.SubscriptionMessage, wsSendBuffer),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-c.replies:
+			if !ok {
+				c.close(websocket.ClosePolicyViolation, "too many requests")
+				return
+			}
+			if err := c.write(&msg); err != nil {
+				return
+			}
+		case change, ok := <-sub.C():
+			if !ok {
+				c.close(websocket.CloseTryAgainLater, "client is too slow")
+				return
+			}
+			if !c.subscribed(change.User.Id) {
+				continue
+			}
+			if err := c.write(changeMessage(&change)); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		case <-p.stopping():
+			c.close(websocket.CloseGoingAway, "server is shutting down")
+			return
+		}
+	}
+}
+
+//readLoop handles requests of the client until the connection fails,
+//replies channel is closed if the client does not read them
+func (p *wsConn) readLoop() {
+	defer close(p.done)
+	p.conn.SetReadLimit(wsMaxMessageSize)
+	p.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	p.conn.SetPongHandler(func(string) error {
+		return p.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		p.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		reply := p.handle(data)
+		select {
+		case p.replies <- *reply:
+		default:
+			close(p.replies)
+			return
+		}
+	}
+}
+
+func (p *wsConn) handle(data []byte) *api.SubscriptionMessage {
+	var req api.SubscriptionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return &api.SubscriptionMessage{Type: api.MessageError, Error: err.Error()}
+	}
+	reply := &api.SubscriptionMessage{RequestId: req.RequestId}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch req.Type {
+	case api.MessagePing:
+		reply.Type = api.MessagePong
+		return reply
+	case api.MessageSubscribe:
+		added := 0
+		for _, id := range req.Ids {
+			if !p.ids[id] {
+				added++
+			}
+		}
+		if len(p.ids)+added > wsMaxSubscriptions {
+			reply.Type = api.MessageError
+			reply.Error = "too many subscriptions"
+			return reply
+		}
+		for _, id := range req.Ids {
+			p.ids[id] = true
+		}
+		reply.Type = api.MessageSubscribed
+	case api.MessageUnsubscribe:
+		for _, id := range req.Ids {
+			delete(p.ids, id)
+		}
+		reply.Type = api.MessageUnsubscribed
+	default:
+		reply.Type = api.MessageError
+		reply.Error = "unknown message type"
+		return reply
+	}
+	reply.Ids = make([]int, 0, len(p.ids))
+	for id := range p.ids {
+		reply.Ids = append(reply.Ids, id)
+	}
+	sort.Ints(reply.Ids)
+	return reply
+}
+
+func (p *wsConn) subscribed(id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ids[id]
+}
+
+func (p *wsConn) write(msg *api.SubscriptionMessage) error {
+	p.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return p.conn.WriteJSON(msg)
+}
+
+//close sends close frame and waits for the client to answer it
+func (p *wsConn) close(code int, text string) {
+	p.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteWait))
+	select {
+	case <-p.done:
+	case <-time.After(wsWriteWait):
+	}
+}
+
+func changeMessage(change *repository.Change) *api.SubscriptionMessage {
+	return &api.SubscriptionMessage{
+		Type:    api.MessageChange,
+		EventId: change.Id,
+		Change:  change.Type,
+		User:    toAPIUser(&change.User),
+	}
+}
+
+//waitStreams waits for hijacked connections, Shutdown of http.Server does not track them
+func (p *Server) waitStreams(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
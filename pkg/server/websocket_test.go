@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"github.com/NektarinR/godocker/internal/repository"
+	"github.com/NektarinR/godocker/pkg/api"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dialSubscribe(t *testing.T, url string) *websocket.Conn {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/users/subscribe", nil)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("wrong responce code, got %d expected %d\n", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func request(t *testing.T, conn *websocket.Conn, req api.SubscriptionRequest) *api.SubscriptionMessage {
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	var msg api.SubscriptionMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	return &msg
+}
+
+func TestServer_HandleSubscribeUsers(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	ts := httptest.NewServer(NewServer(db))
+	defer ts.Close()
+	conn := dialSubscribe(t, ts.URL)
+	defer conn.Close()
+
+	type TestCase struct {
+		Request api.SubscriptionRequest
+		Reply   api.SubscriptionMessage
+	}
+	tests := []TestCase{
+		{api.SubscriptionRequest{Type: "ping", RequestId: "1"},
+			api.SubscriptionMessage{Type: "pong", RequestId: "1"}},
+		{api.SubscriptionRequest{Type: "subscribe", RequestId: "2", Ids: []int{3, 1, 2}},
+			api.SubscriptionMessage{Type: "subscribed", RequestId: "2", Ids: []int{1, 2, 3}}},
+		{api.SubscriptionRequest{Type: "unsubscribe", Ids: []int{1, 5}},
+			api.SubscriptionMessage{Type: "unsubscribed", Ids: []int{2, 3}}},
+		{api.SubscriptionRequest{Type: "join"},
+			api.SubscriptionMessage{Type: "error", Error: "unknown message type"}},
+	}
+	for _, test := range tests {
+		if reply := request(t, conn, test.Request); !reflect.DeepEqual(*reply, test.Reply) {
+			t.Errorf("expected %v, got %v\n", test.Reply, *reply)
+		}
+	}
+
+	//user 1 is not subscribed anymore, only the change of user 2 is pushed
+	db.DeleteUser(context.Background(), 1, 0)
+	usr := &repository.User{PrivateUser: repository.PrivateUser{Id: 2}, PublicUser: repository.PublicUser{Name: "Kolya"}}
+	db.UpdateUser(context.Background(), usr)
+	var msg api.SubscriptionMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+	if msg.Type != "change" || msg.Change != "updated" || msg.EventId != 2 ||
+		msg.User == nil || msg.User.Id != 2 || msg.User.Name != "Kolya" {
+		t.Errorf("expected update of user 2, got %v\n", msg)
+	}
+}
+
+func TestServer_HandleSubscribeUsers_TooManySubscriptions(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	ts := httptest.NewServer(NewServer(db))
+	defer ts.Close()
+	conn := dialSubscribe(t, ts.URL)
+	defer conn.Close()
+	ids := make([]int, wsMaxSubscriptions+1)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	reply := request(t, conn, api.SubscriptionRequest{Type: "subscribe", Ids: ids})
+	if reply.Type != "error" || reply.Error != "too many subscriptions" {
+		t.Errorf("expected too many subscriptions, got %v\n", reply)
+	}
+}
+
+func TestServer_HandleSubscribeUsers_Shutdown(t *testing.T) {
+	db, _ := repository.NewPostgresDBMock()
+	srv := NewServer(db)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn := dialSubscribe(t, ts.URL)
+	defer conn.Close()
+	request(t, conn, api.SubscriptionRequest{Type: "ping"})
+	srv.stopStreams()
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected close going away, got %v\n", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.waitStreams(ctx); err != nil {
+		t.Errorf("expected nil, got %v\n", err)
+	}
+}
@@ -0,0 +1,56 @@
+//Package webhook signs webhook deliveries, receivers use Verify to check them
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//SignatureHeader - "sha256=" and hex HMAC-SHA256 of timestamp, "." and body
+	SignatureHeader = "X-Webhook-Signature"
+	//TimestampHeader - Unix seconds when the attempt was signed
+	TimestampHeader = "X-Webhook-Timestamp"
+	//EventHeader - type of the event, e.g. user.created
+	EventHeader = "X-Webhook-Event"
+	//DeliveryHeader - id of the delivery, it is the same for all attempts
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("signature is expired")
+)
+
+//Sign returns value of SignatureHeader for the body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//Verify checks signature of the delivery and rejects ones signed
+//more than tolerance ago, zero tolerance disables the check
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signature := header.Get(SignatureHeader)
+	if !strings.HasPrefix(signature, "sha256=") ||
+		!hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(timestamp, 0)) > tolerance {
+		return ErrExpired
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"event":"user.created"}`)
+	now := time.Now().Unix()
+	type TestCase struct {
+		Name      string
+		Secret    string
+		Timestamp int64
+		Body      string
+		Err       error
+	}
+	tests := []TestCase{
+		{Name: "valid", Secret: "shh", Timestamp: now, Body: string(body), Err: nil},
+		{Name: "wrong secret", Secret: "psst", Timestamp: now, Body: string(body), Err: ErrInvalidSignature},
+		{Name: "changed body", Secret: "shh", Timestamp: now, Body: `{}`, Err: ErrInvalidSignature},
+		{Name: "old", Secret: "shh", Timestamp: now - 600, Body: string(body), Err: ErrExpired},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set(TimestampHeader, strconv.FormatInt(test.Timestamp, 10))
+		header.Set(SignatureHeader, Sign(test.Secret, test.Timestamp, body))
+		if err := Verify("shh", header, []byte(test.Body), 5*time.Minute); err != test.Err {
+			t.Errorf("%s: expected %v got %v", test.Name, test.Err, err)
+		}
+	}
+	if err := Verify("shh", http.Header{}, body, 0); err != ErrInvalidSignature {
+		t.Errorf("expected %v got %v", ErrInvalidSignature, err)
+	}
+}